@@ -0,0 +1,342 @@
+package surfstore
+
+import (
+    "errors"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    // Bound on each call to a block server, a server that hangs counts as down
+    DefaultBlockCallTimeout = time.Minute
+)
+
+/**
+* blockRouter spreads blocks over a cluster of block servers. The owner of a block is
+* looked up on a consistent hash ring keyed by the block hash, so adding or removing a
+* server only moves about 1/N of the blocks. With replication, a block is written to the
+* owner and the next Factor-1 servers on the ring, and a write succeeds once WriteQuorum
+* of them have stored it.
+*
+* With erasure coding, shard i of a block goes to the i-th server clockwise from its hash
+* instead, see ErasureCoding.go.
+*
+* While blocks are being moved after a membership change, or while a replica is down,
+* a block may sit on other servers, so reads that fail, come back empty or do not match
+* the block hash are retried on the following servers of the ring. A block that none of
+* them has is an error.
+*/
+type blockRouter struct {
+    ring        *HashRing
+    replication ReplicationConfig
+    // Set when the cluster erasure codes blocks instead of copying them
+    codec *reedSolomon
+
+    mutex sync.Mutex
+    pools map[string]*connPool
+}
+
+func newBlockRouter(addrs []string, replication ReplicationConfig) (*blockRouter, error) {
+    if err := replication.Validate(); err != nil {
+        return nil, err
+    }
+    ring := NewHashRing(addrs, DefaultVirtualNodes)
+    r := &blockRouter{
+        ring:        ring,
+        replication: replication.normalize(len(ring.nodes)),
+        pools:       make(map[string]*connPool),
+    }
+    if replication.erasureCoded() {
+        if len(ring.nodes) < replication.DataShards + replication.ParityShards {
+            return nil, errors.New("Erasure coding needs a block server for every shard")
+        }
+        codec, err := newReedSolomon(replication.DataShards, replication.ParityShards)
+        if err != nil {
+            return nil, err
+        }
+        r.codec = codec
+    }
+    return r, nil
+}
+
+/**
+* Ask the block servers how their cluster protects blocks. Servers that are down are
+* skipped, those that answer must agree.
+*/
+func fetchReplicationConfig(addrs []string) (ReplicationConfig, error) {
+    var replication ReplicationConfig
+    var first string
+    var lastErr error
+    for _, addr := range addrs {
+        pool := newConnPool(addr, 1)
+        pool.timeout = DefaultBlockCallTimeout
+        var config ReplicationConfig
+        var succ bool
+        err := pool.call("Server.GetReplicationConfig", &succ, &config)
+        pool.Close()
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        if first == "" {
+            first = addr
+            replication = config
+        } else if config != replication {
+            return ReplicationConfig{}, errors.New("Block servers " + first + " and " + addr + " disagree on the replication settings")
+        }
+    }
+    if first == "" {
+        return ReplicationConfig{}, lastErr
+    }
+    return replication, nil
+}
+
+func (r *blockRouter) GetBlock(blockHash string, block *Block) error {
+    if r.codec != nil {
+        return r.getErasureCoded(blockHash, block)
+    }
+    var lastErr error
+    for _, addr := range r.ring.Lookup(blockHash, len(r.ring.nodes)) {
+        *block = Block{}
+        err := r.call(addr, "Server.GetBlock", blockHash, block)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        // A server without the block returns it empty
+        if hashBlockData(block.BlockData) == blockHash {
+            return nil
+        }
+        if len(block.BlockData) > 0 {
+            lastErr = errors.New("Block " + blockHash + " from " + addr + " does not match its hash")
+            logError("GetBlock Error: ", lastErr)
+        }
+    }
+    *block = Block{}
+    msg := "Block " + blockHash + " not found on any replica"
+    if lastErr != nil {
+        msg += ", last error: " + lastErr.Error()
+    }
+    return errors.New(msg)
+}
+
+/**
+* Write the block to its replicas in parallel.
+*/
+func (r *blockRouter) PutBlock(block Block, succ *bool) error {
+    if r.codec != nil {
+        return r.putErasureCoded([]Block{block}, DefaultMaxBatchBytes, succ)
+    }
+    replicas := r.ring.Lookup(hashBlockData(block.BlockData), r.replication.Factor)
+    errs := make([]error, len(replicas))
+    var wg sync.WaitGroup
+    for i, addr := range replicas {
+        wg.Add(1)
+        go func(i int, addr string) {
+            defer wg.Done()
+            var ok bool
+            errs[i] = r.call(addr, "Server.PutBlock", block, &ok)
+        }(i, addr)
+    }
+    wg.Wait()
+
+    acks := make([]int, 1)
+    for _, err := range errs {
+        if err == nil {
+            acks[0]++
+        }
+    }
+    if err := r.checkQuorum(acks, errs); err != nil {
+        return err
+    }
+    *succ = true
+    return nil
+}
+
+/**
+* Ask the replicas about their blocks. The result keeps the order of blockHashesIn.
+* A block is only reported if at least WriteQuorum of its replicas have it, otherwise it
+* is uploaded again, which also moves it to a new owner after a membership change.
+*/
+func (r *blockRouter) HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error {
+    if r.codec != nil {
+        return r.hasErasureCoded(blockHashesIn, blockHashesOut)
+    }
+    counts := make(map[string]int)
+    addrs, shards := r.shards(blockHashesIn, r.replication.Factor)
+    for _, addr := range addrs {
+        var hashes []string
+        for _, i := range shards[addr] {
+            hashes = append(hashes, blockHashesIn[i])
+        }
+        var out []string
+        if err := r.call(addr, "Server.HasBlocks", hashes, &out); err != nil {
+            // Treated as missing on this replica
+            logError("HasBlocks Error: ", err)
+            continue
+        }
+        for _, hash := range out {
+            counts[hash]++
+        }
+    }
+    for _, hash := range blockHashesIn {
+        if counts[hash] >= r.replication.WriteQuorum {
+            *blockHashesOut = append(*blockHashesOut, hash)
+            // Counted once even if the hash is repeated
+            counts[hash] = 0
+        }
+    }
+    return nil
+}
+
+/**
+* Fetch every block from its owner, in order. Blocks an owner cannot return are
+* looked for on the other servers one at a time.
+*/
+func (r *blockRouter) GetBlocks(blockHashes []string, blocks *[]Block) error {
+    if r.codec != nil {
+        return r.getBlocksErasureCoded(blockHashes, blocks)
+    }
+    result := make([]Block, len(blockHashes))
+    addrs, shards := r.shards(blockHashes, 1)
+    for _, addr := range addrs {
+        var hashes []string
+        for _, i := range shards[addr] {
+            hashes = append(hashes, blockHashes[i])
+        }
+        var shardBlocks []Block
+        err := getBlocksBatched(r.caller(addr), hashes, &shardBlocks)
+        if err != nil {
+            logError("GetBlocks Error: ", err)
+        }
+        for j, block := range shardBlocks {
+            result[shards[addr][j]] = block
+        }
+    }
+    for i := range result {
+        if hashBlockData(result[i].BlockData) == blockHashes[i] {
+            continue
+        }
+        // Missing or damaged on its owner, try the other servers
+        if err := r.GetBlock(blockHashes[i], &result[i]); err != nil {
+            return err
+        }
+    }
+    *blocks = append(*blocks, result...)
+    return nil
+}
+
+/**
+* Upload every block to its replicas, batching per server and writing to the servers
+* in parallel.
+*/
+func (r *blockRouter) PutBlocks(blocks []Block, maxBatchBytes int, succ *bool) error {
+    if r.codec != nil {
+        return r.putErasureCoded(blocks, maxBatchBytes, succ)
+    }
+    hashes := make([]string, len(blocks))
+    for i, block := range blocks {
+        hashes[i] = hashBlockData(block.BlockData)
+    }
+    addrs, shards := r.shards(hashes, r.replication.Factor)
+    errs := make([]error, len(addrs))
+    var wg sync.WaitGroup
+    for n, addr := range addrs {
+        var shardBlocks []Block
+        for _, i := range shards[addr] {
+            shardBlocks = append(shardBlocks, blocks[i])
+        }
+        wg.Add(1)
+        go func(n int, addr string) {
+            defer wg.Done()
+            var ok bool
+            errs[n] = putBlocksBatched(r.caller(addr), shardBlocks, maxBatchBytes, &ok)
+        }(n, addr)
+    }
+    wg.Wait()
+
+    acks := make([]int, len(blocks))
+    for n, addr := range addrs {
+        if errs[n] != nil {
+            continue
+        }
+        for _, i := range shards[addr] {
+            acks[i]++
+        }
+    }
+    if err := r.checkQuorum(acks, errs); err != nil {
+        return err
+    }
+    *succ = true
+    return nil
+}
+
+/**
+* Fail unless every block was stored by at least WriteQuorum replicas.
+*/
+func (r *blockRouter) checkQuorum(acks []int, errs []error) error {
+    for _, n := range acks {
+        if n >= r.replication.WriteQuorum {
+            continue
+        }
+        var lastErr error
+        for _, err := range errs {
+            if err != nil {
+                lastErr = err
+            }
+        }
+        msg := "Only " + strconv.Itoa(n) + " of " + strconv.Itoa(r.replication.WriteQuorum) + " required servers stored a block"
+        if lastErr != nil {
+            msg += ", last error: " + lastErr.Error()
+        }
+        return errors.New(msg)
+    }
+    return nil
+}
+
+func (r *blockRouter) Close() error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    for _, pool := range r.pools {
+        pool.Close()
+    }
+    return nil
+}
+
+/**
+* Group the positions of blockHashes by the first n servers of each block, a position is
+* listed once for each of its servers. The servers are returned in the order they first appear.
+*/
+func (r *blockRouter) shards(blockHashes []string, n int) ([]string, map[string][]int) {
+    var addrs []string
+    shards := make(map[string][]int)
+    for i, hash := range blockHashes {
+        for _, addr := range r.ring.Lookup(hash, n) {
+            if _, ok := shards[addr]; !ok {
+                addrs = append(addrs, addr)
+            }
+            shards[addr] = append(shards[addr], i)
+        }
+    }
+    return addrs, shards
+}
+
+func (r *blockRouter) call(addr string, serviceMethod string, args interface{}, reply interface{}) error {
+    return r.caller(addr)(serviceMethod, args, reply)
+}
+
+/**
+* Calls on the pooled connections to addr.
+*/
+func (r *blockRouter) caller(addr string) rpcCaller {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    pool, ok := r.pools[addr]
+    if !ok {
+        pool = newConnPool(addr, DefaultMaxIdleConns)
+        pool.timeout = DefaultBlockCallTimeout
+        r.pools[addr] = pool
+    }
+    return pool.call
+}
@@ -0,0 +1,66 @@
+package surfstore
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestBlockRouterReportsMissingBlocks(t *testing.T) {
+    addrs, _ := startTestBlockCluster(t, 3, ReplicationConfig{Factor: 2})
+    router := newTestBlockRouter(t, addrs)
+    _, hashes := testBlocks(2, 100)
+
+    var block Block
+    if err := router.GetBlock(hashes[0], &block); err == nil {
+        t.Fatal("GetBlock returned a block no replica has")
+    }
+    var blocks []Block
+    if err := router.GetBlocks(hashes, &blocks); err == nil {
+        t.Fatal("GetBlocks returned blocks no replica has")
+    }
+}
+
+func TestBlockRouterSkipsDamagedReplicas(t *testing.T) {
+    addrs, _, servers := startTestBlockServers(t, 3, ReplicationConfig{Factor: 2})
+    router := newTestBlockRouter(t, addrs)
+    blocks, hashes := testBlocks(1, 100)
+    var succ bool
+    if err := router.PutBlock(blocks[0], &succ); err != nil {
+        t.Fatal(err)
+    }
+    damage := func(addr string) {
+        for i, server := range servers {
+            if addrs[i] == addr {
+                server.Mutex.Lock()
+                server.BlockStore.(*BlockStore).BlockMap[hashes[0]] = Block{BlockData: []byte("garbage"), BlockSize: 7}
+                server.Mutex.Unlock()
+            }
+        }
+    }
+
+    replicas := router.ring.Lookup(hashes[0], 2)
+    damage(replicas[0])
+    var block Block
+    if err := router.GetBlock(hashes[0], &block); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(block.BlockData, blocks[0].BlockData) {
+        t.Fatal("GetBlock returned the damaged copy")
+    }
+    var got []Block
+    if err := router.GetBlocks(hashes, &got); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got[0].BlockData, blocks[0].BlockData) {
+        t.Fatal("GetBlocks returned the damaged copy")
+    }
+
+    damage(replicas[1])
+    if err := router.GetBlock(hashes[0], &block); err == nil {
+        t.Fatal("GetBlock returned a damaged block")
+    }
+    got = nil
+    if err := router.GetBlocks(hashes, &got); err == nil {
+        t.Fatal("GetBlocks returned a damaged block")
+    }
+}
@@ -3,10 +3,19 @@ package surfstore
 import (
     "crypto/sha256"
     "encoding/hex"
+    "sort"
+    "time"
 )
 
 type BlockStore struct {
     BlockMap map[string]Block
+    // Shards of erasure coded blocks, created on the first put
+    ShardMap map[ShardKey]Shard
+
+    // Last time each block was put or reported by HasBlocks, used by the garbage collector.
+    accessTime map[string]time.Time
+    // Counts the blocks stored and removed, see Generation
+    generation int
 }
 
 /**
@@ -26,7 +35,11 @@ func (bs *BlockStore) PutBlock(block Block, succ *bool) error {
     hash.Write(block.BlockData)
     hashBytes := hash.Sum(nil)
     hashCode := hex.EncodeToString(hashBytes)
+    if _, ok := bs.BlockMap[hashCode]; !ok {
+        bs.generation++
+    }
     bs.BlockMap[hashCode] = block
+    bs.touch(hashCode)
     return nil
 }
 
@@ -38,10 +51,145 @@ func (bs *BlockStore) HasBlocks(blockHashesIn []string, blockHashesOut *[]string
     for _, blockHash := range blockHashesIn {
         if _, ok := bs.BlockMap[blockHash]; ok {
             *blockHashesOut = append(*blockHashesOut, blockHash)
+            // The client will reference this block instead of uploading it.
+            bs.touch(blockHash)
+        }
+    }
+    return nil
+}
+
+/**
+* Retrieves the blocks indexed by the given hashes, in order.
+*/
+func (bs *BlockStore) GetBlocks(blockHashes []string, blocks *[]Block) error {
+    for _, blockHash := range blockHashes {
+        *blocks = append(*blocks, bs.BlockMap[blockHash])
+    }
+    return nil
+}
+
+/**
+* Stores every block in the key-value store.
+*/
+func (bs *BlockStore) PutBlocks(blocks []Block, succ *bool) error {
+    for _, block := range blocks {
+        if err := bs.PutBlock(block, succ); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/**
+* Stores shards of erasure coded blocks.
+*/
+func (bs *BlockStore) PutShards(shards []Shard, succ *bool) error {
+    if bs.ShardMap == nil {
+        bs.ShardMap = make(map[ShardKey]Shard)
+    }
+    for _, shard := range shards {
+        bs.ShardMap[shard.ShardKey] = shard
+        bs.touch(shardName(shard.ShardKey))
+    }
+    *succ = true
+    return nil
+}
+
+/**
+* Retrieves shards in order, a missing shard only has its key set.
+*/
+func (bs *BlockStore) GetShards(keys []ShardKey, shards *[]Shard) error {
+    for _, key := range keys {
+        shard, ok := bs.ShardMap[key]
+        if !ok {
+            shard = Shard{ShardKey: key}
         }
+        *shards = append(*shards, shard)
     }
     return nil
 }
 
+/**
+* Returns the subset of keys whose shards are stored.
+*/
+func (bs *BlockStore) HasShards(keysIn []ShardKey, keysOut *[]ShardKey) error {
+    for _, key := range keysIn {
+        if _, ok := bs.ShardMap[key]; ok {
+            *keysOut = append(*keysOut, key)
+            bs.touch(shardName(key))
+        }
+    }
+    return nil
+}
+
+/**
+* Returns the keys of all stored shards.
+*/
+func (bs *BlockStore) ListShards() ([]ShardKey, error) {
+    keys := make([]ShardKey, 0, len(bs.ShardMap))
+    for key := range bs.ShardMap {
+        keys = append(keys, key)
+    }
+    return keys, nil
+}
+
+/**
+* Removes every block and shard that is not in live and has not been accessed since cutoff.
+* Returns the number of removed blocks.
+*/
+func (bs *BlockStore) SweepBlocks(live map[string]bool, cutoff time.Time) (int, error) {
+    removed := 0
+    for blockHash := range bs.BlockMap {
+        if live[blockHash] || bs.accessTime[blockHash].After(cutoff) {
+            continue
+        }
+        delete(bs.BlockMap, blockHash)
+        delete(bs.accessTime, blockHash)
+        bs.generation++
+        removed++
+    }
+    for key := range bs.ShardMap {
+        name := shardName(key)
+        if live[key.BlockHash] || bs.accessTime[name].After(cutoff) {
+            continue
+        }
+        delete(bs.ShardMap, key)
+        delete(bs.accessTime, name)
+    }
+    return removed, nil
+}
+
+/**
+* Returns the hashes of all stored blocks, sorted.
+*/
+func (bs *BlockStore) ListBlocks() ([]string, error) {
+    blockHashes := make([]string, 0, len(bs.BlockMap))
+    for blockHash := range bs.BlockMap {
+        blockHashes = append(blockHashes, blockHash)
+    }
+    sort.Strings(blockHashes)
+    return blockHashes, nil
+}
+
+/**
+* Changes whenever a block is stored or removed, so listings can be cached in between.
+*/
+func (bs *BlockStore) Generation() int {
+    return bs.generation
+}
+
+/**
+* Record that a block has just been put or referenced.
+*/
+func (bs *BlockStore) touch(blockHash string) {
+    if bs.accessTime == nil {
+        bs.accessTime = make(map[string]time.Time)
+    }
+    bs.accessTime[blockHash] = time.Now()
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
+var _ BlockSweeper = new(BlockStore)
+var _ BlockLister = new(BlockStore)
+var _ ShardStore = new(BlockStore)
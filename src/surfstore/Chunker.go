@@ -0,0 +1,178 @@
+package surfstore
+
+import (
+    "errors"
+    "io"
+)
+
+const (
+    // Cut files into chunks of exactly BlockSize bytes
+    FixedChunking = "fixed"
+    // Cut files where the content says so (FastCDC), see cdcCut
+    CDCChunking = "cdc"
+)
+
+/**
+* How the client cuts files into blocks.
+* For content-defined chunking MinSize, AvgSize and MaxSize bound the chunk sizes,
+* zero values are derived from BlockSize.
+*/
+type ChunkingConfig struct {
+    Mode    string
+    MinSize int
+    AvgSize int
+    MaxSize int
+}
+
+/**
+* Fill in defaults and check that the chunk sizes make sense.
+*/
+func (c ChunkingConfig) normalize(blockSize int) (ChunkingConfig, error) {
+    if c.Mode == "" {
+        c.Mode = FixedChunking
+    }
+    switch c.Mode {
+    case FixedChunking:
+        if blockSize <= 0 {
+            return c, errors.New("Block size must be positive")
+        }
+        c.MinSize, c.AvgSize, c.MaxSize = blockSize, blockSize, blockSize
+    case CDCChunking:
+        if c.AvgSize <= 0 {
+            c.AvgSize = blockSize
+        }
+        if c.MinSize <= 0 {
+            c.MinSize = c.AvgSize / 4
+        }
+        if c.MaxSize <= 0 {
+            c.MaxSize = c.AvgSize * 4
+        }
+        if c.MinSize <= 0 || c.MinSize > c.AvgSize || c.AvgSize > c.MaxSize {
+            return c, errors.New("Chunk sizes must satisfy 0 < min <= avg <= max")
+        }
+    default:
+        return c, errors.New("Unknown chunking mode: " + c.Mode)
+    }
+    return c, nil
+}
+
+/**
+* Check the configuration against the client's block size.
+*/
+func (c ChunkingConfig) Validate(blockSize int) error {
+    _, err := c.normalize(blockSize)
+    return err
+}
+
+/**
+* Split the content of r into chunks and call fn with each of them, in order.
+* An empty input has no chunks. The slice passed to fn is only valid during the call.
+*/
+func splitChunks(r io.Reader, config ChunkingConfig, blockSize int, fn func(chunk []byte) error) error {
+    config, err := config.normalize(blockSize)
+    if err != nil {
+        return err
+    }
+
+    buf := make([]byte, config.MaxSize)
+    filled := 0
+    eof := false
+    for {
+        // Keep at least one maximal chunk in the buffer, unless the input is exhausted
+        for !eof && filled < len(buf) {
+            n, readErr := r.Read(buf[filled:])
+            filled += n
+            if readErr == io.EOF {
+                eof = true
+            } else if readErr != nil {
+                return readErr
+            }
+        }
+        if filled == 0 {
+            return nil
+        }
+
+        cut := filled
+        if config.Mode == CDCChunking {
+            cut = cdcCut(buf[:filled], config)
+        }
+        if err := fn(buf[:cut]); err != nil {
+            return err
+        }
+        filled = copy(buf, buf[cut:filled])
+    }
+}
+
+/**
+* FastCDC cut point: a rolling gear hash is computed over the data and a chunk ends where
+* the top bits of the hash are all zero. Before AvgSize a stricter mask (one more bit) is used
+* and after it a looser one, which pulls chunk sizes towards AvgSize. Because the hash only
+* depends on the last 64 bytes, an insertion only moves the cut points right around it.
+*/
+func cdcCut(data []byte, config ChunkingConfig) int {
+    n := len(data)
+    if n <= config.MinSize {
+        return n
+    }
+    if n > config.MaxSize {
+        n = config.MaxSize
+    }
+    normal := config.AvgSize
+    if normal > n {
+        normal = n
+    }
+
+    bits := uint(0)
+    for (1 << (bits + 1)) <= config.AvgSize {
+        bits++
+    }
+    maskS := topBitsMask(bits + 1)
+    maskL := uint64(0)
+    if bits > 0 {
+        maskL = topBitsMask(bits - 1)
+    }
+
+    var hash uint64
+    i := config.MinSize
+    for ; i < normal; i++ {
+        hash = (hash << 1) + gearTable[data[i]]
+        if hash & maskS == 0 {
+            return i + 1
+        }
+    }
+    for ; i < n; i++ {
+        hash = (hash << 1) + gearTable[data[i]]
+        if hash & maskL == 0 {
+            return i + 1
+        }
+    }
+    return n
+}
+
+/**
+* Mask selecting the highest bits of a 64 bit hash.
+*/
+func topBitsMask(bits uint) uint64 {
+    if bits == 0 {
+        return 0
+    }
+    if bits > 64 {
+        bits = 64
+    }
+    return ^uint64(0) << (64 - bits)
+}
+
+// Random values for each byte, generated from a fixed seed so every client cuts identically
+var gearTable = func() [256]uint64 {
+    var table [256]uint64
+    seed := uint64(0x5375726673746f72)
+    for i := range table {
+        // splitmix64
+        seed += 0x9e3779b97f4a7c15
+        z := seed
+        z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+        z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+        table[i] = z ^ (z >> 31)
+    }
+    return table
+}()
@@ -0,0 +1,92 @@
+package surfstore
+
+import (
+    "bytes"
+    "math/rand"
+    "testing"
+    "testing/iotest"
+)
+
+var testCDCConfig = ChunkingConfig{Mode: CDCChunking, MinSize: 1024, AvgSize: 4096, MaxSize: 16384}
+
+func testChunkData(size int) []byte {
+    data := make([]byte, size)
+    rand.New(rand.NewSource(1)).Read(data)
+    return data
+}
+
+/**
+* The chunks of data and the offsets where they end.
+*/
+func cdcChunks(t *testing.T, data []byte) ([][]byte, []int) {
+    t.Helper()
+    var chunks [][]byte
+    var ends []int
+    end := 0
+    // One byte per read, the chunker has to refill its buffer
+    err := splitChunks(iotest.OneByteReader(bytes.NewReader(data)), testCDCConfig, 4096, func(chunk []byte) error {
+        chunks = append(chunks, append([]byte(nil), chunk...))
+        end += len(chunk)
+        ends = append(ends, end)
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return chunks, ends
+}
+
+func TestCDCChunkSizesWithinBounds(t *testing.T) {
+    data := testChunkData(1 << 20)
+    chunks, _ := cdcChunks(t, data)
+    if len(chunks) < 2 {
+        t.Fatalf("%d chunks", len(chunks))
+    }
+    for i, chunk := range chunks {
+        if len(chunk) > testCDCConfig.MaxSize || len(chunk) == 0 {
+            t.Fatalf("Chunk %d has %d bytes", i, len(chunk))
+        }
+        // Only the last chunk may be shorter than the minimum
+        if i < len(chunks) - 1 && len(chunk) < testCDCConfig.MinSize {
+            t.Fatalf("Chunk %d has %d bytes, less than the minimum", i, len(chunk))
+        }
+    }
+}
+
+func TestCDCChunksReassemble(t *testing.T) {
+    for _, size := range []int{0, 1, testCDCConfig.MinSize, testCDCConfig.MaxSize + 1, 1 << 20} {
+        data := testChunkData(size)
+        chunks, _ := cdcChunks(t, data)
+        if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+            t.Fatalf("%d bytes reassembled to %d different bytes", size, len(joined))
+        }
+    }
+}
+
+func TestCDCInsertionKeepsLaterCutPoints(t *testing.T) {
+    data := testChunkData(1 << 20)
+    inserted := []byte("inserted near the start of the file")
+    offset := 100
+    edited := append(append(append([]byte(nil), data[:offset]...), inserted...), data[offset:]...)
+
+    _, ends := cdcChunks(t, data)
+    _, editedEnds := cdcChunks(t, edited)
+    editedCuts := make(map[int]bool)
+    for _, end := range editedEnds {
+        editedCuts[end] = true
+    }
+    // The chunks right after the insertion may change, later ones must not
+    kept := 0
+    for _, end := range ends {
+        if end < offset + 4 * testCDCConfig.MaxSize {
+            continue
+        }
+        if !editedCuts[end + len(inserted)] {
+            t.Fatalf("The cut point at %d moved", end)
+        }
+        kept++
+    }
+    if kept == 0 {
+        t.Fatal("No cut points to compare")
+    }
+}
@@ -0,0 +1,322 @@
+package surfstore
+
+import (
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    // Quiet time after the last local change before the daemon syncs
+    DefaultDebounce = 500 * time.Millisecond
+    // The daemon syncs at least this often, whether or not it was told about changes
+    DefaultPollInterval = time.Minute
+
+    // Continuous writes delay a sync by at most this many debounce periods
+    debounceLimitFactor = 10
+    // Wait before long-polling the server again after an error
+    remoteRetryDelay = 5 * time.Second
+)
+
+type DaemonConfig struct {
+    // 0 means DefaultDebounce
+    Debounce time.Duration
+    // 0 means DefaultPollInterval
+    PollInterval time.Duration
+}
+
+/**
+* Keep BaseDir in sync until stop is closed. Local changes are picked up through inotify and
+* synced once writes have been quiet for config.Debounce, remote changes through the server's
+* WaitForChanges. Without inotify or a server that can wait, the daemon falls back to syncing
+* every config.PollInterval. A sync in progress when stop is closed is finished first, the
+* daemon's goroutines have exited when RunDaemon returns.
+*
+* While watching, a sync only looks at the paths reported since the last one and the daemon
+* ignores the events of its own writes. Every config.PollInterval BaseDir is scanned in full.
+*/
+func RunDaemon(client RPCClient, config DaemonConfig, stop <-chan struct{}) {
+    if config.Debounce <= 0 {
+        config.Debounce = DefaultDebounce
+    }
+    if config.PollInterval <= 0 {
+        config.PollInterval = DefaultPollInterval
+    }
+
+    var events <-chan string
+    var watchErrors <-chan error
+    watcher, err := newDirWatcher(client.BaseDir)
+    if err != nil {
+        log.Println("Watching the base directory failed, rescanning periodically: ", err)
+    } else {
+        defer watcher.Close()
+        events = watcher.Events
+        watchErrors = watcher.Errors
+        // Only files the watcher reported are hashed again
+        client.hashes = newHashCache()
+        client.written = newPathSet()
+    }
+
+    remote := make(chan struct{}, 1)
+    remoteDone := make(chan struct{})
+    go func() {
+        defer close(remoteDone)
+        waitForRemoteChanges(client, remote, stop)
+    }()
+    defer func() {
+        <-remoteDone
+    }()
+
+    ticker := time.NewTicker(config.PollInterval)
+    defer ticker.Stop()
+    debounce := time.NewTimer(config.Debounce)
+    stopTimer(debounce)
+    var pendingSince time.Time
+
+    // Local paths as of the last sync and the paths reported since, nil means scan everything
+    var dirMap map[string]os.FileInfo
+    changed := make(map[string]bool)
+
+    sync := func(full bool) {
+        // The scan covers everything reported so far
+        stopTimer(debounce)
+        pendingSince = time.Time{}
+        if full || dirMap == nil || events == nil {
+            var readErr error
+            dirMap, readErr = scanBaseDir(client.BaseDir)
+            if readErr != nil {
+                log.Println("Read client base directory error: ", readErr)
+            }
+        } else {
+            for fileName := range changed {
+                rescanPath(client, dirMap, fileName)
+            }
+        }
+        changed = make(map[string]bool)
+        client.written.take()
+        syncBaseDir(client, copyDirMap(dirMap))
+        // Its own writes are known, their events are ignored
+        for _, fileName := range client.written.take() {
+            rescanPath(client, dirMap, fileName)
+        }
+    }
+    sync(true)
+    for {
+        select {
+        case <-stop:
+            return
+        case fileName, ok := <-events:
+            if !ok {
+                log.Println("Watching the base directory stopped, rescanning periodically")
+                events = nil
+                client.hashes = nil
+                client.written = nil
+                continue
+            }
+            if isClientIndexFile(strings.SplitN(fileName, ".tmp", 2)[0]) || isDownloadTempFile(fileName) {
+                continue
+            }
+            if fileName == "" {
+                // Events were lost
+                dirMap = nil
+            } else if unchangedPath(client, dirMap, fileName) {
+                continue
+            }
+            changed[fileName] = true
+            client.hashes.invalidate(fileName)
+            now := time.Now()
+            if pendingSince.IsZero() {
+                pendingSince = now
+            }
+            delay := config.Debounce
+            if limit := pendingSince.Add(debounceLimitFactor * config.Debounce); now.Add(delay).After(limit) {
+                delay = limit.Sub(now)
+            }
+            stopTimer(debounce)
+            debounce.Reset(delay)
+        case err := <-watchErrors:
+            log.Println("Watch base directory error: ", err)
+        case <-debounce.C:
+            sync(false)
+        case <-remote:
+            sync(false)
+        case <-ticker.C:
+            sync(true)
+        }
+    }
+}
+
+/**
+* Look at a path again and update dirMap, a directory is scanned with everything below it.
+*/
+func rescanPath(client RPCClient, dirMap map[string]os.FileInfo, fileName string) {
+    removePath(dirMap, fileName)
+    if _, err := os.Lstat(localPath(client, fileName)); err == nil {
+        scanPath(client.BaseDir, fileName, dirMap)
+    }
+}
+
+/**
+* Whether a reported path is still as dirMap has it, e.g. because the last sync wrote it.
+*/
+func unchangedPath(client RPCClient, dirMap map[string]os.FileInfo, fileName string) bool {
+    if dirMap == nil {
+        return false
+    }
+    known, ok := dirMap[fileName]
+    f, err := os.Lstat(localPath(client, fileName))
+    if err != nil {
+        return os.IsNotExist(err) && !ok
+    }
+    if !ok || f.IsDir() != known.IsDir() {
+        return false
+    }
+    // A directory's own time changes with its entries, which are reported themselves
+    return f.IsDir() || (f.Size() == known.Size() && f.ModTime().Equal(known.ModTime()) && f.Mode() == known.Mode())
+}
+
+func copyDirMap(dirMap map[string]os.FileInfo) map[string]os.FileInfo {
+    copied := make(map[string]os.FileInfo, len(dirMap))
+    for fileName, f := range dirMap {
+        copied[fileName] = f
+    }
+    return copied
+}
+
+/**
+* Long-poll the server and signal remote whenever files changed. The goroutine keeps its own
+* cursor, the syncs it triggers fetch the changes themselves. Returns soon after stop is
+* closed, a pending long poll is abandoned.
+*/
+func waitForRemoteChanges(client RPCClient, remote chan<- struct{}, stop <-chan struct{}) {
+    cursor := readCursor(client)
+    for {
+        var reply ChangesReply
+        err := client.waitForChangesUntil(WaitArgs{Cursor: cursor, Timeout: DefaultWaitTimeout}, &reply, stop)
+        if err == errWaitStopped {
+            return
+        }
+        if err != nil {
+            // The periodic sync still pulls remote changes
+            log.Println("Waiting for remote changes failed: ", err)
+            select {
+            case <-stop:
+                return
+            case <-time.After(remoteRetryDelay):
+            }
+            continue
+        }
+        if len(reply.Changes) > 0 || reply.Reset {
+            select {
+            case remote <- struct{}{}:
+            default:
+            }
+        }
+        cursor = reply.Cursor
+        select {
+        case <-stop:
+            return
+        default:
+        }
+    }
+}
+
+/**
+* Stop a timer and drain a pending expiry, so Reset starts over.
+*/
+func stopTimer(timer *time.Timer) {
+    if !timer.Stop() {
+        select {
+        case <-timer.C:
+        default:
+        }
+    }
+}
+
+/**
+* Hash lists of local files, trusted while size and modification time match and the file
+* was not reported as changed.
+*/
+type hashCache struct {
+    mutex   sync.Mutex
+    entries map[string]hashCacheEntry
+}
+
+type hashCacheEntry struct {
+    size     int64
+    modTime  time.Time
+    hashList []string
+}
+
+func newHashCache() *hashCache {
+    return &hashCache{entries: make(map[string]hashCacheEntry)}
+}
+
+func (c *hashCache) lookup(fileName string, f os.FileInfo) ([]string, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    entry, ok := c.entries[fileName]
+    if !ok || entry.size != f.Size() || !entry.modTime.Equal(f.ModTime()) {
+        return nil, false
+    }
+    return entry.hashList, true
+}
+
+func (c *hashCache) store(fileName string, f os.FileInfo, hashList []string) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.entries[fileName] = hashCacheEntry{size: f.Size(), modTime: f.ModTime(), hashList: hashList}
+}
+
+/**
+* Forget a file, "" forgets all of them.
+*/
+func (c *hashCache) invalidate(fileName string) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if fileName == "" {
+        c.entries = make(map[string]hashCacheEntry)
+        return
+    }
+    delete(c.entries, fileName)
+}
+
+/**
+* Paths a sync wrote to bring them in line with the server. The methods do nothing on nil.
+*/
+type pathSet struct {
+    mutex sync.Mutex
+    paths map[string]bool
+}
+
+func newPathSet() *pathSet {
+    return &pathSet{paths: make(map[string]bool)}
+}
+
+func (s *pathSet) add(fileName string) {
+    if s == nil {
+        return
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.paths[fileName] = true
+}
+
+/**
+* Returns the paths added so far and forgets them.
+*/
+func (s *pathSet) take() []string {
+    if s == nil {
+        return nil
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    var fileNames []string
+    for fileName := range s.paths {
+        fileNames = append(fileNames, fileName)
+    }
+    s.paths = make(map[string]bool)
+    return fileNames
+}
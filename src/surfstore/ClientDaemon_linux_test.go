@@ -0,0 +1,180 @@
+package surfstore
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+)
+
+/**
+* A MetaStore that counts the change feed pages clients fetch when they sync.
+*/
+type syncCountingMetaStore struct {
+    *MetaStore
+
+    mutex sync.Mutex
+    syncs int
+}
+
+func (m *syncCountingMetaStore) GetChangesSince(args ChangesArgs, reply *ChangesReply) error {
+    if args.Limit > 0 {
+        // WaitForChanges asks without a limit
+        m.mutex.Lock()
+        m.syncs++
+        m.mutex.Unlock()
+    }
+    return m.MetaStore.GetChangesSince(args, reply)
+}
+
+func (m *syncCountingMetaStore) count() int {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    return m.syncs
+}
+
+func startTestDaemon(t *testing.T, addr string, dir string) {
+    t.Helper()
+    client := NewSurfstoreRPCClient(addr, dir, 1024)
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        RunDaemon(client, DaemonConfig{Debounce: 20 * time.Millisecond, PollInterval: time.Hour}, stop)
+    }()
+    t.Cleanup(func() {
+        close(stop)
+        <-done
+        client.Close()
+    })
+}
+
+/**
+* Wait until the server has a version of a file, read under the server's lock while the
+* daemon commits.
+*/
+func waitForServerVersion(t *testing.T, server *Server, fileName string, version int) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        var succ bool
+        var files map[string]FileMetaData
+        if err := server.GetFileInfoMap(&succ, &files); err != nil {
+            t.Fatal(err)
+        }
+        fileMetaData := files[fileName]
+        if fileMetaData.Version == version {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    t.Fatalf("%s did not reach version %d on the server", fileName, version)
+}
+
+func TestDaemonSyncsReportedChanges(t *testing.T) {
+    metaStore := NewMetaStore()
+    server := NewSurfstoreServerWithStores(&BlockStore{BlockMap: map[string]Block{}}, metaStore)
+    addr := startTestServer(t, &server)
+
+    dir := t.TempDir()
+    writeTestFile(t, filepath.Join(dir, "before"), "there at start")
+    startTestDaemon(t, addr, dir)
+    waitForServerVersion(t, &server, "before", 1)
+
+    writeTestFile(t, filepath.Join(dir, "new"), "created while watching")
+    waitForServerVersion(t, &server, "new", 1)
+    writeTestFile(t, filepath.Join(dir, "before"), "edited while watching")
+    waitForServerVersion(t, &server, "before", 2)
+}
+
+func TestDaemonIgnoresItsOwnWrites(t *testing.T) {
+    metaStore := &syncCountingMetaStore{MetaStore: NewMetaStore()}
+    server := NewSurfstoreServerWithStores(&BlockStore{BlockMap: map[string]Block{}}, metaStore)
+    addr := startTestServer(t, &server)
+
+    dir := t.TempDir()
+    startTestDaemon(t, addr, dir)
+    time.Sleep(200 * time.Millisecond)
+
+    // Another client adds a file, the daemon downloads it once
+    otherDir := t.TempDir()
+    other := NewSurfstoreRPCClient(addr, otherDir, 1024)
+    defer other.Close()
+    writeTestFile(t, filepath.Join(otherDir, "remote"), "from another client")
+    before := metaStore.count()
+    ClientSync(other)
+
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        data, err := ioutil.ReadFile(filepath.Join(dir, "remote"))
+        if err == nil && string(data) == "from another client" {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("The daemon did not download the file")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    time.Sleep(300 * time.Millisecond)
+    // The sync of the other client and the one of the daemon
+    if n := metaStore.count() - before; n != 2 {
+        t.Fatalf("%d syncs after the remote change, want 2", n)
+    }
+    waitForServerVersion(t, &server, "remote", 1)
+}
+
+func TestWatcherCloseWithUnreadEvents(t *testing.T) {
+    dir := t.TempDir()
+    watcher, err := newDirWatcher(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // More events than the channel holds, nobody reads them
+    for i := 0; i < 2 * cap(watcher.Events); i++ {
+        writeTestFile(t, filepath.Join(dir, "file" + strconv.Itoa(i)), "data")
+    }
+    time.Sleep(100 * time.Millisecond)
+
+    closed := make(chan struct{})
+    go func() {
+        watcher.Close()
+        close(closed)
+    }()
+    select {
+    case <-closed:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Close blocked on a full event channel")
+    }
+    // The reading goroutine is gone, only buffered events are left
+    received := 0
+    for range watcher.Events {
+        received++
+    }
+    if received > cap(watcher.Events) {
+        t.Fatalf("%d events after Close, the channel holds %d", received, cap(watcher.Events))
+    }
+}
+
+func TestDaemonReturnsPromptlyAfterStop(t *testing.T) {
+    server := NewSurfstoreServerWithStores(&BlockStore{BlockMap: map[string]Block{}}, NewMetaStore())
+    addr := startTestServer(t, &server)
+    client := NewSurfstoreRPCClient(addr, t.TempDir(), 1024)
+    defer client.Close()
+
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        RunDaemon(client, DaemonConfig{Debounce: 20 * time.Millisecond, PollInterval: time.Hour}, stop)
+    }()
+    // The daemon is long-polling the server by now
+    time.Sleep(200 * time.Millisecond)
+    close(stop)
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("RunDaemon did not return after stop")
+    }
+}
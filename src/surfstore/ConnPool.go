@@ -0,0 +1,235 @@
+package surfstore
+
+import (
+    "bufio"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "net/rpc"
+    "sync"
+    "time"
+)
+
+const (
+    // Number of idle connections kept open per server.
+    DefaultMaxIdleConns = 8
+)
+
+/**
+* connPool keeps idle RPC connections to one server so that consecutive calls reuse
+* the same TCP connection instead of dialing every time. It is safe for concurrent use,
+* each in-flight call holds its own connection.
+*/
+type connPool struct {
+    addr    string
+    maxIdle int
+    // Bound on dialing and on each call, 0 means wait forever
+    timeout time.Duration
+
+    mutex  sync.Mutex
+    idle   []*rpc.Client
+    closed bool
+}
+
+func newConnPool(addr string, maxIdle int) *connPool {
+    if maxIdle <= 0 {
+        maxIdle = DefaultMaxIdleConns
+    }
+    return &connPool{addr: addr, maxIdle: maxIdle}
+}
+
+var errCallTimeout = errors.New("RPC call timed out")
+
+/**
+* Calls that can be repeated without changing the result, if the first one got through
+* after all. Blocks and shards are stored under their hash, storing them twice is harmless.
+* Metadata updates are not, a repeated UpdateFile could fail with a version conflict with
+* itself.
+*/
+var idempotentMethods = map[string]bool{
+    "Server.GetFileInfoMap":        true,
+    "Server.GetChangesSince":       true,
+    "Server.WaitForChanges":        true,
+    "Server.GetFileHistory":        true,
+    "Server.ListSnapshots":         true,
+    "Server.GetSnapshot":           true,
+    "Server.GetReferencedBlocks":   true,
+    "Server.GetReplicationConfig":  true,
+    "Server.GetBlock":              true,
+    "Server.GetBlocks":             true,
+    "Server.HasBlocks":             true,
+    "Server.PutBlock":              true,
+    "Server.PutBlocks":             true,
+    "Server.GetShards":             true,
+    "Server.HasShards":             true,
+    "Server.PutShards":             true,
+    "Server.GetMerkleNodes":        true,
+    "Server.GetMerkleLeaves":       true,
+    // Raft handles repeated messages, e.g. a vote for the same candidate is granted again
+    "Raft.RequestVote":             true,
+    "Raft.AppendEntries":           true,
+}
+
+func isIdempotent(serviceMethod string) bool {
+    return idempotentMethods[serviceMethod]
+}
+
+/**
+* The connection to the server could not be set up, so no request was sent on it.
+*/
+type dialError struct {
+    err error
+}
+
+func (e *dialError) Error() string {
+    return e.err.Error()
+}
+
+func isDialError(err error) bool {
+    _, ok := err.(*dialError)
+    return ok
+}
+
+/**
+* Perform a call on a pooled connection.
+* A pooled connection may have been closed by the server since it was last used. If an
+* idempotent call fails with a connection error it is retried once on a fresh connection,
+* any other call may have reached the server and fails. A *dialError means the call was
+* never sent.
+*/
+func (p *connPool) call(serviceMethod string, args interface{}, reply interface{}) error {
+    conn, pooled, err := p.get()
+    if err != nil {
+        return err
+    }
+    err = p.callOn(conn, serviceMethod, args, reply)
+    if err == nil || !isConnError(err) {
+        // Application errors come back on a healthy connection.
+        p.put(conn)
+        return err
+    }
+    conn.Close()
+    if !pooled || err == errCallTimeout || !isIdempotent(serviceMethod) {
+        // The reply may still be written by the timed out call, it must not be reused.
+        return err
+    }
+
+    conn, err = p.dial()
+    if err != nil {
+        return &dialError{err: err}
+    }
+    err = p.callOn(conn, serviceMethod, args, reply)
+    if err != nil && isConnError(err) {
+        conn.Close()
+        return err
+    }
+    p.put(conn)
+    return err
+}
+
+/**
+* Take an idle connection, or dial a new one. Reports whether the connection was pooled.
+*/
+func (p *connPool) get() (*rpc.Client, bool, error) {
+    p.mutex.Lock()
+    if p.closed {
+        p.mutex.Unlock()
+        return nil, false, errors.New("Connection pool is closed")
+    }
+    if n := len(p.idle); n > 0 {
+        conn := p.idle[n - 1]
+        p.idle = p.idle[:n - 1]
+        p.mutex.Unlock()
+        return conn, true, nil
+    }
+    p.mutex.Unlock()
+
+    conn, err := p.dial()
+    if err != nil {
+        return nil, false, &dialError{err: err}
+    }
+    return conn, false, nil
+}
+
+/**
+* Return a healthy connection to the pool, closing it if the pool is full or closed.
+*/
+func (p *connPool) put(conn *rpc.Client) {
+    p.mutex.Lock()
+    if p.closed || len(p.idle) >= p.maxIdle {
+        p.mutex.Unlock()
+        conn.Close()
+        return
+    }
+    p.idle = append(p.idle, conn)
+    p.mutex.Unlock()
+}
+
+/**
+* Perform a call on one connection, giving up after the pool's timeout.
+*/
+func (p *connPool) callOn(conn *rpc.Client, serviceMethod string, args interface{}, reply interface{}) error {
+    if p.timeout <= 0 {
+        return conn.Call(serviceMethod, args, reply)
+    }
+    timer := time.NewTimer(p.timeout)
+    defer timer.Stop()
+    call := conn.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+    select {
+    case <-call.Done:
+        return call.Error
+    case <-timer.C:
+        return errCallTimeout
+    }
+}
+
+/**
+* Same as rpc.DialHTTP, but bounded by the pool's timeout.
+*/
+func (p *connPool) dial() (*rpc.Client, error) {
+    if p.timeout <= 0 {
+        return rpc.DialHTTP("tcp", p.addr)
+    }
+    conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(p.timeout))
+    io.WriteString(conn, "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n\n")
+    resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+    if err == nil && resp.Status != "200 Connected to Go RPC" {
+        err = errors.New("unexpected HTTP response: " + resp.Status)
+    }
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    conn.SetDeadline(time.Time{})
+    return rpc.NewClient(conn), nil
+}
+
+/**
+* Close all idle connections. Connections in use are closed when they are returned.
+*/
+func (p *connPool) Close() error {
+    p.mutex.Lock()
+    idle := p.idle
+    p.idle = nil
+    p.closed = true
+    p.mutex.Unlock()
+
+    for _, conn := range idle {
+        conn.Close()
+    }
+    return nil
+}
+
+/**
+* Errors returned by the remote method arrive as rpc.ServerError, anything else
+* means the connection itself is broken.
+*/
+func isConnError(err error) bool {
+    _, ok := err.(rpc.ServerError)
+    return !ok
+}
@@ -0,0 +1,133 @@
+package surfstore
+
+import (
+    "net"
+    "net/http"
+    "net/rpc"
+    "sync"
+    "testing"
+)
+
+/**
+* An RPC service whose calls break their connection after being handled, until told not to.
+*/
+type breakingService struct {
+    listener *trackingListener
+
+    mutex sync.Mutex
+    calls map[string]int
+    brk   bool
+}
+
+func (s *breakingService) handled(method string) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.calls[method]++
+    if s.brk {
+        s.brk = false
+        s.listener.closeConns()
+    }
+}
+
+func (s *breakingService) breakNext() {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.brk = true
+}
+
+func (s *breakingService) count(method string) int {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.calls[method]
+}
+
+func (s *breakingService) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
+    s.handled("GetFileInfoMap")
+    return nil
+}
+
+func (s *breakingService) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) error {
+    s.handled("UpdateFile")
+    *latestVersion = fileMetaData.Version
+    return nil
+}
+
+func startBreakingService(t *testing.T) (*breakingService, string) {
+    t.Helper()
+    inner, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    service := &breakingService{listener: &trackingListener{Listener: inner}, calls: make(map[string]int)}
+    rpcServer := rpc.NewServer()
+    if err := rpcServer.RegisterName("Server", service); err != nil {
+        t.Fatal(err)
+    }
+    mux := http.NewServeMux()
+    mux.Handle(rpc.DefaultRPCPath, rpcServer)
+    httpServer := &http.Server{Handler: mux}
+    go httpServer.Serve(service.listener)
+    t.Cleanup(func() {
+        httpServer.Close()
+        service.listener.closeConns()
+    })
+    return service, inner.Addr().String()
+}
+
+func TestConnPoolRetriesOnlyIdempotentCalls(t *testing.T) {
+    service, addr := startBreakingService(t)
+    pool := newConnPool(addr, 1)
+    defer pool.Close()
+
+    var succ bool
+    var files map[string]FileMetaData
+    // Leaves a connection in the pool
+    if err := pool.call("Server.GetFileInfoMap", &succ, &files); err != nil {
+        t.Fatal(err)
+    }
+
+    service.breakNext()
+    if err := pool.call("Server.GetFileInfoMap", &succ, &files); err != nil {
+        t.Fatal("A read was not retried: ", err)
+    }
+    if n := service.count("GetFileInfoMap"); n != 3 {
+        t.Fatalf("GetFileInfoMap handled %d times, want 3", n)
+    }
+
+    if err := pool.call("Server.GetFileInfoMap", &succ, &files); err != nil {
+        t.Fatal(err)
+    }
+    service.breakNext()
+    var latestVersion int
+    if err := pool.call("Server.UpdateFile", &FileMetaData{Filename: "f", Version: 1}, &latestVersion); err == nil {
+        t.Fatal("The update did not report the broken connection")
+    }
+    if n := service.count("UpdateFile"); n != 1 {
+        t.Fatalf("UpdateFile handled %d times, want 1", n)
+    }
+}
+
+func TestMetaRouterDoesNotResendUpdates(t *testing.T) {
+    service, addr := startBreakingService(t)
+    router := newMetaRouter([]string{addr})
+    defer router.Close()
+
+    service.breakNext()
+    var latestVersion int
+    if err := router.call("Server.UpdateFile", &FileMetaData{Filename: "f", Version: 1}, &latestVersion); err == nil {
+        t.Fatal("The update did not report the broken connection")
+    }
+    if n := service.count("UpdateFile"); n != 1 {
+        t.Fatalf("UpdateFile handled %d times, want 1", n)
+    }
+
+    // A server that cannot be reached never saw the call, the next one is tried
+    router = newMetaRouter([]string{"127.0.0.1:1", addr})
+    defer router.Close()
+    if err := router.call("Server.UpdateFile", &FileMetaData{Filename: "f", Version: 2}, &latestVersion); err != nil {
+        t.Fatal(err)
+    }
+    if n := service.count("UpdateFile"); n != 2 {
+        t.Fatalf("UpdateFile handled %d times, want 2", n)
+    }
+}
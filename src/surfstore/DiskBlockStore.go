@@ -0,0 +1,386 @@
+package surfstore
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "hash/crc32"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/**
+* DiskBlockStore keeps every block in its own file under DataDir, content-addressed
+* by the SHA-256 hash of the block data. Blocks are fanned out into sub-directories
+* named after the first two hex characters of the hash, i.e. DataDir/ab/abcdef...
+*/
+type DiskBlockStore struct {
+    DataDir string
+
+    // Counts the blocks stored and removed through this store, see Generation
+    generation int
+}
+
+/**
+* Create a disk-backed block store rooted at dataDir, creating the directory if needed.
+*/
+func NewDiskBlockStore(dataDir string) (*DiskBlockStore, error) {
+    if err := os.MkdirAll(dataDir, 0755); err != nil {
+        return nil, err
+    }
+    return &DiskBlockStore{DataDir: dataDir}, nil
+}
+
+/**
+* Retrieves a block indexed by hash value h.
+* A missing block is returned as an empty block, same as the in-memory BlockStore.
+*/
+func (bs *DiskBlockStore) GetBlock(blockHash string, blockData *Block) error {
+    path, err := bs.blockPath(blockHash)
+    if err != nil {
+        return err
+    }
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        *blockData = Block{}
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if hashBlockData(data) != blockHash {
+        return errors.New("Block " + blockHash + " is corrupted on disk")
+    }
+    *blockData = Block{BlockData: data, BlockSize: len(data)}
+    return nil
+}
+
+/**
+* Stores block b on disk, indexed by the SHA-256 hash of its data.
+* The block is written to a temp file, fsynced and renamed into place, so a crash
+* never leaves a partially written block behind.
+*/
+func (bs *DiskBlockStore) PutBlock(block Block, succ *bool) error {
+    hashCode := hashBlockData(block.BlockData)
+    path, _ := bs.blockPath(hashCode)
+    if _, err := os.Stat(path); err == nil {
+        // Content-addressed, the same hash always holds the same data.
+        *succ = true
+        return touchFile(path)
+    }
+
+    dir := filepath.Dir(path)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+    tmp, err := ioutil.TempFile(dir, hashCode + ".tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err = tmp.Write(block.BlockData); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        return err
+    }
+    if err = os.Rename(tmp.Name(), path); err != nil {
+        return err
+    }
+    if err = syncDir(dir); err != nil {
+        return err
+    }
+    bs.generation++
+    *succ = true
+    return nil
+}
+
+/**
+* Given a list of hashes “in”, returns a list containing the subset
+* of in that are stored on disk.
+*/
+func (bs *DiskBlockStore) HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error {
+    for _, blockHash := range blockHashesIn {
+        path, err := bs.blockPath(blockHash)
+        if err != nil {
+            continue
+        }
+        if _, err := os.Stat(path); err == nil {
+            *blockHashesOut = append(*blockHashesOut, blockHash)
+            // The client will reference this block instead of uploading it.
+            touchFile(path)
+        }
+    }
+    return nil
+}
+
+/**
+* Retrieves the blocks indexed by the given hashes, in order.
+*/
+func (bs *DiskBlockStore) GetBlocks(blockHashes []string, blocks *[]Block) error {
+    for _, blockHash := range blockHashes {
+        var block Block
+        if err := bs.GetBlock(blockHash, &block); err != nil {
+            return err
+        }
+        *blocks = append(*blocks, block)
+    }
+    return nil
+}
+
+/**
+* Stores every block on disk.
+*/
+func (bs *DiskBlockStore) PutBlocks(blocks []Block, succ *bool) error {
+    for _, block := range blocks {
+        if err := bs.PutBlock(block, succ); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/**
+* Removes every block and shard file that is not in live and has not been modified since cutoff.
+* Leftover temp files from interrupted puts are removed as well.
+* Returns the number of removed blocks.
+*/
+func (bs *DiskBlockStore) SweepBlocks(live map[string]bool, cutoff time.Time) (int, error) {
+    removed := 0
+    err := filepath.Walk(bs.DataDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) {
+                return nil
+            }
+            return err
+        }
+        if info.IsDir() || live[info.Name()] || info.ModTime().After(cutoff) {
+            return nil
+        }
+        _, hashErr := bs.blockPath(info.Name())
+        isTemp := strings.Contains(info.Name(), ".tmp")
+        shardKey, isShard := parseShardName(info.Name())
+        if isShard && live[shardKey.BlockHash] {
+            return nil
+        }
+        if hashErr != nil && !isTemp && !isShard {
+            // Not ours, leave it alone.
+            return nil
+        }
+        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        if hashErr == nil {
+            bs.generation++
+            removed++
+        }
+        return nil
+    })
+    return removed, err
+}
+
+/**
+* Stores shards of erasure coded blocks next to the blocks, as DataDir/ab/<hash>.<index>.
+* A shard file holds [8 byte block size][4 byte CRC-32][shard data], so a corrupted shard
+* is detected and treated as missing.
+*/
+func (bs *DiskBlockStore) PutShards(shards []Shard, succ *bool) error {
+    for _, shard := range shards {
+        path, err := bs.shardPath(shard.ShardKey)
+        if err != nil {
+            return err
+        }
+        if _, err := os.Stat(path); err == nil {
+            if err = touchFile(path); err != nil {
+                return err
+            }
+            continue
+        }
+        payload := make([]byte, 12 + len(shard.Data))
+        binary.BigEndian.PutUint64(payload[0:8], uint64(shard.BlockSize))
+        binary.BigEndian.PutUint32(payload[8:12], crc32.ChecksumIEEE(shard.Data))
+        copy(payload[12:], shard.Data)
+        dir := filepath.Dir(path)
+        if err = os.MkdirAll(dir, 0755); err != nil {
+            return err
+        }
+        if err = writeFileAtomic(dir, filepath.Base(path), payload); err != nil {
+            return err
+        }
+    }
+    *succ = true
+    return nil
+}
+
+/**
+* Retrieves shards in order, a missing or corrupted shard only has its key set.
+*/
+func (bs *DiskBlockStore) GetShards(keys []ShardKey, shards *[]Shard) error {
+    for _, key := range keys {
+        path, err := bs.shardPath(key)
+        if err != nil {
+            return err
+        }
+        shard := Shard{ShardKey: key}
+        payload, err := ioutil.ReadFile(path)
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        if err == nil {
+            if len(payload) >= 12 && crc32.ChecksumIEEE(payload[12:]) == binary.BigEndian.Uint32(payload[8:12]) {
+                shard.BlockSize = int(binary.BigEndian.Uint64(payload[0:8]))
+                shard.Data = payload[12:]
+            } else {
+                logError("GetShards Error: ", errors.New("Shard " + shardName(key) + " is corrupted on disk"))
+            }
+        }
+        *shards = append(*shards, shard)
+    }
+    return nil
+}
+
+/**
+* Returns the subset of keys whose shards are on disk.
+*/
+func (bs *DiskBlockStore) HasShards(keysIn []ShardKey, keysOut *[]ShardKey) error {
+    for _, key := range keysIn {
+        path, err := bs.shardPath(key)
+        if err != nil {
+            continue
+        }
+        if _, err := os.Stat(path); err == nil {
+            *keysOut = append(*keysOut, key)
+            touchFile(path)
+        }
+    }
+    return nil
+}
+
+/**
+* Returns the keys of all shards on disk.
+*/
+func (bs *DiskBlockStore) ListShards() ([]ShardKey, error) {
+    var keys []ShardKey
+    err := filepath.Walk(bs.DataDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) {
+                return nil
+            }
+            return err
+        }
+        if info.IsDir() {
+            return nil
+        }
+        if key, ok := parseShardName(info.Name()); ok {
+            keys = append(keys, key)
+        }
+        return nil
+    })
+    return keys, err
+}
+
+/**
+* Returns the hashes of all blocks on disk, sorted.
+*/
+func (bs *DiskBlockStore) ListBlocks() ([]string, error) {
+    var blockHashes []string
+    err := filepath.Walk(bs.DataDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) {
+                return nil
+            }
+            return err
+        }
+        if info.IsDir() {
+            return nil
+        }
+        if _, hashErr := bs.blockPath(info.Name()); hashErr == nil {
+            blockHashes = append(blockHashes, info.Name())
+        }
+        return nil
+    })
+    sort.Strings(blockHashes)
+    return blockHashes, err
+}
+
+/**
+* Changes whenever a block is stored or removed through this store, so listings can be
+* cached in between. Files changed on disk by anything else go unnoticed.
+*/
+func (bs *DiskBlockStore) Generation() int {
+    return bs.generation
+}
+
+/**
+* Map a block hash to its file path, rejecting anything that is not a hex SHA-256
+* so a client cannot escape DataDir.
+*/
+func (bs *DiskBlockStore) blockPath(blockHash string) (string, error) {
+    if len(blockHash) != sha256.Size * 2 {
+        return "", errors.New("Invalid block hash: " + blockHash)
+    }
+    if _, err := hex.DecodeString(blockHash); err != nil {
+        return "", errors.New("Invalid block hash: " + blockHash)
+    }
+    return filepath.Join(bs.DataDir, blockHash[:2], blockHash), nil
+}
+
+/**
+* Map a shard key to its file path next to the block.
+*/
+func (bs *DiskBlockStore) shardPath(key ShardKey) (string, error) {
+    path, err := bs.blockPath(key.BlockHash)
+    if err != nil {
+        return "", err
+    }
+    if key.Index < 0 || key.Index > maxShardIndex {
+        return "", errors.New("Invalid shard index: " + strconv.Itoa(key.Index))
+    }
+    return filepath.Join(filepath.Dir(path), shardName(key)), nil
+}
+
+/**
+* Compute the hex encoded SHA-256 hash of block data.
+*/
+func hashBlockData(data []byte) string {
+    hash := sha256.Sum256(data)
+    return hex.EncodeToString(hash[:])
+}
+
+/**
+* Set the modification time of a file to now.
+*/
+func touchFile(path string) error {
+    now := time.Now()
+    return os.Chtimes(path, now, now)
+}
+
+/**
+* Fsync a directory so that a rename inside it is durable.
+*/
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
+
+// This line guarantees all method for DiskBlockStore are implemented
+var _ BlockStoreInterface = new(DiskBlockStore)
+var _ BlockSweeper = new(DiskBlockStore)
+var _ BlockLister = new(DiskBlockStore)
+var _ ShardStore = new(DiskBlockStore)
@@ -0,0 +1,97 @@
+package surfstore
+
+import (
+    "bytes"
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestDiskBlockStoreRoundTripAcrossReopen(t *testing.T) {
+    dir := t.TempDir()
+    store, err := NewDiskBlockStore(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    blocks, hashes := testBlocks(3, 100)
+    var succ bool
+    if err := store.PutBlocks(blocks, &succ); err != nil || !succ {
+        t.Fatalf("PutBlocks: %v, %v", succ, err)
+    }
+
+    reopened, err := NewDiskBlockStore(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, hash := range hashes {
+        var block Block
+        if err := reopened.GetBlock(hash, &block); err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(block.BlockData, blocks[i].BlockData) || block.BlockSize != len(blocks[i].BlockData) {
+            t.Fatalf("Block %d came back with %d bytes", i, block.BlockSize)
+        }
+    }
+    listed, err := reopened.ListBlocks()
+    if err != nil || len(listed) != len(hashes) {
+        t.Fatalf("Listed %d blocks: %v", len(listed), err)
+    }
+
+    // A missing block is empty, not an error
+    var missing Block
+    if err := reopened.GetBlock(hashBlockData([]byte("never stored")), &missing); err != nil || missing.BlockSize != 0 {
+        t.Fatalf("Missing block: %d bytes, %v", missing.BlockSize, err)
+    }
+}
+
+func TestDiskBlockStoreDetectsCorruption(t *testing.T) {
+    dir := t.TempDir()
+    store, err := NewDiskBlockStore(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    blocks, hashes := testBlocks(1, 100)
+    var succ bool
+    if err := store.PutBlock(blocks[0], &succ); err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(dir, hashes[0][:2], hashes[0])
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data[0] ^= 0xff
+    if err := ioutil.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    var block Block
+    if err := store.GetBlock(hashes[0], &block); err == nil || !strings.Contains(err.Error(), "corrupted") {
+        t.Fatalf("Corrupted block read with error %v", err)
+    }
+}
+
+func TestDiskBlockStoreRejectsInvalidHashes(t *testing.T) {
+    store, err := NewDiskBlockStore(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    invalid := []string{
+        "",
+        "abc",
+        strings.Repeat("g", 64),
+        "../" + strings.Repeat("a", 61),
+        strings.Repeat("a", 65),
+    }
+    for _, hash := range invalid {
+        var block Block
+        if err := store.GetBlock(hash, &block); err == nil {
+            t.Fatalf("GetBlock accepted %q", hash)
+        }
+        var found []string
+        if err := store.HasBlocks([]string{hash}, &found); err != nil || len(found) != 0 {
+            t.Fatalf("HasBlocks of %q: %v, %v", hash, found, err)
+        }
+    }
+}
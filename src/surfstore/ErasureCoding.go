@@ -0,0 +1,410 @@
+package surfstore
+
+import (
+    "crypto/sha256"
+    "errors"
+    "sort"
+    "strconv"
+    "sync"
+)
+
+/**
+* Erasure coded block storage of a block cluster. Every block is split by Reed-Solomon into
+* DataShards data shards and ParityShards parity shards, and shard i is stored on the i-th
+* server clockwise from the block hash on the ring, so every shard of a block is on a
+* different server. Reads fetch the data shards first and only ask for parity shards when
+* some are missing, so up to ParityShards servers can be down.
+*/
+
+/**
+* The servers holding the shards of a block, in shard order.
+*/
+func (r *blockRouter) shardServers(blockHash string) []string {
+    return r.ring.Lookup(blockHash, r.codec.dataShards + r.codec.parityShards)
+}
+
+/**
+* Encode the blocks and write their shards, batching per server and writing to the
+* servers in parallel.
+*/
+func (r *blockRouter) putErasureCoded(blocks []Block, maxBatchBytes int, succ *bool) error {
+    var addrs []string
+    shards := make(map[string][]Shard)
+    // Position of the block of each shard
+    owners := make(map[string][]int)
+    for i, block := range blocks {
+        blockHash := hashBlockData(block.BlockData)
+        servers := r.shardServers(blockHash)
+        for index, data := range r.codec.encode(block.BlockData) {
+            addr := servers[index]
+            if _, ok := shards[addr]; !ok {
+                addrs = append(addrs, addr)
+            }
+            shard := Shard{ShardKey: ShardKey{BlockHash: blockHash, Index: index}, BlockSize: len(block.BlockData), Data: data}
+            shards[addr] = append(shards[addr], shard)
+            owners[addr] = append(owners[addr], i)
+        }
+    }
+
+    errs := make([]error, len(addrs))
+    var wg sync.WaitGroup
+    for n, addr := range addrs {
+        wg.Add(1)
+        go func(n int, addr string) {
+            defer wg.Done()
+            errs[n] = putShardsBatched(r.caller(addr), shards[addr], maxBatchBytes)
+        }(n, addr)
+    }
+    wg.Wait()
+
+    acks := make([]int, len(blocks))
+    for n, addr := range addrs {
+        if errs[n] != nil {
+            continue
+        }
+        for _, i := range owners[addr] {
+            acks[i]++
+        }
+    }
+    if err := r.checkQuorum(acks, errs); err != nil {
+        return err
+    }
+    *succ = true
+    return nil
+}
+
+func (r *blockRouter) getErasureCoded(blockHash string, block *Block) error {
+    var blocks []Block
+    if err := r.getBlocksErasureCoded([]string{blockHash}, &blocks); err != nil {
+        return err
+    }
+    *block = blocks[0]
+    return nil
+}
+
+/**
+* Fetch the shards of the blocks and rebuild them, in order. A block without any shards
+* on the servers that answer is an error, like one with too few.
+*/
+func (r *blockRouter) getBlocksErasureCoded(blockHashes []string, blocks *[]Block) error {
+    total := r.codec.dataShards + r.codec.parityShards
+    found := make(map[ShardKey]Shard)
+    counts := make(map[string]int)
+
+    // Data shards first, parity shards only for blocks that still lack shards
+    for _, indexes := range [][2]int{{0, r.codec.dataShards}, {r.codec.dataShards, total}} {
+        requests := make(map[string][]ShardKey)
+        for _, blockHash := range blockHashes {
+            if counts[blockHash] >= r.codec.dataShards {
+                continue
+            }
+            servers := r.shardServers(blockHash)
+            for index := indexes[0]; index < indexes[1]; index++ {
+                key := ShardKey{BlockHash: blockHash, Index: index}
+                if _, ok := found[key]; !ok {
+                    requests[servers[index]] = append(requests[servers[index]], key)
+                }
+            }
+        }
+        for _, shard := range r.fetchShards(requests) {
+            if _, ok := found[shard.ShardKey]; !ok {
+                found[shard.ShardKey] = shard
+                counts[shard.BlockHash]++
+            }
+        }
+    }
+
+    for _, blockHash := range blockHashes {
+        if counts[blockHash] == 0 {
+            return errors.New("Block " + blockHash + " not found on any server")
+        }
+        shards := make([][]byte, total)
+        size := 0
+        for index := range shards {
+            if shard, ok := found[ShardKey{BlockHash: blockHash, Index: index}]; ok {
+                shards[index] = shard.Data
+                size = shard.BlockSize
+            }
+        }
+        data, err := r.codec.reconstruct(shards, size)
+        if err != nil {
+            return errors.New("Cannot rebuild block " + blockHash + ": " + err.Error())
+        }
+        if hashBlockData(data) != blockHash {
+            return errors.New("Rebuilt block " + blockHash + " does not match its hash")
+        }
+        *blocks = append(*blocks, Block{BlockData: data, BlockSize: len(data)})
+    }
+    return nil
+}
+
+/**
+* Ask every server for its shards in parallel. Shards a server does not have, or cannot
+* return because it is down, are left out.
+*/
+func (r *blockRouter) fetchShards(requests map[string][]ShardKey) []Shard {
+    var mutex sync.Mutex
+    var result []Shard
+    var wg sync.WaitGroup
+    for addr, keys := range requests {
+        wg.Add(1)
+        go func(addr string, keys []ShardKey) {
+            defer wg.Done()
+            var shards []Shard
+            if err := getShardsBatched(r.caller(addr), keys, &shards); err != nil {
+                logError("GetShards Error: ", err)
+            }
+            mutex.Lock()
+            defer mutex.Unlock()
+            for _, shard := range shards {
+                if shard.Data != nil {
+                    result = append(result, shard)
+                }
+            }
+        }(addr, keys)
+    }
+    wg.Wait()
+    return result
+}
+
+/**
+* A block is only reported if at least WriteQuorum of its shards are stored, otherwise it
+* is uploaded again.
+*/
+func (r *blockRouter) hasErasureCoded(blockHashesIn []string, blockHashesOut *[]string) error {
+    var addrs []string
+    requests := make(map[string][]ShardKey)
+    for _, blockHash := range blockHashesIn {
+        for index, addr := range r.shardServers(blockHash) {
+            if _, ok := requests[addr]; !ok {
+                addrs = append(addrs, addr)
+            }
+            requests[addr] = append(requests[addr], ShardKey{BlockHash: blockHash, Index: index})
+        }
+    }
+    counts := make(map[string]int)
+    for _, addr := range addrs {
+        var keysOut []ShardKey
+        if err := r.call(addr, "Server.HasShards", requests[addr], &keysOut); err != nil {
+            // Treated as missing on this server
+            logError("HasShards Error: ", err)
+            continue
+        }
+        for _, key := range keysOut {
+            counts[key.BlockHash]++
+        }
+    }
+    for _, blockHash := range blockHashesIn {
+        if counts[blockHash] >= r.replication.WriteQuorum {
+            *blockHashesOut = append(*blockHashesOut, blockHash)
+            // Counted once even if the hash is repeated
+            counts[blockHash] = 0
+        }
+    }
+    return nil
+}
+
+/**
+* Fetch shards from one server, in as many batches as the server needs.
+*/
+func getShardsBatched(call rpcCaller, keys []ShardKey, shards *[]Shard) error {
+    for len(keys) > 0 {
+        var batch []Shard
+        err := call("Server.GetShards", keys, &batch)
+        if err != nil {
+            return err
+        }
+        if len(batch) == 0 {
+            return errors.New("Server returned an empty batch")
+        }
+        *shards = append(*shards, batch...)
+        keys = keys[len(batch):]
+    }
+    return nil
+}
+
+/**
+* Upload shards to one server in batches of at most maxBatchBytes.
+*/
+func putShardsBatched(call rpcCaller, shards []Shard, maxBatchBytes int) error {
+    for len(shards) > 0 {
+        n, size := 0, 0
+        for n < len(shards) && (n == 0 || size + len(shards[n].Data) <= maxBatchBytes) {
+            size += len(shards[n].Data)
+            n++
+        }
+        var succ bool
+        err := call("Server.PutShards", shards[:n], &succ)
+        if err != nil {
+            return err
+        }
+        shards = shards[n:]
+    }
+    return nil
+}
+
+/**
+* Rebuild the shards that live servers of the cluster are missing, for the blocks this server
+* holds a shard of, e.g. after a server lost its disk or missed writes while it was down.
+* Every holder of a shard asks the other shard servers of the block which shards they have,
+* and the holder of the lowest shard index rebuilds the block from DataShards of them and
+* writes the missing shards to their servers, so each block is rebuilt by one server.
+* Shards of servers that are down are left alone, they have nowhere else to go without two
+* shards of a block ending up on one server. Only blocks in referenced are rebuilt, unless it
+* is nil. Returns the number of rebuilt shards.
+*/
+func (r *blockReplicator) rebuildShards(live map[string]bool, referenced map[string]bool) (int, error) {
+    shardStore, err := r.server.shardStore()
+    if err != nil {
+        return 0, err
+    }
+    r.server.Mutex.RLock()
+    localKeys, err := shardStore.ListShards()
+    r.server.Mutex.RUnlock()
+    if err != nil {
+        return 0, err
+    }
+    local := make(map[ShardKey]bool)
+    seen := make(map[string]bool)
+    var blockHashes []string
+    for _, key := range localKeys {
+        local[key] = true
+        if !seen[key.BlockHash] && copyable(referenced, key.BlockHash) {
+            seen[key.BlockHash] = true
+            blockHashes = append(blockHashes, key.BlockHash)
+        }
+    }
+    sort.Strings(blockHashes)
+
+    total := r.codec.dataShards + r.codec.parityShards
+    placement := func(blockHash string) []string {
+        return r.ring.Lookup(blockHash, total)
+    }
+
+    // Which shards the other live servers have
+    present := make(map[ShardKey]bool)
+    requests := make(map[string][]ShardKey)
+    for _, blockHash := range blockHashes {
+        for index, addr := range placement(blockHash) {
+            key := ShardKey{BlockHash: blockHash, Index: index}
+            if addr == r.self {
+                present[key] = local[key]
+            } else if live[addr] {
+                requests[addr] = append(requests[addr], key)
+            }
+        }
+    }
+    perCall := r.server.maxBatchBytes() / (sha256.Size * 2) + 1
+    for addr, keys := range requests {
+        for start := 0; start < len(keys); start += perCall {
+            end := start + perCall
+            if end > len(keys) {
+                end = len(keys)
+            }
+            var keysOut []ShardKey
+            if err := r.pool(addr).call("Server.HasShards", keys[start:end], &keysOut); err != nil {
+                // Its shards are not rebuilt this round
+                logError("HasShards on " + addr + " Error: ", err)
+                for _, key := range keys[start:end] {
+                    present[key] = true
+                }
+                continue
+            }
+            for _, key := range keysOut {
+                present[key] = true
+            }
+        }
+    }
+
+    // The blocks this server rebuilds, and the shards to fetch for them
+    var rebuild []string
+    fetch := make(map[string][]ShardKey)
+    for _, blockHash := range blockHashes {
+        servers := placement(blockHash)
+        first := -1
+        var have []int
+        missing := false
+        for index, addr := range servers {
+            key := ShardKey{BlockHash: blockHash, Index: index}
+            if present[key] {
+                if first < 0 {
+                    first = index
+                }
+                have = append(have, index)
+            } else if live[addr] {
+                missing = true
+            }
+        }
+        if !missing || servers[first] != r.self {
+            continue
+        }
+        if len(have) < r.codec.dataShards {
+            logError("Rebuild Error: ", errors.New("Only " + strconv.Itoa(len(have)) + " shards of block " + blockHash + " are left"))
+            continue
+        }
+        rebuild = append(rebuild, blockHash)
+        for _, index := range have[:r.codec.dataShards] {
+            fetch[servers[index]] = append(fetch[servers[index]], ShardKey{BlockHash: blockHash, Index: index})
+        }
+    }
+    if len(rebuild) == 0 {
+        return 0, nil
+    }
+
+    found := make(map[ShardKey]Shard)
+    for addr, keys := range fetch {
+        var shards []Shard
+        if addr == r.self {
+            r.server.Mutex.RLock()
+            err = shardStore.GetShards(keys, &shards)
+            r.server.Mutex.RUnlock()
+        } else {
+            err = getShardsBatched(r.pool(addr).call, keys, &shards)
+        }
+        if err != nil {
+            logError("GetShards on " + addr + " Error: ", err)
+        }
+        for _, shard := range shards {
+            if shard.Data != nil {
+                found[shard.ShardKey] = shard
+            }
+        }
+    }
+
+    puts := make(map[string][]Shard)
+    for _, blockHash := range rebuild {
+        shards := make([][]byte, total)
+        size := 0
+        for index := range shards {
+            if shard, ok := found[ShardKey{BlockHash: blockHash, Index: index}]; ok {
+                shards[index] = shard.Data
+                size = shard.BlockSize
+            }
+        }
+        data, err := r.codec.reconstruct(shards, size)
+        if err != nil {
+            logError("Rebuild Error: ", errors.New("Cannot rebuild block " + blockHash + ": " + err.Error()))
+            continue
+        }
+        if hashBlockData(data) != blockHash {
+            logError("Rebuild Error: ", errors.New("Rebuilt block " + blockHash + " does not match its hash"))
+            continue
+        }
+        servers := placement(blockHash)
+        for index, shardData := range r.codec.encode(data) {
+            key := ShardKey{BlockHash: blockHash, Index: index}
+            if !present[key] && live[servers[index]] {
+                puts[servers[index]] = append(puts[servers[index]], Shard{ShardKey: key, BlockSize: size, Data: shardData})
+            }
+        }
+    }
+    rebuilt := 0
+    for addr, shards := range puts {
+        if err := putShardsBatched(r.pool(addr).call, shards, r.server.maxBatchBytes()); err != nil {
+            logError("PutShards on " + addr + " Error: ", err)
+            continue
+        }
+        rebuilt += len(shards)
+    }
+    return rebuilt, nil
+}
@@ -0,0 +1,232 @@
+package surfstore
+
+import (
+    "bytes"
+    "math/rand"
+    "testing"
+    "time"
+)
+
+/**
+* Start n in-memory block servers of a cluster with the given replication settings.
+* Returns their addresses and a function per server that stops it.
+*/
+func startTestBlockCluster(t *testing.T, n int, replication ReplicationConfig) ([]string, []func()) {
+    t.Helper()
+    addrs, stops, _ := startTestBlockServers(t, n, replication)
+    return addrs, stops
+}
+
+func startTestBlockServers(t *testing.T, n int, replication ReplicationConfig) ([]string, []func(), []*Server) {
+    t.Helper()
+    var addrs []string
+    var stops []func()
+    var servers []*Server
+    for i := 0; i < n; i++ {
+        server := NewSurfstoreServer()
+        server.Replication = replication
+        addr, stop := startStoppableTestServer(t, &server)
+        addrs = append(addrs, addr)
+        stops = append(stops, stop)
+        servers = append(servers, &server)
+    }
+    return addrs, stops, servers
+}
+
+/**
+* A router configured from the servers, like a client with -blocks.
+*/
+func newTestBlockRouter(t *testing.T, addrs []string) *blockRouter {
+    t.Helper()
+    replication, err := fetchReplicationConfig(addrs)
+    if err != nil {
+        t.Fatal(err)
+    }
+    router, err := newBlockRouter(addrs, replication)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        router.Close()
+    })
+    return router
+}
+
+func testBlocks(n int, size int) ([]Block, []string) {
+    random := rand.New(rand.NewSource(int64(n)))
+    var blocks []Block
+    var hashes []string
+    for i := 0; i < n; i++ {
+        data := make([]byte, size + i)
+        random.Read(data)
+        blocks = append(blocks, Block{BlockData: data, BlockSize: len(data)})
+        hashes = append(hashes, hashBlockData(data))
+    }
+    return blocks, hashes
+}
+
+func TestErasureCodedBlocksSurviveParityShardsServersDown(t *testing.T) {
+    const dataShards, parityShards = 4, 2
+    addrs, stops := startTestBlockCluster(t, dataShards + parityShards, ReplicationConfig{DataShards: dataShards, ParityShards: parityShards})
+    router := newTestBlockRouter(t, addrs)
+    if router.codec == nil {
+        t.Fatal("The router did not take erasure coding from the servers")
+    }
+
+    blocks, hashes := testBlocks(20, 1000)
+    var succ bool
+    if err := router.PutBlocks(blocks, DefaultMaxBatchBytes, &succ); err != nil {
+        t.Fatal(err)
+    }
+
+    // Every block has one shard on each server, so any parityShards servers may go
+    for i := 0; i < parityShards; i++ {
+        stops[i]()
+    }
+    for i, hash := range hashes {
+        var block Block
+        if err := router.GetBlock(hash, &block); err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(block.BlockData, blocks[i].BlockData) {
+            t.Fatalf("GetBlock rebuilt block %d wrong", i)
+        }
+    }
+    var got []Block
+    if err := router.GetBlocks(hashes, &got); err != nil {
+        t.Fatal(err)
+    }
+    if len(got) != len(blocks) {
+        t.Fatalf("GetBlocks returned %d blocks, want %d", len(got), len(blocks))
+    }
+    for i := range blocks {
+        if !bytes.Equal(got[i].BlockData, blocks[i].BlockData) {
+            t.Fatalf("GetBlocks rebuilt block %d wrong", i)
+        }
+    }
+}
+
+func TestErasureCodedBlocksLostWithTooManyServersDown(t *testing.T) {
+    const dataShards, parityShards = 4, 2
+    addrs, stops := startTestBlockCluster(t, dataShards + parityShards, ReplicationConfig{DataShards: dataShards, ParityShards: parityShards})
+    router := newTestBlockRouter(t, addrs)
+
+    blocks, hashes := testBlocks(5, 1000)
+    var succ bool
+    if err := router.PutBlocks(blocks, DefaultMaxBatchBytes, &succ); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i <= parityShards; i++ {
+        stops[i]()
+    }
+    var block Block
+    if err := router.GetBlock(hashes[0], &block); err == nil {
+        t.Fatal("GetBlock rebuilt a block with too few shards")
+    }
+    var got []Block
+    if err := router.GetBlocks(hashes, &got); err == nil {
+        t.Fatal("GetBlocks rebuilt blocks with too few shards")
+    }
+}
+
+func TestBlockServersRejectOtherReplicationModes(t *testing.T) {
+    coded, _ := startTestBlockCluster(t, 3, ReplicationConfig{DataShards: 2, ParityShards: 1})
+    copied, _ := startTestBlockCluster(t, 3, ReplicationConfig{Factor: 2})
+    blocks, _ := testBlocks(1, 100)
+
+    codedPool := newConnPool(coded[0], 1)
+    defer codedPool.Close()
+    copiedPool := newConnPool(copied[0], 1)
+    defer copiedPool.Close()
+
+    var succ bool
+    if err := codedPool.call("Server.PutBlock", blocks[0], &succ); err == nil {
+        t.Fatal("An erasure coded server accepted a whole block")
+    }
+    shard := Shard{ShardKey: ShardKey{BlockHash: hashBlockData(blocks[0].BlockData), Index: 0}, BlockSize: 100, Data: blocks[0].BlockData[:50]}
+    if err := copiedPool.call("Server.PutShards", []Shard{shard}, &succ); err == nil {
+        t.Fatal("A replicating server accepted a shard")
+    }
+    if _, err := fetchReplicationConfig(append(coded, copied...)); err == nil {
+        t.Fatal("Servers of different clusters were used as one")
+    }
+
+    // Servers that are down are skipped
+    replication, err := fetchReplicationConfig(append([]string{"127.0.0.1:1"}, copied...))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if replication.Factor != 2 || replication.erasureCoded() {
+        t.Fatalf("Fetched %+v", replication)
+    }
+}
+
+func TestReplicatorRebuildsLostShards(t *testing.T) {
+    const dataShards, parityShards = 3, 2
+    addrs, stops, servers := startTestBlockServers(t, dataShards + parityShards, ReplicationConfig{DataShards: dataShards, ParityShards: parityShards})
+    // Rounds are run by hand below
+    for i, server := range servers {
+        stop, err := server.StartBlockReplicator(addrs[i], addrs, time.Hour)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer stop()
+    }
+    router := newTestBlockRouter(t, addrs)
+    blocks, hashes := testBlocks(20, 1000)
+    var succ bool
+    if err := router.PutBlocks(blocks, DefaultMaxBatchBytes, &succ); err != nil {
+        t.Fatal(err)
+    }
+
+    // One server loses its disk, another is down
+    lost := servers[1]
+    lost.Mutex.Lock()
+    before := len(lost.BlockStore.(*BlockStore).ShardMap)
+    lost.BlockStore = &BlockStore{BlockMap: map[string]Block{}}
+    lost.Mutex.Unlock()
+    stops[2]()
+
+    rebuilt := 0
+    for i, server := range servers {
+        if i == 2 {
+            continue
+        }
+        n, err := server.replicator.replicate()
+        if err != nil {
+            t.Fatal(err)
+        }
+        rebuilt += n
+    }
+    if rebuilt != before {
+        t.Fatalf("Rebuilt %d shards, %d were lost", rebuilt, before)
+    }
+    lost.Mutex.RLock()
+    after := len(lost.BlockStore.(*BlockStore).ShardMap)
+    lost.Mutex.RUnlock()
+    if after != before {
+        t.Fatalf("The server has %d of its %d shards back", after, before)
+    }
+
+    // Another server may now go down as well
+    stops[3]()
+    var got []Block
+    if err := router.GetBlocks(hashes, &got); err != nil {
+        t.Fatal(err)
+    }
+    for i := range blocks {
+        if !bytes.Equal(got[i].BlockData, blocks[i].BlockData) {
+            t.Fatalf("Block %d differs", i)
+        }
+    }
+}
+
+func TestErasureCodedMissingBlockIsAnError(t *testing.T) {
+    addrs, _ := startTestBlockCluster(t, 3, ReplicationConfig{DataShards: 2, ParityShards: 1})
+    router := newTestBlockRouter(t, addrs)
+    _, hashes := testBlocks(1, 100)
+    var block Block
+    if err := router.GetBlock(hashes[0], &block); err == nil {
+        t.Fatal("A block that was never stored was returned")
+    }
+}
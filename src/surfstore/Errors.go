@@ -0,0 +1,76 @@
+package surfstore
+
+import (
+    "encoding/json"
+    "net/rpc"
+    "strings"
+)
+
+const (
+    versionConflictPrefix = "Version conflict: "
+    notLeaderPrefix       = "Not leader, leader is: "
+)
+
+/**
+* Returned by UpdateFile when the new version number is not exactly one greater than the
+* server's. It carries the server's current metadata of the file, so the client can resolve
+* the conflict without asking for the whole FileInfoMap again.
+*
+* net/rpc only sends the error string and drops the reply, so the metadata is encoded into
+* the message and decoded again by RPCClient, see decodeRPCError.
+*/
+type VersionConflictError struct {
+    Filename      string
+    Version       int
+    BlockHashList []string
+}
+
+func (e *VersionConflictError) Error() string {
+    data, _ := json.Marshal(e)
+    return versionConflictPrefix + string(data)
+}
+
+/**
+* The server's metadata of the conflicting file.
+*/
+func (e *VersionConflictError) FileMetaData() FileMetaData {
+    return FileMetaData{
+        Filename:      e.Filename,
+        Version:       e.Version,
+        BlockHashList: e.BlockHashList,
+    }
+}
+
+/**
+* Returned by a metadata server that is not the Raft leader. Leader is the address of the
+* node it believes is the leader, empty if it does not know one.
+*/
+type NotLeaderError struct {
+    Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+    return notLeaderPrefix + e.Leader
+}
+
+/**
+* Turn an error string received over RPC back into the typed error it was created from.
+* Errors that are not typed are returned unchanged.
+*/
+func decodeRPCError(err error) error {
+    serverErr, ok := err.(rpc.ServerError)
+    if !ok {
+        return err
+    }
+    msg := string(serverErr)
+    if strings.HasPrefix(msg, versionConflictPrefix) {
+        conflict := &VersionConflictError{}
+        if json.Unmarshal([]byte(msg[len(versionConflictPrefix):]), conflict) == nil {
+            return conflict
+        }
+    }
+    if strings.HasPrefix(msg, notLeaderPrefix) {
+        return &NotLeaderError{Leader: msg[len(notLeaderPrefix):]}
+    }
+    return err
+}
@@ -13,3 +13,24 @@ type FileInfo struct {
     FileMetaData   FileMetaData
     Status         State
 }
+
+const (
+    // Hash list of a deleted file
+    tombstoneHash = "0"
+    // Hash list of a directory
+    directoryHash = "dir"
+)
+
+/**
+* A deleted file is recorded with the hash list "0".
+*/
+func isTombstone(fileMetaData FileMetaData) bool {
+    return len(fileMetaData.BlockHashList) == 1 && fileMetaData.BlockHashList[0] == tombstoneHash
+}
+
+/**
+* A directory is recorded with the hash list "dir", so that empty directories sync too.
+*/
+func isDirectory(fileMetaData FileMetaData) bool {
+    return len(fileMetaData.BlockHashList) == 1 && fileMetaData.BlockHashList[0] == directoryHash
+}
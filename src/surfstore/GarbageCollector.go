@@ -0,0 +1,129 @@
+package surfstore
+
+import (
+    "errors"
+    "sort"
+    "time"
+)
+
+const (
+    // Blocks younger than this are never collected, see CollectGarbage.
+    DefaultGCGracePeriod = time.Hour
+)
+
+/**
+* Mark-and-sweep garbage collection of blocks that no file references anymore.
+*
+* The mark phase collects every hash in the committed metadata, the sweep phase removes all
+* other blocks from the BlockStore under the block lock, so no RPC observes a half collected
+* store. The metadata is that of the local MetaStore, or of the metadata servers in GCMetaAddrs
+* when the files referencing the blocks of this server live elsewhere. If it cannot be had,
+* e.g. on a Raft follower or when the metadata servers cannot be reached, nothing is removed.
+* Clients upload blocks before the UpdateFile that references them, so a block that is
+* unreferenced right now may be referenced by the next call. Blocks that were put, or
+* reported by HasBlocks, within gracePeriod are therefore kept.
+* Returns the number of removed blocks.
+*/
+func (s *Server) CollectGarbage(gracePeriod time.Duration) (int, error) {
+    sweeper, ok := s.BlockStore.(BlockSweeper)
+    if !ok {
+        return 0, errors.New("BlockStore does not support garbage collection")
+    }
+    live, err := s.referencedBlocks()
+    if err != nil {
+        logError("CollectGarbage Error: ", err)
+        return 0, err
+    }
+
+    s.Mutex.Lock()
+    defer func() {
+        s.Mutex.Unlock()
+    }()
+    removed, err := sweeper.SweepBlocks(live, time.Now().Add(-gracePeriod))
+    if err != nil {
+        logError("CollectGarbage Error: ", err)
+    }
+    return removed, err
+}
+
+/**
+* The blocks referenced by the committed metadata, the roots of garbage collection.
+*/
+func (s *Server) referencedBlocks() (map[string]bool, error) {
+    if len(s.GCMetaAddrs) == 0 {
+        referencer, ok := s.MetaStore.(BlockReferencer)
+        if !ok {
+            return nil, errors.New("MetaStore cannot report referenced blocks")
+        }
+        unlock := s.lockMeta(false)
+        defer func() {
+            unlock()
+        }()
+        return referencer.ReferencedBlocks()
+    }
+    router := newMetaRouter(s.GCMetaAddrs)
+    defer router.Close()
+    var succ bool
+    var blockHashes []string
+    if err := router.call("Server.GetReferencedBlocks", &succ, &blockHashes); err != nil {
+        return nil, err
+    }
+    live := make(map[string]bool, len(blockHashes))
+    for _, blockHash := range blockHashes {
+        live[blockHash] = true
+    }
+    return live, nil
+}
+
+/**
+* Returns the blocks referenced by the committed metadata of this server, for the garbage
+* collectors of the servers holding the blocks. A Raft follower returns a *NotLeaderError.
+*/
+func (s *Server) GetReferencedBlocks(_ignore *bool, blockHashes *[]string) error {
+    logDebug("GetReferencedBlocks")
+    referencer, ok := s.MetaStore.(BlockReferencer)
+    if !ok {
+        err := errors.New("MetaStore cannot report referenced blocks")
+        logError("GetReferencedBlocks Error: ", err)
+        return err
+    }
+    unlock := s.lockMeta(false)
+    defer func() {
+        unlock()
+    }()
+    live, err := referencer.ReferencedBlocks()
+    if err != nil {
+        logError("GetReferencedBlocks Error: ", err)
+        return err
+    }
+    for blockHash := range live {
+        *blockHashes = append(*blockHashes, blockHash)
+    }
+    sort.Strings(*blockHashes)
+    return nil
+}
+
+/**
+* Run CollectGarbage every interval until the returned stop function is called.
+*/
+func (s *Server) StartGarbageCollector(interval time.Duration, gracePeriod time.Duration) (stop func()) {
+    done := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                removed, err := s.CollectGarbage(gracePeriod)
+                if err == nil && removed > 0 {
+                    logInfo("Garbage collector removed", removed, "blocks")
+                }
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func() {
+        close(done)
+    }
+}
@@ -0,0 +1,78 @@
+package surfstore
+
+import (
+    "testing"
+)
+
+func TestBlockServerCollectsWithMetadataFromMetaService(t *testing.T) {
+    metaServer := NewSurfstoreServer()
+    metaAddr := startTestServer(t, &metaServer)
+    blockServer := NewSurfstoreServer()
+    blockServer.GCMetaAddrs = []string{metaAddr}
+
+    blocks, hashes := testBlocks(2, 100)
+    var succ bool
+    if err := blockServer.PutBlocks(blocks, &succ); err != nil {
+        t.Fatal(err)
+    }
+    var latestVersion int
+    if err := metaServer.UpdateFile(&FileMetaData{Filename: "f", Version: 1, BlockHashList: hashes[:1]}, &latestVersion); err != nil {
+        t.Fatal(err)
+    }
+
+    removed, err := blockServer.CollectGarbage(0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if removed != 1 {
+        t.Fatalf("Removed %d blocks, want 1", removed)
+    }
+    var left []string
+    if err := blockServer.HasBlocks(hashes, &left); err != nil {
+        t.Fatal(err)
+    }
+    if len(left) != 1 || left[0] != hashes[0] {
+        t.Fatalf("Left %v, want the referenced block", left)
+    }
+}
+
+func TestGarbageCollectionNeedsAuthoritativeMetadata(t *testing.T) {
+    blocks, hashes := testBlocks(1, 100)
+    var succ bool
+
+    // The metadata service cannot be reached
+    blockServer := NewSurfstoreServer()
+    blockServer.GCMetaAddrs = []string{"127.0.0.1:1"}
+    if err := blockServer.PutBlocks(blocks, &succ); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := blockServer.CollectGarbage(0); err == nil {
+        t.Fatal("Collected garbage without the metadata")
+    }
+    var left []string
+    if err := blockServer.HasBlocks(hashes, &left); err != nil {
+        t.Fatal(err)
+    }
+    if len(left) != 1 {
+        t.Fatal("A block was removed without the metadata")
+    }
+
+    // A Raft follower's copy may be behind
+    _, stores := startTestRaftCluster(t, 3)
+    leader := waitForLeader(t, stores)
+    for _, store := range stores {
+        if store == leader {
+            continue
+        }
+        follower := NewSurfstoreServerWithStores(&BlockStore{BlockMap: map[string]Block{}}, store)
+        if err := follower.PutBlocks(blocks, &succ); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := follower.CollectGarbage(0); err == nil {
+            t.Fatal("A follower collected garbage from its own copy")
+        }
+    }
+    if _, err := leader.ReferencedBlocks(); err != nil {
+        t.Fatal(err)
+    }
+}
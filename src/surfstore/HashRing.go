@@ -0,0 +1,135 @@
+package surfstore
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "sort"
+    "strconv"
+)
+
+const (
+    // Points per node on the ring, more points spread the keys more evenly
+    DefaultVirtualNodes = 100
+)
+
+/**
+* HashRing assigns keys to nodes by consistent hashing. Every node is placed on a ring of
+* 64 bit hashes at VirtualNodes points, and a key belongs to the first node clockwise from
+* the hash of the key. Adding or removing one of N nodes only moves the keys next to its
+* points, about 1/N of all keys.
+*
+* A HashRing is not safe for concurrent modification.
+*/
+type HashRing struct {
+    VirtualNodes int
+
+    points []ringPoint
+    nodes  map[string]bool
+}
+
+type ringPoint struct {
+    hash uint64
+    node string
+}
+
+func NewHashRing(nodes []string, virtualNodes int) *HashRing {
+    if virtualNodes <= 0 {
+        virtualNodes = DefaultVirtualNodes
+    }
+    ring := &HashRing{VirtualNodes: virtualNodes, nodes: make(map[string]bool)}
+    for _, node := range nodes {
+        ring.Add(node)
+    }
+    return ring
+}
+
+/**
+* Place a node on the ring, adding a node twice has no effect.
+*/
+func (h *HashRing) Add(node string) {
+    if h.nodes[node] {
+        return
+    }
+    h.nodes[node] = true
+    for i := 0; i < h.VirtualNodes; i++ {
+        h.points = append(h.points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+    }
+    sort.Slice(h.points, func(i, j int) bool {
+        if h.points[i].hash != h.points[j].hash {
+            return h.points[i].hash < h.points[j].hash
+        }
+        return h.points[i].node < h.points[j].node
+    })
+}
+
+/**
+* Take a node off the ring, its keys move to the next nodes clockwise.
+*/
+func (h *HashRing) Remove(node string) {
+    if !h.nodes[node] {
+        return
+    }
+    delete(h.nodes, node)
+    points := h.points[:0]
+    for _, point := range h.points {
+        if point.node != node {
+            points = append(points, point)
+        }
+    }
+    h.points = points
+}
+
+/**
+* All nodes on the ring, sorted.
+*/
+func (h *HashRing) Nodes() []string {
+    var nodes []string
+    for node := range h.nodes {
+        nodes = append(nodes, node)
+    }
+    sort.Strings(nodes)
+    return nodes
+}
+
+/**
+* The node that owns key, empty if the ring is empty.
+*/
+func (h *HashRing) Owner(key string) string {
+    nodes := h.Lookup(key, 1)
+    if len(nodes) == 0 {
+        return ""
+    }
+    return nodes[0]
+}
+
+/**
+* The first n distinct nodes clockwise from key, the owner first.
+* Fewer are returned if the ring has fewer nodes.
+*/
+func (h *HashRing) Lookup(key string, n int) []string {
+    if n > len(h.nodes) {
+        n = len(h.nodes)
+    }
+    var nodes []string
+    if n <= 0 {
+        return nodes
+    }
+    keyHash := ringHash(key)
+    start := sort.Search(len(h.points), func(i int) bool {
+        return h.points[i].hash >= keyHash
+    })
+    seen := make(map[string]bool)
+    for i := 0; len(nodes) < n; i++ {
+        node := h.points[(start + i) % len(h.points)].node
+        if !seen[node] {
+            seen[node] = true
+            nodes = append(nodes, node)
+        }
+    }
+    return nodes
+}
+
+func ringHash(key string) uint64 {
+    sum := sha256.Sum256([]byte(key))
+    return binary.BigEndian.Uint64(sum[:8])
+}
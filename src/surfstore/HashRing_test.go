@@ -0,0 +1,64 @@
+package surfstore
+
+import (
+    "strconv"
+    "testing"
+)
+
+const testRingKeys = 5000
+
+func ringOwners(ring *HashRing) map[string]string {
+    owners := make(map[string]string)
+    for i := 0; i < testRingKeys; i++ {
+        key := "key" + strconv.Itoa(i)
+        owners[key] = ring.Owner(key)
+    }
+    return owners
+}
+
+func TestHashRingAddMovesFewKeys(t *testing.T) {
+    ring := NewHashRing([]string{"node0", "node1", "node2", "node3", "node4"}, DefaultVirtualNodes)
+    before := ringOwners(ring)
+    ring.Add("node5")
+    after := ringOwners(ring)
+
+    moved := 0
+    for key, owner := range after {
+        if owner == before[key] {
+            continue
+        }
+        if owner != "node5" {
+            t.Fatalf("%s moved from %s to %s, not to the new node", key, before[key], owner)
+        }
+        moved++
+    }
+    // The new node should take about 1/6 of the keys
+    if moved == 0 || moved > 2 * testRingKeys / 6 {
+        t.Fatalf("%d of %d keys moved to the new node", moved, testRingKeys)
+    }
+}
+
+func TestHashRingRemoveMovesOnlyItsKeys(t *testing.T) {
+    ring := NewHashRing([]string{"node0", "node1", "node2", "node3", "node4"}, DefaultVirtualNodes)
+    before := ringOwners(ring)
+    ring.Remove("node2")
+    after := ringOwners(ring)
+
+    moved := 0
+    for key, owner := range after {
+        if owner == "node2" {
+            t.Fatalf("%s is still owned by the removed node", key)
+        }
+        if owner == before[key] {
+            continue
+        }
+        if before[key] != "node2" {
+            t.Fatalf("%s moved from %s to %s, not from the removed node", key, before[key], owner)
+        }
+        moved++
+    }
+    // The removed node held about 1/5 of the keys
+    if moved == 0 || moved > 2 * testRingKeys / 5 {
+        t.Fatalf("%d of %d keys moved off the removed node", moved, testRingKeys)
+    }
+}
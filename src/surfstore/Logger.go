@@ -0,0 +1,50 @@
+package surfstore
+
+import (
+    "errors"
+    "log"
+)
+
+const (
+    LogDebug = iota
+    LogInfo
+    LogError
+)
+
+// Messages below this level are dropped
+var logLevel = LogInfo
+
+/**
+* Set the log level by name: debug, info or error.
+*/
+func SetLogLevel(level string) error {
+    switch level {
+    case "debug":
+        logLevel = LogDebug
+    case "info":
+        logLevel = LogInfo
+    case "error":
+        logLevel = LogError
+    default:
+        return errors.New("Unknown log level: " + level)
+    }
+    return nil
+}
+
+func logDebug(v ...interface{}) {
+    if logLevel <= LogDebug {
+        log.Println(v...)
+    }
+}
+
+func logInfo(v ...interface{}) {
+    if logLevel <= LogInfo {
+        log.Println(v...)
+    }
+}
+
+func logError(v ...interface{}) {
+    if logLevel <= LogError {
+        log.Println(v...)
+    }
+}
@@ -0,0 +1,175 @@
+package surfstore
+
+import (
+    "bytes"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    // Larger files are not merged, they become conflicted copies
+    maxMergeBytes = 4 * 1024 * 1024
+    // Versions further apart than this many inserted and deleted lines are not merged
+    maxMergeEdits = 4000
+
+    conflictMarkerLocal  = "<<<<<<< local\n"
+    conflictMarkerSplit  = "=======\n"
+    conflictMarkerServer = ">>>>>>> server\n"
+)
+
+/**
+* Whether data looks like text that can be merged line by line.
+*/
+func isMergeableText(data []byte) bool {
+    return len(data) <= maxMergeBytes && utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+/**
+* Line-based three-way merge of the local and server versions of a file with their common
+* ancestor. A region changed differently on both sides is written with conflict markers and
+* conflicts is set. ok is false if the versions are too different to merge.
+*/
+func mergeText(base []byte, local []byte, server []byte) (merged []byte, conflicts bool, ok bool) {
+    baseLines := splitLines(base)
+    localLines := splitLines(local)
+    serverLines := splitLines(server)
+    toLocal, ok := matchLines(baseLines, localLines)
+    if !ok {
+        return nil, false, false
+    }
+    toServer, ok := matchLines(baseLines, serverLines)
+    if !ok {
+        return nil, false, false
+    }
+
+    var out bytes.Buffer
+    i, j, k := 0, 0, 0
+    for i < len(baseLines) || j < len(localLines) || k < len(serverLines) {
+        if i < len(baseLines) && toLocal[i] == j && toServer[i] == k {
+            // Unchanged on both sides
+            out.WriteString(baseLines[i])
+            i, j, k = i + 1, j + 1, k + 1
+            continue
+        }
+
+        // The changed region ends at the next base line both sides kept
+        nextI, nextJ, nextK := len(baseLines), len(localLines), len(serverLines)
+        for n := i; n < len(baseLines); n++ {
+            if toLocal[n] >= 0 && toServer[n] >= 0 {
+                nextI, nextJ, nextK = n, toLocal[n], toServer[n]
+                break
+            }
+        }
+        baseChunk := baseLines[i:nextI]
+        localChunk := localLines[j:nextJ]
+        serverChunk := serverLines[k:nextK]
+        switch {
+        case sameLines(localChunk, baseChunk):
+            writeLines(&out, serverChunk, false)
+        case sameLines(serverChunk, baseChunk), sameLines(localChunk, serverChunk):
+            writeLines(&out, localChunk, false)
+        default:
+            conflicts = true
+            out.WriteString(conflictMarkerLocal)
+            writeLines(&out, localChunk, true)
+            out.WriteString(conflictMarkerSplit)
+            writeLines(&out, serverChunk, true)
+            out.WriteString(conflictMarkerServer)
+        }
+        i, j, k = nextI, nextJ, nextK
+    }
+    return out.Bytes(), conflicts, true
+}
+
+/**
+* Lines including their line break, the last one may have none.
+*/
+func splitLines(data []byte) []string {
+    lines := strings.SplitAfter(string(data), "\n")
+    if lines[len(lines) - 1] == "" {
+        lines = lines[:len(lines) - 1]
+    }
+    return lines
+}
+
+func sameLines(a []string, b []string) bool {
+    return sameHashList(a, b)
+}
+
+/**
+* Write lines as they are. With beforeMarker a last line without a line break gets one,
+* the conflict marker that follows must start on a line of its own.
+*/
+func writeLines(out *bytes.Buffer, lines []string, beforeMarker bool) {
+    for _, line := range lines {
+        out.WriteString(line)
+    }
+    if beforeMarker && len(lines) > 0 && !strings.HasSuffix(lines[len(lines) - 1], "\n") {
+        out.WriteString("\n")
+    }
+}
+
+/**
+* For each line of a, the index of the matching line of b in a longest common subsequence,
+* -1 for lines only in a. Uses Myers' diff, ok is false after maxMergeEdits edits.
+*/
+func matchLines(a []string, b []string) ([]int, bool) {
+    n, m := len(a), len(b)
+    offset := n + m + 1
+    v := make([]int, 2 * offset + 1)
+    // trace[d] holds v[-d-1 .. d+1] as it was before step d
+    var trace [][]int
+
+    found := false
+    for d := 0; d <= n + m && !found; d++ {
+        if d > maxMergeEdits {
+            return nil, false
+        }
+        trace = append(trace, append([]int(nil), v[offset - d - 1 : offset + d + 2]...))
+        for diagonal := -d; diagonal <= d; diagonal += 2 {
+            var x int
+            if diagonal == -d || (diagonal != d && v[offset + diagonal - 1] < v[offset + diagonal + 1]) {
+                x = v[offset + diagonal + 1]
+            } else {
+                x = v[offset + diagonal - 1] + 1
+            }
+            y := x - diagonal
+            for x < n && y < m && a[x] == b[y] {
+                x, y = x + 1, y + 1
+            }
+            v[offset + diagonal] = x
+            if x >= n && y >= m {
+                found = true
+                break
+            }
+        }
+    }
+
+    matches := make([]int, n)
+    for i := range matches {
+        matches[i] = -1
+    }
+    x, y := n, m
+    for d := len(trace) - 1; d >= 0; d-- {
+        previous := func(diagonal int) int {
+            return trace[d][diagonal + d + 1]
+        }
+        diagonal := x - y
+        var prevDiagonal int
+        if diagonal == -d || (diagonal != d && previous(diagonal - 1) < previous(diagonal + 1)) {
+            prevDiagonal = diagonal + 1
+        } else {
+            prevDiagonal = diagonal - 1
+        }
+        prevX := previous(prevDiagonal)
+        prevY := prevX - prevDiagonal
+        for x > prevX && y > prevY {
+            x, y = x - 1, y - 1
+            matches[x] = y
+        }
+        if d > 0 {
+            x, y = prevX, prevY
+        }
+    }
+    return matches, true
+}
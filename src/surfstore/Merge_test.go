@@ -0,0 +1,111 @@
+package surfstore
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestMergeTextCleanMerges(t *testing.T) {
+    cases := []struct {
+        name                string
+        base, local, server string
+        want                string
+    }{
+        {"changes in different lines", "a\nb\nc\nd\n", "A\nb\nc\nd\n", "a\nb\nc\nD\n", "A\nb\nc\nD\n"},
+        {"only the server changed", "a\nb\n", "a\nb\n", "a\nc\n", "a\nc\n"},
+        {"both made the same change", "a\nb\n", "a\nx\n", "a\nx\n", "a\nx\n"},
+        {"insertions on both sides", "a\nb\nc\n", "a\nl\nb\nc\n", "a\nb\nc\ns\n", "a\nl\nb\nc\ns\n"},
+        {"server change without a trailing newline", "a\nb", "a\nb", "a\nc", "a\nc"},
+        {"local change without a trailing newline", "a\nb", "a\nc", "a\nb", "a\nc"},
+        {"empty base", "", "", "new\n", "new\n"},
+    }
+    for _, c := range cases {
+        merged, conflicts, ok := mergeText([]byte(c.base), []byte(c.local), []byte(c.server))
+        if !ok || conflicts {
+            t.Fatalf("%s: ok %v, conflicts %v", c.name, ok, conflicts)
+        }
+        if string(merged) != c.want {
+            t.Fatalf("%s: merged to %q, want %q", c.name, merged, c.want)
+        }
+    }
+}
+
+func TestMergeTextConflicts(t *testing.T) {
+    merged, conflicts, ok := mergeText([]byte("a\nb\nc\n"), []byte("a\nlocal\nc\n"), []byte("a\nserver\nc\n"))
+    if !ok || !conflicts {
+        t.Fatalf("ok %v, conflicts %v", ok, conflicts)
+    }
+    want := "a\n" + conflictMarkerLocal + "local\n" + conflictMarkerSplit + "server\n" + conflictMarkerServer + "c\n"
+    if string(merged) != want {
+        t.Fatalf("Merged to %q, want %q", merged, want)
+    }
+
+    // The markers stay on lines of their own
+    merged, conflicts, ok = mergeText([]byte("a\nb"), []byte("a\nlocal"), []byte("a\nserver"))
+    if !ok || !conflicts {
+        t.Fatalf("ok %v, conflicts %v", ok, conflicts)
+    }
+    want = "a\n" + conflictMarkerLocal + "local\n" + conflictMarkerSplit + "server\n" + conflictMarkerServer
+    if string(merged) != want {
+        t.Fatalf("Merged to %q, want %q", merged, want)
+    }
+}
+
+func TestMergeTextGivesUpOnTooManyEdits(t *testing.T) {
+    var base, server []string
+    for i := 0; i < maxMergeEdits / 2 + 100; i++ {
+        base = append(base, "base " + strconv.Itoa(i) + "\n")
+        server = append(server, "server " + strconv.Itoa(i) + "\n")
+    }
+    baseText := strings.Join(base, "")
+    if _, _, ok := mergeText([]byte(baseText), []byte(baseText), []byte(strings.Join(server, ""))); ok {
+        t.Fatal("Versions with too many edits were merged")
+    }
+    if _, ok := matchLines(base, server); ok {
+        t.Fatal("matchLines did not give up")
+    }
+}
+
+func TestMatchLinesFindsLongestCommonSubsequence(t *testing.T) {
+    a := splitLines([]byte("a\nb\nc\na\nb\nb\na\n"))
+    b := splitLines([]byte("c\nb\na\nb\na\nc\n"))
+    matches, ok := matchLines(a, b)
+    if !ok {
+        t.Fatal("matchLines gave up")
+    }
+    matched, last := 0, -1
+    for i, j := range matches {
+        if j < 0 {
+            continue
+        }
+        if j <= last || a[i] != b[j] {
+            t.Fatalf("Line %d matched to %d in %v", i, j, matches)
+        }
+        last = j
+        matched++
+    }
+    // The classic example of Myers' paper has an edit distance of 5
+    if matched != 4 {
+        t.Fatalf("Matched %d lines, want 4", matched)
+    }
+
+    identical, ok := matchLines(a, a)
+    if !ok {
+        t.Fatal("matchLines gave up")
+    }
+    for i, j := range identical {
+        if i != j {
+            t.Fatalf("Identical line %d matched to %d", i, j)
+        }
+    }
+    none, ok := matchLines(a, nil)
+    if !ok {
+        t.Fatal("matchLines gave up")
+    }
+    for _, j := range none {
+        if j != -1 {
+            t.Fatal("A line matched an empty file")
+        }
+    }
+}
@@ -0,0 +1,194 @@
+package surfstore
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "sort"
+)
+
+const (
+    // Hex digits of the prefixes of the leaves, 16^3 = 4096 leaves
+    merkleDepth = 3
+    merkleDigits = "0123456789abcdef"
+)
+
+/**
+* Summary of the blocks whose hash starts with Prefix. Hash covers the subtree and is
+* empty if there are no such blocks.
+*/
+type MerkleNode struct {
+    Prefix string
+    Hash   string
+    Count  int
+}
+
+/**
+* Arguments of the Merkle tree RPCs.
+*/
+type MerkleArgs struct {
+    // Address of the block server asking. In a replicated cluster the tree only covers
+    // the blocks that both servers should hold.
+    Replica  string
+    Prefixes []string
+}
+
+/**
+* merkleTree summarizes a set of block hashes so that two servers can find the blocks
+* they differ in by exchanging only a few hashes. The tree has a fixed shape: the node
+* with prefix p covers the blocks whose hash starts with p and has one child per next hex
+* digit, and the leaves are the prefixes of merkleDepth digits. Two sets agree on a
+* subtree exactly when the node hashes agree.
+*/
+type merkleTree struct {
+    nodes  map[string]MerkleNode
+    leaves map[string][]string
+}
+
+func buildMerkleTree(blockHashes []string) *merkleTree {
+    tree := &merkleTree{nodes: make(map[string]MerkleNode), leaves: make(map[string][]string)}
+    for _, blockHash := range blockHashes {
+        if len(blockHash) < merkleDepth {
+            continue
+        }
+        prefix := blockHash[:merkleDepth]
+        tree.leaves[prefix] = append(tree.leaves[prefix], blockHash)
+    }
+    for prefix, leaf := range tree.leaves {
+        sort.Strings(leaf)
+        digest := sha256.New()
+        for _, blockHash := range leaf {
+            digest.Write([]byte(blockHash))
+        }
+        tree.nodes[prefix] = MerkleNode{Prefix: prefix, Hash: hex.EncodeToString(digest.Sum(nil)), Count: len(leaf)}
+    }
+
+    // Inner nodes, bottom up
+    for depth := merkleDepth - 1; depth >= 0; depth-- {
+        parents := make(map[string]bool)
+        for prefix := range tree.nodes {
+            if len(prefix) == depth + 1 {
+                parents[prefix[:depth]] = true
+            }
+        }
+        for parent := range parents {
+            digest := sha256.New()
+            count := 0
+            for _, child := range merkleChildren(parent) {
+                if node, ok := tree.nodes[child]; ok {
+                    digest.Write([]byte(node.Prefix + node.Hash))
+                    count += node.Count
+                }
+            }
+            tree.nodes[parent] = MerkleNode{Prefix: parent, Hash: hex.EncodeToString(digest.Sum(nil)), Count: count}
+        }
+    }
+    return tree
+}
+
+/**
+* The node with the given prefix, an empty subtree if there is none.
+*/
+func (t *merkleTree) node(prefix string) MerkleNode {
+    if node, ok := t.nodes[prefix]; ok {
+        return node
+    }
+    return MerkleNode{Prefix: prefix}
+}
+
+func merkleChildren(prefix string) []string {
+    children := make([]string, len(merkleDigits))
+    for i := range merkleDigits {
+        children[i] = prefix + merkleDigits[i:i + 1]
+    }
+    return children
+}
+
+/**
+* Returns the Merkle tree nodes with the given prefixes, in order.
+*/
+func (s *Server) GetMerkleNodes(args MerkleArgs, nodes *[]MerkleNode) error {
+    logDebug("GetMerkleNodes: ", len(args.Prefixes), "prefixes")
+    tree, err := s.merkleTree(args.Replica)
+    if err != nil {
+        logError("GetMerkleNodes Error: ", err)
+        return err
+    }
+    for _, prefix := range args.Prefixes {
+        *nodes = append(*nodes, tree.node(prefix))
+    }
+    return nil
+}
+
+/**
+* Returns the hashes of the blocks in the Merkle tree leaves with the given prefixes.
+*/
+func (s *Server) GetMerkleLeaves(args MerkleArgs, blockHashes *[]string) error {
+    logDebug("GetMerkleLeaves: ", len(args.Prefixes), "prefixes")
+    tree, err := s.merkleTree(args.Replica)
+    if err != nil {
+        logError("GetMerkleLeaves Error: ", err)
+        return err
+    }
+    for _, prefix := range args.Prefixes {
+        *blockHashes = append(*blockHashes, tree.leaves[prefix]...)
+    }
+    return nil
+}
+
+/**
+* The Merkle tree of the blocks this server shares with replica. A replicator keeps the
+* trees until a block is stored or removed, a round asks for the same tree once per level.
+*/
+func (s *Server) merkleTree(replica string) (*merkleTree, error) {
+    if s.replicator == nil {
+        blockHashes, _, err := s.listBlocks()
+        if err != nil {
+            return nil, err
+        }
+        return buildMerkleTree(blockHashes), nil
+    }
+    return s.replicator.merkleTree(replica)
+}
+
+/**
+* The blocks of the server and the generation of the block store they were listed at.
+*/
+func (s *Server) listBlocks() ([]string, int, error) {
+    lister, ok := s.BlockStore.(BlockLister)
+    if !ok {
+        return nil, 0, errors.New("BlockStore cannot list its blocks")
+    }
+    s.Mutex.RLock()
+    defer s.Mutex.RUnlock()
+    blockHashes, err := lister.ListBlocks()
+    return blockHashes, lister.Generation(), err
+}
+
+func (r *blockReplicator) merkleTree(replica string) (*merkleTree, error) {
+    store := r.server.BlockStore
+    lister, ok := store.(BlockLister)
+    if !ok {
+        return nil, errors.New("BlockStore cannot list its blocks")
+    }
+    r.server.Mutex.RLock()
+    generation := lister.Generation()
+    r.server.Mutex.RUnlock()
+
+    r.merkleMutex.Lock()
+    defer r.merkleMutex.Unlock()
+    if r.merkleTrees == nil || r.merkleStore != store || r.merkleGeneration != generation {
+        blockHashes, listed, err := r.server.listBlocks()
+        if err != nil {
+            return nil, err
+        }
+        r.merkleStore, r.merkleGeneration, r.merkleBlocks = store, listed, blockHashes
+        r.merkleTrees = make(map[string]*merkleTree)
+    }
+    tree, ok := r.merkleTrees[replica]
+    if !ok {
+        tree = buildMerkleTree(r.shared(r.merkleBlocks, replica))
+        r.merkleTrees[replica] = tree
+    }
+    return tree, nil
+}
@@ -0,0 +1,108 @@
+package surfstore
+
+import (
+    "sync"
+    "time"
+)
+
+const (
+    // Each server is tried this many times before a metadata call fails
+    metaRetryRounds = 10
+    metaRetryBackoff = 50 * time.Millisecond
+)
+
+/**
+* metaRouter sends metadata calls to the leader of a Raft cluster.
+* It starts with the first server, follows the leader named in a *NotLeaderError,
+* and moves on to the next server when one cannot be reached. An update that was sent
+* before its connection broke is not sent again, it may have been committed.
+*/
+type metaRouter struct {
+    mutex  sync.Mutex
+    addrs  []string
+    leader string
+    pools  map[string]*connPool
+}
+
+func newMetaRouter(addrs []string) *metaRouter {
+    router := &metaRouter{pools: make(map[string]*connPool)}
+    router.addrs = append(router.addrs, addrs...)
+    if len(addrs) > 0 {
+        router.leader = addrs[0]
+    }
+    return router
+}
+
+func (r *metaRouter) call(serviceMethod string, args interface{}, reply interface{}) error {
+    var err error
+    for attempt := 1; attempt <= len(r.addrs) * metaRetryRounds; attempt++ {
+        addr, pool := r.current()
+        callErr := pool.call(serviceMethod, args, reply)
+        err = decodeRPCError(callErr)
+        if notLeader, ok := err.(*NotLeaderError); ok {
+            r.redirect(addr, notLeader.Leader)
+        } else if callErr != nil && isConnError(callErr) && callErr != errCallTimeout && (isIdempotent(serviceMethod) || isDialError(callErr)) {
+            r.redirect(addr, "")
+        } else {
+            return err
+        }
+        backoff := metaRetryBackoff * time.Duration(attempt)
+        if backoff > 10 * metaRetryBackoff {
+            backoff = 10 * metaRetryBackoff
+        }
+        time.Sleep(backoff)
+    }
+    return err
+}
+
+/**
+* The assumed leader and its connection pool.
+*/
+func (r *metaRouter) current() (string, *connPool) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    pool, ok := r.pools[r.leader]
+    if !ok {
+        pool = newConnPool(r.leader, DefaultMaxIdleConns)
+        r.pools[r.leader] = pool
+    }
+    return r.leader, pool
+}
+
+/**
+* Switch to leader, or to the server after failed if the leader is unknown.
+*/
+func (r *metaRouter) redirect(failed string, leader string) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.leader != failed {
+        // Another call already moved on
+        return
+    }
+    if leader != "" {
+        known := false
+        for _, addr := range r.addrs {
+            known = known || addr == leader
+        }
+        if !known {
+            r.addrs = append(r.addrs, leader)
+        }
+        r.leader = leader
+        return
+    }
+    for i, addr := range r.addrs {
+        if addr == failed {
+            r.leader = r.addrs[(i + 1) % len(r.addrs)]
+            return
+        }
+    }
+}
+
+func (r *metaRouter) Close() error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    for _, pool := range r.pools {
+        pool.Close()
+    }
+    return nil
+}
@@ -1,11 +1,103 @@
 package surfstore
 
 import (
+    "crypto/rand"
+    "encoding/hex"
     "errors"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
 )
 
+const (
+    // Changes returned by one GetChangesSince call if the client does not ask for fewer
+    DefaultChangesPageSize = 1000
+    // Versions of each file kept in its history, including the current one
+    MaxFileVersions = 10
+
+    OpUpdateFile = "UpdateFile"
+    // FileMetaData is the renamed file at its new path, Source the tombstone left behind
+    OpRenameFile = "RenameFile"
+    // Files are updated together or not at all
+    OpCommitFiles = "CommitFiles"
+    OpCreateSnapshot = "CreateSnapshot"
+    // Time is the cutoff, tombstones of files deleted before it are removed
+    OpPurgeTombstones = "PurgeTombstones"
+    // Appended by a new Raft leader, changes nothing
+    OpNoop = "Noop"
+)
+
+/**
+* A single mutation of the MetaStore, as written to the write-ahead log or replicated by Raft.
+*/
+type MetaLogEntry struct {
+    Op           string
+    FileMetaData FileMetaData
+    // Tombstone of the old path of a renamed file
+    Source FileMetaData
+    // Updates committed together
+    Files []FileMetaData
+    // Renames committed together with Files
+    Renames []RenamedFile
+    // Name of the snapshot to create
+    SnapshotName string
+    // When the update was accepted, recorded in the file's history
+    Time time.Time
+    // Position in the write-ahead log of a PersistentMetaStore, 0 elsewhere
+    LogIndex int
+}
+
+/**
+* A rename as logged, the tombstone at the old path and the file at the new one.
+*/
+type RenamedFile struct {
+    Source FileMetaData
+    Target FileMetaData
+}
+
 type MetaStore struct {
     FileMetaMap map[string]FileMetaData
+
+    // Identifies this history of changes, a cursor of another history is not valid here
+    Epoch string
+    // Sequence number of the last change, it only ever grows
+    Sequence int
+    // Sequence number of the last change of each file
+    FileSequence map[string]int
+    // Sequence number of the newest purged tombstone, an older cursor may have missed deletions
+    PurgedSequence int
+    // Retained versions of each file, oldest first, the last one is the current version
+    History map[string][]FileVersion
+    // Immutable copies of FileMetaMap by name
+    NamespaceSnapshots map[string]NamespaceSnapshot
+
+    // Files in the order of their changes, possibly with stale entries of files that
+    // changed again later. Rebuilt from FileSequence when not valid.
+    changeIndex      []fileChange
+    changeIndexValid bool
+    // Closed on the next change, nil while nobody waits
+    changed chan struct{}
+}
+
+type fileChange struct {
+    Sequence int
+    Filename string
+}
+
+/**
+* Create an empty MetaStore with a new random epoch.
+*/
+func NewMetaStore() *MetaStore {
+    epoch := make([]byte, 8)
+    rand.Read(epoch)
+    return &MetaStore{
+        FileMetaMap:  map[string]FileMetaData{},
+        Epoch:        hex.EncodeToString(epoch),
+        FileSequence: map[string]int{},
+        History:      map[string][]FileVersion{},
+        NamespaceSnapshots: map[string]NamespaceSnapshot{},
+    }
 }
 
 /**
@@ -13,8 +105,12 @@ type MetaStore struct {
 * including the version, filename, and hashlist.
 */
 func (m *MetaStore) GetFileInfoMap(_ignore *bool, serverFileInfoMap *map[string]FileMetaData) error {
-    // Only retrieve the map
-    *serverFileInfoMap = m.FileMetaMap
+    // A copy, the RPC reply is encoded after the server's lock is released
+    fileInfoMap := make(map[string]FileMetaData, len(m.FileMetaMap))
+    for fileName, fileMetaData := range m.FileMetaMap {
+        fileInfoMap[fileName] = fileMetaData
+    }
+    *serverFileInfoMap = fileInfoMap
     return nil
 }
 
@@ -25,21 +121,578 @@ func (m *MetaStore) GetFileInfoMap(_ignore *bool, serverFileInfoMap *map[string]
 * they are trying to store is not right (likely too old) as well as the current value of the file’s version on the server.
 */
 func (m *MetaStore) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) (err error) {
-    filename := fileMetaData.Filename
+    return m.updateFile(fileMetaData, latestVersion, time.Now())
+}
+
+func (m *MetaStore) updateFile(fileMetaData *FileMetaData, latestVersion *int, updateTime time.Time) error {
+    if err := m.checkUpdate(fileMetaData); err != nil {
+        if conflict, ok := err.(*VersionConflictError); ok {
+            *latestVersion = conflict.Version
+        }
+        return err
+    }
+    m.setFile(*fileMetaData, updateTime)
+    *latestVersion = fileMetaData.Version       // Update the lastest version as the new version.
+    return nil
+}
+
+/**
+* Updates several files and renames others at once. Either every file is at the version before
+* its new one and every rename may be applied, and all of them are stored, or none is and the
+* error of the first one that may not is returned. latestVersions is set to the new versions of
+* args.Files followed by those of the rename targets, in order.
+*/
+func (m *MetaStore) CommitFiles(args CommitArgs, latestVersions *[]int) error {
+    renames, err := m.renamedFilesOf(args.Renames)
+    if err != nil {
+        return err
+    }
+    if err := m.checkCommit(args.Files, renames); err != nil {
+        return err
+    }
+    if _, err := m.applyCommand(MetaLogEntry{Op: OpCommitFiles, Files: args.Files, Renames: renames, Time: time.Now()}); err != nil {
+        return err
+    }
+    *latestVersions = committedVersions(args.Files, renames)
+    return nil
+}
+
+/**
+* Check that every update and rename of a commit may be applied without modifying anything.
+* No path may be touched twice.
+*/
+func (m *MetaStore) checkCommit(files []FileMetaData, renames []RenamedFile) error {
+    seen := make(map[string]bool)
+    for _, fileName := range committedPaths(files, renames) {
+        if seen[fileName] {
+            return errors.New("File committed twice: " + fileName)
+        }
+        seen[fileName] = true
+    }
+    for i := range files {
+        if err := m.checkUpdate(&files[i]); err != nil {
+            return err
+        }
+    }
+    for _, rename := range renames {
+        if err := m.checkRename(rename.Source, rename.Target); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func committedPaths(files []FileMetaData, renames []RenamedFile) []string {
+    var fileNames []string
+    for _, fileMetaData := range files {
+        fileNames = append(fileNames, fileMetaData.Filename)
+    }
+    for _, rename := range renames {
+        fileNames = append(fileNames, rename.Source.Filename, rename.Target.Filename)
+    }
+    return fileNames
+}
+
+func (m *MetaStore) commitFiles(files []FileMetaData, renames []RenamedFile, commitTime time.Time) {
+    for _, fileMetaData := range files {
+        m.setFile(fileMetaData, commitTime)
+    }
+    for _, rename := range renames {
+        m.renameFile(rename.Source, rename.Target, commitTime)
+    }
+}
+
+func committedVersions(files []FileMetaData, renames []RenamedFile) []int {
+    versions := make([]int, 0, len(files) + len(renames))
+    for _, fileMetaData := range files {
+        versions = append(versions, fileMetaData.Version)
+    }
+    for _, rename := range renames {
+        versions = append(versions, rename.Target.Version)
+    }
+    return versions
+}
+
+/**
+* Moves a file to a new path in one step, leaving a tombstone at the old path. Both paths must
+* be at the versions the client knows, otherwise a *VersionConflictError names the one that is
+* not. latestVersion is set to the version of the file at its new path.
+*/
+func (m *MetaStore) RenameFile(args RenameArgs, latestVersion *int) error {
+    source, target, err := m.renamedFiles(args)
+    if err != nil {
+        return err
+    }
+    *latestVersion, err = m.applyCommand(MetaLogEntry{Op: OpRenameFile, FileMetaData: target, Source: source, Time: time.Now()})
+    return err
+}
+
+/**
+* The tombstone at the old path and the file at the new path after a rename.
+*/
+func (m *MetaStore) renamedFiles(args RenameArgs) (source FileMetaData, target FileMetaData, err error) {
+    current, ok := m.FileMetaMap[args.Source]
+    if !ok || isTombstone(current) {
+        return FileMetaData{}, FileMetaData{}, errors.New("File not found: " + args.Source)
+    }
+    if isDirectory(current) {
+        return FileMetaData{}, FileMetaData{}, errors.New("Cannot rename a directory: " + args.Source)
+    }
+    if args.Target == "" || args.Target == args.Source {
+        return FileMetaData{}, FileMetaData{}, errors.New("Invalid rename target: " + strconv.Quote(args.Target))
+    }
+    source = FileMetaData{Filename: args.Source, Version: args.SourceVersion + 1, BlockHashList: []string{tombstoneHash}}
+    target = FileMetaData{Filename: args.Target, Version: args.TargetVersion + 1, BlockHashList: current.BlockHashList}
+    if err := m.checkRename(source, target); err != nil {
+        return FileMetaData{}, FileMetaData{}, err
+    }
+    return source, target, nil
+}
+
+/**
+* The renames of a commit as they are logged.
+*/
+func (m *MetaStore) renamedFilesOf(renames []RenameArgs) ([]RenamedFile, error) {
+    var renamed []RenamedFile
+    for _, args := range renames {
+        source, target, err := m.renamedFiles(args)
+        if err != nil {
+            return nil, err
+        }
+        renamed = append(renamed, RenamedFile{Source: source, Target: target})
+    }
+    return renamed, nil
+}
+
+/**
+* Check that a rename may be applied without modifying anything. The file must still have the
+* content it had when the rename was accepted.
+*/
+func (m *MetaStore) checkRename(source FileMetaData, target FileMetaData) error {
+    current, ok := m.FileMetaMap[source.Filename]
+    if !ok {
+        return errors.New("File not found: " + source.Filename)
+    }
+    if err := m.checkUpdate(&source); err != nil {
+        return err
+    }
+    if !sameHashList(current.BlockHashList, target.BlockHashList) {
+        return errors.New("File changed while it was renamed: " + source.Filename)
+    }
+    if _, ok := m.FileMetaMap[target.Filename]; !ok && target.Version != 1 {
+        // The client expects a file the server does not have
+        return &VersionConflictError{Filename: target.Filename}
+    }
+    return m.checkUpdate(&target)
+}
+
+func (m *MetaStore) renameFile(source FileMetaData, target FileMetaData, renameTime time.Time) {
+    m.setFile(source, renameTime)
+    m.setFile(target, renameTime)
+}
+
+/**
+* Returns the files changed after args.Cursor, in the order of their last change, and the
+* cursor to continue from. A file that changed several times is only returned once. If the
+* cursor is not valid here, e.g. because it is from before a restart of an in-memory server,
+* reply.Reset is set and the changes start from the beginning.
+*/
+func (m *MetaStore) GetChangesSince(args ChangesArgs, reply *ChangesReply) error {
+    cursor := args.Cursor
+    if m.PurgedSequence > 0 && (cursor.Epoch != m.Epoch || cursor.Sequence < m.PurgedSequence) {
+        // Deletions after the cursor may be gone, the client must compare everything
+        reply.Expired = true
+        cursor = ChangeCursor{Epoch: m.Epoch}
+        reply.Reset = true
+    }
+    if cursor.Epoch != m.Epoch || cursor.Sequence < 0 || cursor.Sequence > m.Sequence {
+        cursor = ChangeCursor{Epoch: m.Epoch}
+        reply.Reset = true
+    }
+    limit := args.Limit
+    if limit <= 0 || limit > DefaultChangesPageSize {
+        limit = DefaultChangesPageSize
+    }
+
+    changes := m.sortedChanges()
+    start := sort.Search(len(changes), func(i int) bool {
+        return changes[i].Sequence > cursor.Sequence
+    })
+    for _, change := range changes[start:] {
+        if m.FileSequence[change.Filename] != change.Sequence {
+            // The file changed again later
+            continue
+        }
+        if len(reply.Changes) == limit {
+            reply.More = true
+            break
+        }
+        reply.Changes = append(reply.Changes, m.FileMetaMap[change.Filename])
+        cursor.Sequence = change.Sequence
+    }
+    if !reply.More {
+        cursor.Sequence = m.Sequence
+    }
+    reply.Cursor = cursor
+    return nil
+}
+
+/**
+* Returns the retained versions of a file, oldest first. The list is empty for an unknown file.
+*/
+func (m *MetaStore) GetFileHistory(fileName string, versions *[]FileVersion) error {
+    *versions = append([]FileVersion(nil), m.fileHistory(fileName)...)
+    return nil
+}
+
+/**
+* Stores an old version of a file from its history as the next version. latestVersion is set
+* to the new version.
+*/
+func (m *MetaStore) RestoreFile(args RestoreArgs, latestVersion *int) error {
+    restored, err := m.restoredFile(args)
+    if err != nil {
+        return err
+    }
+    return m.UpdateFile(&restored, latestVersion)
+}
+
+/**
+* The update that restores a version of a file from its history.
+*/
+func (m *MetaStore) restoredFile(args RestoreArgs) (FileMetaData, error) {
+    current, ok := m.FileMetaMap[args.Filename]
+    if !ok {
+        return FileMetaData{}, errors.New("File not found: " + args.Filename)
+    }
+    for _, version := range m.fileHistory(args.Filename) {
+        if version.FileMetaData.Version == args.Version {
+            restored := version.FileMetaData
+            restored.Version = current.Version + 1
+            return restored, nil
+        }
+    }
+    return FileMetaData{}, errors.New("Version " + strconv.Itoa(args.Version) + " of " + args.Filename + " is not in the history")
+}
+
+/**
+* Creates an immutable snapshot of all files under a new name. Its blocks are kept by garbage
+* collection for as long as the snapshot exists.
+*/
+func (m *MetaStore) CreateSnapshot(name string, succ *bool) error {
+    if err := m.checkSnapshot(name); err != nil {
+        return err
+    }
+    m.createSnapshot(name, time.Now())
+    *succ = true
+    return nil
+}
+
+/**
+* Returns the snapshots, oldest first.
+*/
+func (m *MetaStore) ListSnapshots(_ignore *bool, snapshots *[]SnapshotInfo) error {
+    *snapshots = nil
+    for _, snapshot := range m.NamespaceSnapshots {
+        *snapshots = append(*snapshots, SnapshotInfo{Name: snapshot.Name, Time: snapshot.Time, Files: len(snapshot.Files)})
+    }
+    sort.Slice(*snapshots, func(i, j int) bool {
+        a, b := (*snapshots)[i], (*snapshots)[j]
+        return a.Time.Before(b.Time) || (a.Time.Equal(b.Time) && a.Name < b.Name)
+    })
+    return nil
+}
+
+/**
+* Returns the files of a snapshot, including the tombstones of deleted files.
+*/
+func (m *MetaStore) GetSnapshot(name string, files *map[string]FileMetaData) error {
+    snapshot, ok := m.NamespaceSnapshots[name]
+    if !ok {
+        return errors.New("Snapshot not found: " + name)
+    }
+    *files = snapshot.Files
+    return nil
+}
+
+/**
+* Check that a snapshot may be created, so persistent stores can log it before creating it.
+*/
+func (m *MetaStore) checkSnapshot(name string) error {
+    if name == "" || strings.ContainsAny(name, "\n\x00") {
+        return errors.New("Invalid snapshot name: " + strconv.Quote(name))
+    }
+    if _, ok := m.NamespaceSnapshots[name]; ok {
+        return errors.New("Snapshot already exists: " + name)
+    }
+    return nil
+}
+
+func (m *MetaStore) createSnapshot(name string, snapshotTime time.Time) {
+    if m.NamespaceSnapshots == nil {
+        m.NamespaceSnapshots = make(map[string]NamespaceSnapshot)
+    }
+    // Hash lists are never modified in place, sharing them is safe
+    files := make(map[string]FileMetaData, len(m.FileMetaMap))
+    for fileName, fileMetaData := range m.FileMetaMap {
+        files[fileName] = fileMetaData
+    }
+    m.NamespaceSnapshots[name] = NamespaceSnapshot{Name: name, Time: snapshotTime, Files: files}
+}
+
+/**
+* Removes the entries of files deleted before cutoff, together with their history. Returns
+* the number of removed files.
+*/
+func (m *MetaStore) PurgeTombstones(cutoff time.Time) (int, error) {
+    return m.purgeTombstones(cutoff), nil
+}
+
+/**
+* Files deleted before cutoff. A file deleted before deletion times were recorded counts as
+* expired, clients that missed its deletion are told by GetChangesSince.
+*/
+func (m *MetaStore) expiredTombstones(cutoff time.Time) []string {
+    var expired []string
+    for fileName, fileMetaData := range m.FileMetaMap {
+        if !isTombstone(fileMetaData) {
+            continue
+        }
+        history := m.fileHistory(fileName)
+        if deleted := history[len(history) - 1].Time; deleted.Before(cutoff) {
+            expired = append(expired, fileName)
+        }
+    }
+    sort.Strings(expired)
+    return expired
+}
+
+func (m *MetaStore) purgeTombstones(cutoff time.Time) int {
+    expired := m.expiredTombstones(cutoff)
+    if len(expired) == 0 {
+        return 0
+    }
+    // Every file needs a sequence number to move PurgedSequence past it
+    m.sortedChanges()
+    for _, fileName := range expired {
+        if sequence := m.FileSequence[fileName]; sequence > m.PurgedSequence {
+            m.PurgedSequence = sequence
+        }
+        delete(m.FileMetaMap, fileName)
+        delete(m.FileSequence, fileName)
+        delete(m.History, fileName)
+    }
+    m.changeIndexValid = false
+    m.changeIndex = nil
+    return len(expired)
+}
+
+/**
+* A file stored before histories were kept only has its current version.
+*/
+func (m *MetaStore) fileHistory(fileName string) []FileVersion {
+    if history := m.History[fileName]; len(history) > 0 {
+        return history
+    }
+    if current, ok := m.FileMetaMap[fileName]; ok {
+        return []FileVersion{{FileMetaData: current}}
+    }
+    return nil
+}
+
+/**
+* Store a file and record the change and the new version in the file's history.
+*/
+func (m *MetaStore) setFile(fileMetaData FileMetaData, updateTime time.Time) {
+    if m.FileSequence == nil {
+        m.FileSequence = make(map[string]int)
+    }
+    if m.History == nil {
+        m.History = make(map[string][]FileVersion)
+    }
+    history := append(m.fileHistory(fileMetaData.Filename), FileVersion{FileMetaData: fileMetaData, Time: updateTime})
+    if len(history) > MaxFileVersions {
+        history = append([]FileVersion(nil), history[len(history) - MaxFileVersions:]...)
+    }
+    m.History[fileMetaData.Filename] = history
+    m.FileMetaMap[fileMetaData.Filename] = fileMetaData
+    m.Sequence++
+    m.FileSequence[fileMetaData.Filename] = m.Sequence
+    if m.changeIndexValid {
+        m.changeIndex = append(m.changeIndex, fileChange{Sequence: m.Sequence, Filename: fileMetaData.Filename})
+        if len(m.changeIndex) > 2 * len(m.FileSequence) + DefaultChangesPageSize {
+            // Mostly stale entries, rebuild on the next read
+            m.changeIndexValid = false
+            m.changeIndex = nil
+        }
+    }
+    if m.changed != nil {
+        close(m.changed)
+        m.changed = nil
+    }
+}
+
+/**
+* Returns a channel that is closed by the next change. Must be called under the same
+* lock as the changes.
+*/
+func (m *MetaStore) ChangeSignal() <-chan struct{} {
+    if m.changed == nil {
+        m.changed = make(chan struct{})
+    }
+    return m.changed
+}
+
+/**
+* The change index, sorted by sequence number. Files without a sequence number, e.g.
+* from a snapshot of an older version, are given one first.
+*/
+func (m *MetaStore) sortedChanges() []fileChange {
+    if m.changeIndexValid {
+        return m.changeIndex
+    }
+    if m.FileSequence == nil {
+        m.FileSequence = make(map[string]int)
+    }
+    var unsequenced []string
+    for fileName := range m.FileMetaMap {
+        if _, ok := m.FileSequence[fileName]; !ok {
+            unsequenced = append(unsequenced, fileName)
+        }
+    }
+    sort.Strings(unsequenced)
+    for _, fileName := range unsequenced {
+        m.Sequence++
+        m.FileSequence[fileName] = m.Sequence
+    }
+
+    m.changeIndex = make([]fileChange, 0, len(m.FileSequence))
+    for fileName, sequence := range m.FileSequence {
+        m.changeIndex = append(m.changeIndex, fileChange{Sequence: sequence, Filename: fileName})
+    }
+    sort.Slice(m.changeIndex, func(i, j int) bool {
+        return m.changeIndex[i].Sequence < m.changeIndex[j].Sequence
+    })
+    m.changeIndexValid = true
+    return m.changeIndex
+}
+
+/**
+* Check that fileMetaData may replace the current entry without modifying anything,
+* so persistent stores can log an update before applying it.
+*/
+func (m *MetaStore) checkUpdate(fileMetaData *FileMetaData) error {
     // File may not exist in the metaStore map
-    if _, ok := m.FileMetaMap[filename]; ok {
-        if fileMetaData.Version - m.FileMetaMap[filename].Version == 1 {
-            m.FileMetaMap[filename] = *fileMetaData
-            *latestVersion = fileMetaData.Version       // Update the lastest version as the new version.
-            return nil
-        } else {
-            return errors.New("New version number is NOT one greater than current version number")
-        }
-    } else {
-        m.FileMetaMap[filename] = *fileMetaData
-        *latestVersion = fileMetaData.Version
+    if current, ok := m.FileMetaMap[fileMetaData.Filename]; ok {
+        if fileMetaData.Version - current.Version != 1 {
+            // New version number is NOT one greater than current version number
+            return &VersionConflictError{
+                Filename:      current.Filename,
+                Version:       current.Version,
+                BlockHashList: current.BlockHashList,
+            }
+        }
+    }
+    return nil
+}
+
+/**
+* Validate and apply a command, as the replicated state machine of a Raft cluster does.
+* Every replica applies the same commands in the same order, so they all accept or reject
+* each command alike. Returns the latest version of the file.
+*/
+func (m *MetaStore) applyCommand(entry MetaLogEntry) (int, error) {
+    switch entry.Op {
+    case OpNoop:
+        return 0, nil
+    case OpUpdateFile:
+        var latestVersion int
+        err := m.updateFile(&entry.FileMetaData, &latestVersion, entry.Time)
+        return latestVersion, err
+    case OpRenameFile:
+        if err := m.checkRename(entry.Source, entry.FileMetaData); err != nil {
+            return 0, err
+        }
+        m.renameFile(entry.Source, entry.FileMetaData, entry.Time)
+        return entry.FileMetaData.Version, nil
+    case OpCommitFiles:
+        if err := m.checkCommit(entry.Files, entry.Renames); err != nil {
+            return 0, err
+        }
+        m.commitFiles(entry.Files, entry.Renames, entry.Time)
+        return 0, nil
+    case OpCreateSnapshot:
+        if err := m.checkSnapshot(entry.SnapshotName); err != nil {
+            return 0, err
+        }
+        m.createSnapshot(entry.SnapshotName, entry.Time)
+        return 0, nil
+    case OpPurgeTombstones:
+        return m.purgeTombstones(entry.Time), nil
+    default:
+        return 0, errors.New("Unknown log entry op: " + entry.Op)
+    }
+}
+
+/**
+* Re-apply an update that has already been accepted, e.g. when replaying a log.
+* Entries are applied without the version check so that replaying a log on top of
+* a snapshot which already contains some of its entries is harmless.
+*/
+func (m *MetaStore) applyLogEntry(entry MetaLogEntry) error {
+    switch entry.Op {
+    case OpNoop:
+        return nil
+    case OpUpdateFile:
+        m.setFile(entry.FileMetaData, entry.Time)
+        return nil
+    case OpRenameFile:
+        m.renameFile(entry.Source, entry.FileMetaData, entry.Time)
+        return nil
+    case OpCommitFiles:
+        m.commitFiles(entry.Files, entry.Renames, entry.Time)
         return nil
+    case OpCreateSnapshot:
+        if _, ok := m.NamespaceSnapshots[entry.SnapshotName]; !ok {
+            m.createSnapshot(entry.SnapshotName, entry.Time)
+        }
+        return nil
+    case OpPurgeTombstones:
+        m.purgeTombstones(entry.Time)
+        return nil
+    default:
+        return errors.New("Unknown log entry op: " + entry.Op)
+    }
+}
+
+/**
+* Returns the set of block hashes referenced by any file, any version in its history or any
+* snapshot, the roots of garbage collection.
+*/
+func (m *MetaStore) ReferencedBlocks() (map[string]bool, error) {
+    live := make(map[string]bool)
+    addBlocks := func(fileMetaData FileMetaData) {
+        if isTombstone(fileMetaData) || isDirectory(fileMetaData) {
+            return
+        }
+        for _, blockHash := range fileMetaData.BlockHashList {
+            live[blockHash] = true
+        }
+    }
+    for fileName := range m.FileMetaMap {
+        for _, version := range m.fileHistory(fileName) {
+            addBlocks(version.FileMetaData)
+        }
+    }
+    for _, snapshot := range m.NamespaceSnapshots {
+        for _, fileMetaData := range snapshot.Files {
+            addBlocks(fileMetaData)
+        }
     }
+    return live, nil
 }
 
 var _ MetaStoreInterface = new(MetaStore)
+var _ ChangeNotifier = new(MetaStore)
+var _ BlockReferencer = new(MetaStore)
+var _ TombstonePurger = new(MetaStore)
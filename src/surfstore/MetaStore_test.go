@@ -0,0 +1,57 @@
+package surfstore
+
+import (
+    "testing"
+)
+
+func TestCommitAppliesRenamesWithFiles(t *testing.T) {
+    m := NewMetaStore()
+    var latestVersion int
+    for _, fileName := range []string{"a", "b"} {
+        if err := m.UpdateFile(&FileMetaData{Filename: fileName, Version: 1, BlockHashList: []string{fileName}}, &latestVersion); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // The rename is fine, the update is not, nothing changes
+    var latestVersions []int
+    err := m.CommitFiles(CommitArgs{
+        Files:   []FileMetaData{{Filename: "b", Version: 3, BlockHashList: []string{"b2"}}},
+        Renames: []RenameArgs{{Source: "a", SourceVersion: 1, Target: "c"}},
+    }, &latestVersions)
+    if _, ok := err.(*VersionConflictError); !ok {
+        t.Fatalf("Commit returned %v, want a version conflict", err)
+    }
+    if _, ok := m.FileMetaMap["c"]; ok || isTombstone(m.FileMetaMap["a"]) {
+        t.Fatal("The rename of a failed commit was applied")
+    }
+
+    // The update is fine, the rename is not, nothing changes
+    err = m.CommitFiles(CommitArgs{
+        Files:   []FileMetaData{{Filename: "b", Version: 2, BlockHashList: []string{"b2"}}},
+        Renames: []RenameArgs{{Source: "a", SourceVersion: 1, Target: "b"}},
+    }, &latestVersions)
+    if err == nil {
+        t.Fatal("A commit touching b twice was accepted")
+    }
+    if m.FileMetaMap["b"].Version != 1 {
+        t.Fatal("The update of a failed commit was applied")
+    }
+
+    err = m.CommitFiles(CommitArgs{
+        Files:   []FileMetaData{{Filename: "b", Version: 2, BlockHashList: []string{"b2"}}},
+        Renames: []RenameArgs{{Source: "a", SourceVersion: 1, Target: "c"}},
+    }, &latestVersions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(latestVersions) != 2 || latestVersions[0] != 2 || latestVersions[1] != 1 {
+        t.Fatalf("Latest versions %v, want [2 1]", latestVersions)
+    }
+    if !isTombstone(m.FileMetaMap["a"]) || m.FileMetaMap["a"].Version != 2 {
+        t.Fatalf("Old path is %v", m.FileMetaMap["a"])
+    }
+    if c := m.FileMetaMap["c"]; c.Version != 1 || !sameHashList(c.BlockHashList, []string{"a"}) {
+        t.Fatalf("New path is %v", c)
+    }
+}
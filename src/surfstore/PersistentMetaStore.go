@@ -0,0 +1,301 @@
+package surfstore
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const (
+    metaLogFileName      = "meta.log"
+    metaSnapshotFileName = "meta.snapshot"
+
+    // Number of log entries after which the log is compacted into a snapshot.
+    DefaultSnapshotInterval = 1000
+)
+
+/**
+* PersistentMetaStore is a MetaStore that survives restarts.
+* Every accepted update is appended to a write-ahead log and fsynced before it is applied,
+* and every SnapshotInterval entries the whole map is written to a snapshot and the log is reset.
+* On startup the snapshot is loaded and the log is replayed on top of it. Log entries are
+* numbered, and the snapshot records the last one it contains, so entries that are already in
+* the snapshot are skipped.
+*
+* Log records are framed as [4 byte length][4 byte CRC-32][JSON entry], so a record torn
+* by a crash is detected and dropped on replay.
+*/
+type PersistentMetaStore struct {
+    MetaStore
+    DataDir          string
+    SnapshotInterval int
+
+    log      *recordLog
+    logCount int
+    // Number of the last entry appended to the log, it keeps growing across resets
+    logIndex int
+}
+
+/**
+* The snapshot file, the MetaStore and the number of the last log entry it contains.
+*/
+type metaSnapshot struct {
+    *MetaStore
+    LogIndex int
+}
+
+/**
+* Open (or create) a persistent MetaStore in dataDir and recover its state.
+*/
+func NewPersistentMetaStore(dataDir string, snapshotInterval int) (*PersistentMetaStore, error) {
+    if err := os.MkdirAll(dataDir, 0755); err != nil {
+        return nil, err
+    }
+    if snapshotInterval <= 0 {
+        snapshotInterval = DefaultSnapshotInterval
+    }
+    m := &PersistentMetaStore{
+        MetaStore:        *NewMetaStore(),
+        DataDir:          dataDir,
+        SnapshotInterval: snapshotInterval,
+    }
+    loaded, err := m.loadSnapshot()
+    if err != nil {
+        return nil, err
+    }
+    if err = m.replayLog(); err != nil {
+        return nil, err
+    }
+    if !loaded {
+        // Keep the new epoch across restarts
+        if err = m.Snapshot(); err != nil {
+            return nil, err
+        }
+    }
+    return m, nil
+}
+
+/**
+* Updates the FileInfo values associated with a file, logging the update before applying it.
+*/
+func (m *PersistentMetaStore) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) (err error) {
+    if err := m.checkUpdate(fileMetaData); err != nil {
+        // Let the MetaStore fill in the version of the conflict
+        return m.MetaStore.UpdateFile(fileMetaData, latestVersion)
+    }
+    entry := MetaLogEntry{Op: OpUpdateFile, FileMetaData: *fileMetaData, Time: time.Now()}
+    if err := m.appendLog(entry); err != nil {
+        return err
+    }
+    *latestVersion, err = m.MetaStore.applyCommand(entry)
+    m.maybeSnapshot()
+    return err
+}
+
+/**
+* Commits several updates and renames as one log entry, so a crash never leaves only some of them.
+*/
+func (m *PersistentMetaStore) CommitFiles(args CommitArgs, latestVersions *[]int) error {
+    renames, err := m.renamedFilesOf(args.Renames)
+    if err != nil {
+        return err
+    }
+    if err := m.checkCommit(args.Files, renames); err != nil {
+        return err
+    }
+    entry := MetaLogEntry{Op: OpCommitFiles, Files: args.Files, Renames: renames, Time: time.Now()}
+    if err := m.appendLog(entry); err != nil {
+        return err
+    }
+    _, err = m.MetaStore.applyCommand(entry)
+    if err == nil {
+        *latestVersions = committedVersions(args.Files, renames)
+    }
+    m.maybeSnapshot()
+    return err
+}
+
+/**
+* Restores an old version of a file, logged like any other update.
+*/
+func (m *PersistentMetaStore) RestoreFile(args RestoreArgs, latestVersion *int) error {
+    restored, err := m.restoredFile(args)
+    if err != nil {
+        return err
+    }
+    return m.UpdateFile(&restored, latestVersion)
+}
+
+/**
+* Renames a file, logged as one entry so a crash never leaves only half of it.
+*/
+func (m *PersistentMetaStore) RenameFile(args RenameArgs, latestVersion *int) (err error) {
+    source, target, err := m.renamedFiles(args)
+    if err != nil {
+        return err
+    }
+    entry := MetaLogEntry{Op: OpRenameFile, FileMetaData: target, Source: source, Time: time.Now()}
+    if err := m.appendLog(entry); err != nil {
+        return err
+    }
+    *latestVersion, err = m.MetaStore.applyCommand(entry)
+    m.maybeSnapshot()
+    return err
+}
+
+/**
+* Creates a namespace snapshot, logged like any other update.
+*/
+func (m *PersistentMetaStore) CreateSnapshot(name string, succ *bool) error {
+    if err := m.checkSnapshot(name); err != nil {
+        return err
+    }
+    entry := MetaLogEntry{Op: OpCreateSnapshot, SnapshotName: name, Time: time.Now()}
+    if err := m.appendLog(entry); err != nil {
+        return err
+    }
+    _, err := m.MetaStore.applyCommand(entry)
+    *succ = err == nil
+    m.maybeSnapshot()
+    return err
+}
+
+/**
+* Purges expired tombstones, logged like any other update if there are any.
+*/
+func (m *PersistentMetaStore) PurgeTombstones(cutoff time.Time) (int, error) {
+    if len(m.expiredTombstones(cutoff)) == 0 {
+        return 0, nil
+    }
+    entry := MetaLogEntry{Op: OpPurgeTombstones, Time: cutoff}
+    if err := m.appendLog(entry); err != nil {
+        return 0, err
+    }
+    removed, err := m.MetaStore.applyCommand(entry)
+    m.maybeSnapshot()
+    return removed, err
+}
+
+/**
+* Flush a final snapshot and close the log.
+*/
+func (m *PersistentMetaStore) Close() error {
+    if err := m.Snapshot(); err != nil {
+        return err
+    }
+    return m.log.Close()
+}
+
+/**
+* Write the current state to a snapshot and truncate the log.
+* The old snapshot stays valid until the new one is complete. A crash between writing the
+* snapshot and the truncate leaves entries in the log that are already in the snapshot, they
+* are numbered up to its LogIndex and skipped on replay. Applying them again would add their
+* versions to the history a second time.
+*/
+func (m *PersistentMetaStore) Snapshot() error {
+    data, err := json.Marshal(metaSnapshot{MetaStore: &m.MetaStore, LogIndex: m.logIndex})
+    if err != nil {
+        return err
+    }
+    if err = writeFileAtomic(m.DataDir, metaSnapshotFileName, data); err != nil {
+        return err
+    }
+    if err = m.log.reset(); err != nil {
+        return err
+    }
+    m.logCount = 0
+    return nil
+}
+
+/**
+* Append an entry to the log and fsync it.
+*/
+func (m *PersistentMetaStore) appendLog(entry MetaLogEntry) error {
+    entry.LogIndex = m.logIndex + 1
+    payload, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    if err = m.log.append(payload); err != nil {
+        return err
+    }
+    m.logIndex = entry.LogIndex
+    m.logCount++
+    return nil
+}
+
+/**
+* Compact the log into a snapshot once it grows too long.
+* Must only be called after the logged entries have been applied.
+*/
+func (m *PersistentMetaStore) maybeSnapshot() {
+    if m.logCount < m.SnapshotInterval {
+        return
+    }
+    // The entries are already durable in the log, a failed snapshot only delays compaction.
+    if err := m.Snapshot(); err != nil {
+        logError("Snapshot Error: ", err)
+    }
+}
+
+/**
+* Load the last snapshot, if any. Reports whether there was one with a change history.
+*/
+func (m *PersistentMetaStore) loadSnapshot() (bool, error) {
+    data, err := ioutil.ReadFile(filepath.Join(m.DataDir, metaSnapshotFileName))
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    epoch := m.Epoch
+    m.Epoch = ""
+    snapshot := metaSnapshot{MetaStore: &m.MetaStore}
+    if err = json.Unmarshal(data, &snapshot); err != nil {
+        return false, err
+    }
+    m.logIndex = snapshot.LogIndex
+    if m.FileMetaMap == nil {
+        m.FileMetaMap = map[string]FileMetaData{}
+    }
+    m.changeIndexValid = false
+    if m.Epoch == "" {
+        // A snapshot from before the change history, start one and save it
+        m.Epoch = epoch
+        return false, nil
+    }
+    return true, nil
+}
+
+/**
+* Replay the log on top of the snapshot and leave the log open for appending.
+* Entries the snapshot already contains are skipped. Entries of logs written before they
+* were numbered have no LogIndex and are always applied.
+*/
+func (m *PersistentMetaStore) replayLog() error {
+    metaLog, count, err := openRecordLog(filepath.Join(m.DataDir, metaLogFileName), func(payload []byte) error {
+        var entry MetaLogEntry
+        if err := json.Unmarshal(payload, &entry); err != nil {
+            return err
+        }
+        if entry.LogIndex > 0 && entry.LogIndex <= m.logIndex {
+            return nil
+        }
+        if entry.LogIndex > m.logIndex {
+            m.logIndex = entry.LogIndex
+        }
+        return m.applyLogEntry(entry)
+    })
+    if err != nil {
+        return err
+    }
+    m.log = metaLog
+    m.logCount = count
+    return nil
+}
+
+var _ MetaStoreInterface = new(PersistentMetaStore)
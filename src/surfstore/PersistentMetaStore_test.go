@@ -0,0 +1,61 @@
+package surfstore
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+func TestReplaySkipsEntriesInSnapshot(t *testing.T) {
+    dataDir := t.TempDir()
+    m, err := NewPersistentMetaStore(dataDir, DefaultSnapshotInterval)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var latestVersion int
+    for version := 1; version <= 3; version++ {
+        if err := m.UpdateFile(&FileMetaData{Filename: "f", Version: version, BlockHashList: []string{"h"}}, &latestVersion); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // A crash after the snapshot was written, before the log was truncated
+    logPath := filepath.Join(dataDir, metaLogFileName)
+    untruncated, err := ioutil.ReadFile(logPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := m.Snapshot(); err != nil {
+        t.Fatal(err)
+    }
+    sequence, history := m.Sequence, len(m.History["f"])
+    m.log.Close()
+    if err := ioutil.WriteFile(logPath, untruncated, 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    recovered, err := NewPersistentMetaStore(dataDir, DefaultSnapshotInterval)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if recovered.Sequence != sequence {
+        t.Fatalf("Sequence %d after recovery, want %d", recovered.Sequence, sequence)
+    }
+    if len(recovered.History["f"]) != history {
+        t.Fatalf("%d versions in the history after recovery, want %d", len(recovered.History["f"]), history)
+    }
+
+    // Entries after the snapshot are still replayed
+    if err := recovered.UpdateFile(&FileMetaData{Filename: "f", Version: 4, BlockHashList: []string{"h"}}, &latestVersion); err != nil {
+        t.Fatal(err)
+    }
+    recovered.log.Close()
+    again, err := NewPersistentMetaStore(dataDir, DefaultSnapshotInterval)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer again.Close()
+    if again.FileMetaMap["f"].Version != 4 || len(again.History["f"]) != history + 1 {
+        t.Fatalf("Version %d with %d versions in the history, want 4 with %d", again.FileMetaMap["f"].Version, len(again.History["f"]), history + 1)
+    }
+}
@@ -0,0 +1,758 @@
+package surfstore
+
+import (
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const (
+    raftFollower = iota
+    raftCandidate
+    raftLeader
+)
+
+const (
+    DefaultRaftElectionTimeout   = 300 * time.Millisecond
+    DefaultRaftHeartbeatInterval = 50 * time.Millisecond
+    // How long UpdateFile waits for its entry to commit
+    DefaultRaftProposalTimeout = 5 * time.Second
+
+    raftStateFileName = "raft.state"
+    raftLogFileName   = "raft.log"
+)
+
+var errRaftStopped = errors.New("Raft node is stopped")
+
+/**
+* Configuration of one node of a Raft cluster.
+* Node IDs are the addresses the nodes serve RPCs on.
+*/
+type RaftConfig struct {
+    ID    string
+    // IDs of all nodes in the cluster, including this one
+    Peers []string
+
+    // A follower that hears nothing from a leader for a random time between
+    // ElectionTimeout and twice that starts an election
+    ElectionTimeout   time.Duration
+    HeartbeatInterval time.Duration
+    ProposalTimeout   time.Duration
+
+    // Directory for the persistent term, vote and log, empty keeps them in memory only
+    DataDir string
+}
+
+type RaftLogEntry struct {
+    Term  int
+    Entry MetaLogEntry
+}
+
+type RequestVoteArgs struct {
+    Term         int
+    CandidateID  string
+    LastLogIndex int
+    LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+    Term        int
+    VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+    Term         int
+    LeaderID     string
+    PrevLogIndex int
+    PrevLogTerm  int
+    Entries      []RaftLogEntry
+    LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+    Term    int
+    Success bool
+    // On failure, the index the leader should retry from
+    ConflictIndex int
+}
+
+/**
+* The messages Raft nodes exchange. Implemented over net/rpc for real clusters,
+* and by LocalRaftNetwork for in-process clusters.
+*/
+type RaftTransport interface {
+    RequestVote(peer string, args *RequestVoteArgs, reply *RequestVoteReply) error
+    AppendEntries(peer string, args *AppendEntriesArgs, reply *AppendEntriesReply) error
+}
+
+type raftResult struct {
+    term    int
+    version int
+    err     error
+}
+
+/**
+* RaftNode replicates the log of MetaStore commands with the Raft consensus algorithm
+* and applies committed commands to its MetaStore, in log order.
+* Only the leader accepts commands, see Propose.
+*
+* The log is never compacted, there are no Raft snapshots. It holds every command since the
+* cluster was created and a restarted node applies all of them again.
+*/
+type RaftNode struct {
+    config    RaftConfig
+    transport RaftTransport
+    metaStore *MetaStore
+
+    mutex       sync.Mutex
+    state       int
+    currentTerm int
+    votedFor    string
+    // log[0] is a sentinel, so entry i is log[i]
+    log         []RaftLogEntry
+    commitIndex int
+    lastApplied int
+    leaderID    string
+
+    // Leader state
+    nextIndex  map[string]int
+    matchIndex map[string]int
+    inFlight   map[string]bool
+    lastAck    map[string]time.Time
+    // Index of the first entry of the current term, reads wait until it is applied
+    termStart     int
+    lastHeartbeat time.Time
+
+    electionDeadline time.Time
+    waiters          map[int]chan raftResult
+
+    stateFile string
+    logFile   *recordLog
+
+    applyCh chan struct{}
+    stopCh  chan struct{}
+    stopped bool
+}
+
+/**
+* Create a Raft node that applies committed commands to metaStore.
+* If config.DataDir is set, the term, vote and log are restored from it.
+* The node does nothing until Start is called.
+*/
+func NewRaftNode(config RaftConfig, transport RaftTransport, metaStore *MetaStore) (*RaftNode, error) {
+    if config.ElectionTimeout <= 0 {
+        config.ElectionTimeout = DefaultRaftElectionTimeout
+    }
+    if config.HeartbeatInterval <= 0 {
+        config.HeartbeatInterval = DefaultRaftHeartbeatInterval
+    }
+    if config.ProposalTimeout <= 0 {
+        config.ProposalTimeout = DefaultRaftProposalTimeout
+    }
+    member := false
+    for _, peer := range config.Peers {
+        member = member || peer == config.ID
+    }
+    if !member {
+        return nil, errors.New("Raft node " + config.ID + " is not one of its peers")
+    }
+    r := &RaftNode{
+        config:    config,
+        transport: transport,
+        metaStore: metaStore,
+        log:       []RaftLogEntry{{}},
+        waiters:   make(map[int]chan raftResult),
+        applyCh:   make(chan struct{}, 1),
+        stopCh:    make(chan struct{}),
+    }
+    if config.DataDir != "" {
+        if err := r.restore(); err != nil {
+            return nil, err
+        }
+    }
+    return r, nil
+}
+
+/**
+* Start the election timer and the applier.
+*/
+func (r *RaftNode) Start() {
+    r.mutex.Lock()
+    r.resetElectionDeadline()
+    r.mutex.Unlock()
+    go r.run()
+    go r.applier()
+}
+
+/**
+* Stop the node. Pending proposals fail.
+*/
+func (r *RaftNode) Stop() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.stopped {
+        return
+    }
+    r.stopped = true
+    close(r.stopCh)
+    for index, waiter := range r.waiters {
+        waiter <- raftResult{err: errRaftStopped}
+        delete(r.waiters, index)
+    }
+    if r.logFile != nil {
+        r.logFile.Close()
+    }
+}
+
+/**
+* Reports the current term and whether this node believes it is the leader.
+*/
+func (r *RaftNode) State() (int, bool) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.currentTerm, r.state == raftLeader
+}
+
+/**
+* The ID of the node this node believes is leader, empty if unknown.
+*/
+func (r *RaftNode) Leader() string {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.leaderID
+}
+
+/**
+* Append a command to the log and wait until it is committed and applied.
+* Returns the result of applying it, or a *NotLeaderError if this node is not the leader.
+*/
+func (r *RaftNode) Propose(entry MetaLogEntry) (int, error) {
+    r.mutex.Lock()
+    if r.stopped {
+        r.mutex.Unlock()
+        return 0, errRaftStopped
+    }
+    if r.state != raftLeader {
+        err := &NotLeaderError{Leader: r.leaderID}
+        r.mutex.Unlock()
+        return 0, err
+    }
+    term := r.currentTerm
+    if err := r.appendLocal([]RaftLogEntry{{Term: term, Entry: entry}}); err != nil {
+        r.mutex.Unlock()
+        return 0, err
+    }
+    index := r.lastIndex()
+    waiter := make(chan raftResult, 1)
+    r.waiters[index] = waiter
+    // Without peers the leader alone is the majority
+    r.advanceCommitIndex()
+    r.mutex.Unlock()
+
+    r.broadcastAppendEntries()
+
+    timer := time.NewTimer(r.config.ProposalTimeout)
+    defer timer.Stop()
+    select {
+    case result := <-waiter:
+        if result.term == 0 {
+            // Stopped, or the entry was dropped
+            return 0, result.err
+        }
+        if result.term != term {
+            // Another leader overwrote the entry
+            return 0, &NotLeaderError{Leader: r.Leader()}
+        }
+        return result.version, result.err
+    case <-timer.C:
+        r.mutex.Lock()
+        delete(r.waiters, index)
+        r.mutex.Unlock()
+        return 0, errors.New("Timed out waiting for the update to commit")
+    }
+}
+
+/**
+* Run fn on the MetaStore once this node has confirmed it is the leader and has applied
+* everything committed before its term, so fn observes every acknowledged update.
+* Leadership is confirmed by acknowledgements from a majority within one election timeout.
+*/
+func (r *RaftNode) Read(fn func(metaStore *MetaStore) error) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.stopped {
+        return errRaftStopped
+    }
+    if r.state != raftLeader {
+        return &NotLeaderError{Leader: r.leaderID}
+    }
+    acks := 1
+    for _, peer := range r.config.Peers {
+        if peer != r.config.ID && time.Since(r.lastAck[peer]) < r.config.ElectionTimeout {
+            acks++
+        }
+    }
+    if acks <= len(r.config.Peers) / 2 || r.lastApplied < r.termStart {
+        // Not ready yet, the client retries
+        return &NotLeaderError{Leader: r.config.ID}
+    }
+    return fn(r.metaStore)
+}
+
+/**
+* RequestVote RPC handler.
+*/
+func (r *RaftNode) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.stopped {
+        return errRaftStopped
+    }
+    if args.Term > r.currentTerm {
+        r.becomeFollower(args.Term)
+    }
+    reply.Term = r.currentTerm
+
+    lastTerm := r.log[r.lastIndex()].Term
+    upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= r.lastIndex())
+    if args.Term == r.currentTerm && (r.votedFor == "" || r.votedFor == args.CandidateID) && upToDate {
+        r.votedFor = args.CandidateID
+        if err := r.persistState(); err != nil {
+            return err
+        }
+        reply.VoteGranted = true
+        r.resetElectionDeadline()
+    }
+    return nil
+}
+
+/**
+* AppendEntries RPC handler, also used as heartbeat.
+*/
+func (r *RaftNode) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.stopped {
+        return errRaftStopped
+    }
+    reply.Term = r.currentTerm
+    if args.Term < r.currentTerm {
+        return nil
+    }
+    if args.Term > r.currentTerm || r.state != raftFollower {
+        r.becomeFollower(args.Term)
+        reply.Term = r.currentTerm
+    }
+    r.leaderID = args.LeaderID
+    r.resetElectionDeadline()
+
+    if args.PrevLogIndex > r.lastIndex() {
+        reply.ConflictIndex = r.lastIndex() + 1
+        return nil
+    }
+    if r.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+        // Skip back over the whole conflicting term at once
+        conflictTerm := r.log[args.PrevLogIndex].Term
+        index := args.PrevLogIndex
+        for index > 1 && r.log[index - 1].Term == conflictTerm {
+            index--
+        }
+        reply.ConflictIndex = index
+        return nil
+    }
+
+    for i, entry := range args.Entries {
+        index := args.PrevLogIndex + 1 + i
+        if index <= r.lastIndex() {
+            if r.log[index].Term == entry.Term {
+                continue
+            }
+            if err := r.truncateLocal(index); err != nil {
+                return err
+            }
+        }
+        if err := r.appendLocal(args.Entries[i:]); err != nil {
+            return err
+        }
+        break
+    }
+
+    if args.LeaderCommit > r.commitIndex {
+        lastNew := args.PrevLogIndex + len(args.Entries)
+        r.commitIndex = args.LeaderCommit
+        if lastNew < r.commitIndex {
+            r.commitIndex = lastNew
+        }
+        r.signalApply()
+    }
+    reply.Success = true
+    return nil
+}
+
+/**
+* Drive elections and heartbeats until stopped.
+*/
+func (r *RaftNode) run() {
+    ticker := time.NewTicker(r.config.HeartbeatInterval / 5)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-r.stopCh:
+            return
+        case <-ticker.C:
+        }
+
+        r.mutex.Lock()
+        isLeader := r.state == raftLeader
+        heartbeatDue := time.Since(r.lastHeartbeat) >= r.config.HeartbeatInterval
+        electionDue := time.Now().After(r.electionDeadline)
+        r.mutex.Unlock()
+
+        if isLeader && heartbeatDue {
+            r.broadcastAppendEntries()
+        } else if !isLeader && electionDue {
+            r.startElection()
+        }
+    }
+}
+
+func (r *RaftNode) startElection() {
+    r.mutex.Lock()
+    r.state = raftCandidate
+    r.currentTerm++
+    r.votedFor = r.config.ID
+    r.leaderID = ""
+    r.resetElectionDeadline()
+    if err := r.persistState(); err != nil {
+        logError("Raft persist Error: ", err)
+        r.mutex.Unlock()
+        return
+    }
+    term := r.currentTerm
+    args := RequestVoteArgs{
+        Term:         term,
+        CandidateID:  r.config.ID,
+        LastLogIndex: r.lastIndex(),
+        LastLogTerm:  r.log[r.lastIndex()].Term,
+    }
+    r.mutex.Unlock()
+    logDebug("Raft", r.config.ID, "starts election for term", term)
+
+    votes := 1
+    if votes > len(r.config.Peers) / 2 {
+        r.mutex.Lock()
+        r.becomeLeader()
+        r.mutex.Unlock()
+        return
+    }
+    for _, peer := range r.config.Peers {
+        if peer == r.config.ID {
+            continue
+        }
+        go func(peer string) {
+            var reply RequestVoteReply
+            if err := r.transport.RequestVote(peer, &args, &reply); err != nil {
+                return
+            }
+            r.mutex.Lock()
+            defer r.mutex.Unlock()
+            if reply.Term > r.currentTerm {
+                r.becomeFollower(reply.Term)
+                return
+            }
+            if r.state != raftCandidate || r.currentTerm != term || !reply.VoteGranted {
+                return
+            }
+            votes++
+            if votes > len(r.config.Peers) / 2 {
+                r.becomeLeader()
+            }
+        }(peer)
+    }
+}
+
+/**
+* Must be called with the lock held.
+*/
+func (r *RaftNode) becomeLeader() {
+    logInfo("Raft", r.config.ID, "is leader for term", r.currentTerm)
+    r.state = raftLeader
+    r.leaderID = r.config.ID
+    r.nextIndex = make(map[string]int)
+    r.matchIndex = make(map[string]int)
+    r.inFlight = make(map[string]bool)
+    r.lastAck = make(map[string]time.Time)
+    for _, peer := range r.config.Peers {
+        r.nextIndex[peer] = r.lastIndex() + 1
+    }
+    // Entries of earlier terms only commit together with one of the current term
+    if err := r.appendLocal([]RaftLogEntry{{Term: r.currentTerm, Entry: MetaLogEntry{Op: OpNoop}}}); err != nil {
+        logError("Raft persist Error: ", err)
+    }
+    r.termStart = r.lastIndex()
+    r.lastHeartbeat = time.Time{}
+    r.advanceCommitIndex()
+}
+
+/**
+* Must be called with the lock held.
+*/
+func (r *RaftNode) becomeFollower(term int) {
+    if term > r.currentTerm {
+        r.currentTerm = term
+        r.votedFor = ""
+        r.leaderID = ""
+        if err := r.persistState(); err != nil {
+            logError("Raft persist Error: ", err)
+        }
+    }
+    r.state = raftFollower
+}
+
+/**
+* Send new entries, or an empty heartbeat, to every follower.
+*/
+func (r *RaftNode) broadcastAppendEntries() {
+    r.mutex.Lock()
+    r.lastHeartbeat = time.Now()
+    r.mutex.Unlock()
+    for _, peer := range r.config.Peers {
+        if peer != r.config.ID {
+            go r.replicateTo(peer)
+        }
+    }
+}
+
+/**
+* Send one AppendEntries to peer and process the reply.
+*/
+func (r *RaftNode) replicateTo(peer string) {
+    r.mutex.Lock()
+    if r.state != raftLeader || r.inFlight[peer] {
+        r.mutex.Unlock()
+        return
+    }
+    r.inFlight[peer] = true
+    term := r.currentTerm
+    prevLogIndex := r.nextIndex[peer] - 1
+    if prevLogIndex > r.lastIndex() {
+        prevLogIndex = r.lastIndex()
+    }
+    args := AppendEntriesArgs{
+        Term:         term,
+        LeaderID:     r.config.ID,
+        PrevLogIndex: prevLogIndex,
+        PrevLogTerm:  r.log[prevLogIndex].Term,
+        Entries:      append([]RaftLogEntry(nil), r.log[prevLogIndex + 1:]...),
+        LeaderCommit: r.commitIndex,
+    }
+    inFlight := r.inFlight
+    r.mutex.Unlock()
+
+    sent := time.Now()
+    var reply AppendEntriesReply
+    err := r.transport.AppendEntries(peer, &args, &reply)
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    inFlight[peer] = false
+    if err != nil {
+        return
+    }
+    if reply.Term > r.currentTerm {
+        r.becomeFollower(reply.Term)
+        return
+    }
+    if r.state != raftLeader || r.currentTerm != term {
+        return
+    }
+    r.lastAck[peer] = sent
+    if reply.Success {
+        match := args.PrevLogIndex + len(args.Entries)
+        if match > r.matchIndex[peer] {
+            r.matchIndex[peer] = match
+        }
+        r.nextIndex[peer] = r.matchIndex[peer] + 1
+        r.advanceCommitIndex()
+        if r.nextIndex[peer] <= r.lastIndex() {
+            // More entries arrived in the meantime
+            go r.replicateTo(peer)
+        }
+    } else {
+        r.nextIndex[peer] = reply.ConflictIndex
+        if r.nextIndex[peer] < 1 {
+            r.nextIndex[peer] = 1
+        }
+        go r.replicateTo(peer)
+    }
+}
+
+/**
+* Commit the highest entry of the current term that a majority has stored.
+* Must be called with the lock held.
+*/
+func (r *RaftNode) advanceCommitIndex() {
+    for index := r.lastIndex(); index > r.commitIndex; index-- {
+        if r.log[index].Term != r.currentTerm {
+            break
+        }
+        count := 1
+        for _, peer := range r.config.Peers {
+            if peer != r.config.ID && r.matchIndex[peer] >= index {
+                count++
+            }
+        }
+        if count > len(r.config.Peers) / 2 {
+            r.commitIndex = index
+            r.signalApply()
+            return
+        }
+    }
+}
+
+/**
+* Apply committed entries to the MetaStore and hand the results to waiting proposals.
+*/
+func (r *RaftNode) applier() {
+    for {
+        select {
+        case <-r.stopCh:
+            return
+        case <-r.applyCh:
+        }
+
+        r.mutex.Lock()
+        for r.lastApplied < r.commitIndex {
+            r.lastApplied++
+            entry := r.log[r.lastApplied]
+            version, err := r.metaStore.applyCommand(entry.Entry)
+            if waiter, ok := r.waiters[r.lastApplied]; ok {
+                waiter <- raftResult{term: entry.Term, version: version, err: err}
+                delete(r.waiters, r.lastApplied)
+            }
+        }
+        r.mutex.Unlock()
+    }
+}
+
+func (r *RaftNode) signalApply() {
+    select {
+    case r.applyCh <- struct{}{}:
+    default:
+    }
+}
+
+func (r *RaftNode) lastIndex() int {
+    return len(r.log) - 1
+}
+
+func (r *RaftNode) resetElectionDeadline() {
+    timeout := r.config.ElectionTimeout + time.Duration(rand.Int63n(int64(r.config.ElectionTimeout)))
+    r.electionDeadline = time.Now().Add(timeout)
+}
+
+/**
+* Append entries to the log, durably if the node has a data directory.
+*/
+func (r *RaftNode) appendLocal(entries []RaftLogEntry) error {
+    if r.logFile != nil {
+        for _, entry := range entries {
+            payload, err := json.Marshal(entry)
+            if err != nil {
+                return err
+            }
+            if err = r.logFile.append(payload); err != nil {
+                return err
+            }
+        }
+    }
+    r.log = append(r.log, entries...)
+    return nil
+}
+
+/**
+* Drop the entries from index on, they conflict with the leader's log.
+* Proposals waiting on them will never see them applied.
+*/
+func (r *RaftNode) truncateLocal(index int) error {
+    r.log = r.log[:index]
+    for waiting, waiter := range r.waiters {
+        if waiting >= index {
+            waiter <- raftResult{err: &NotLeaderError{Leader: r.leaderID}}
+            delete(r.waiters, waiting)
+        }
+    }
+    if r.logFile == nil {
+        return nil
+    }
+    // Rare, so the log file is simply rewritten
+    if err := r.logFile.reset(); err != nil {
+        return err
+    }
+    for _, entry := range r.log[1:] {
+        payload, err := json.Marshal(entry)
+        if err != nil {
+            return err
+        }
+        if err = r.logFile.append(payload); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+type raftPersistentState struct {
+    CurrentTerm int
+    VotedFor    string
+}
+
+func (r *RaftNode) persistState() error {
+    if r.stateFile == "" {
+        return nil
+    }
+    data, err := json.Marshal(raftPersistentState{CurrentTerm: r.currentTerm, VotedFor: r.votedFor})
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(r.config.DataDir, raftStateFileName, data)
+}
+
+/**
+* Load the term, vote and log from the data directory.
+* The MetaStore is rebuilt by applying the log again as the commit index advances.
+*/
+func (r *RaftNode) restore() error {
+    if err := os.MkdirAll(r.config.DataDir, 0755); err != nil {
+        return err
+    }
+    r.stateFile = filepath.Join(r.config.DataDir, raftStateFileName)
+    data, err := ioutil.ReadFile(r.stateFile)
+    if err == nil {
+        var state raftPersistentState
+        if err = json.Unmarshal(data, &state); err != nil {
+            return err
+        }
+        r.currentTerm, r.votedFor = state.CurrentTerm, state.VotedFor
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+
+    logFile, _, err := openRecordLog(filepath.Join(r.config.DataDir, raftLogFileName), func(payload []byte) error {
+        var entry RaftLogEntry
+        if err := json.Unmarshal(payload, &entry); err != nil {
+            return err
+        }
+        r.log = append(r.log, entry)
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    r.logFile = logFile
+    return nil
+}
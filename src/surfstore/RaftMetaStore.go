@@ -0,0 +1,189 @@
+package surfstore
+
+import (
+    "sort"
+    "strings"
+    "time"
+)
+
+/**
+* RaftMetaStore is a MetaStore replicated by a Raft cluster.
+* Updates are proposed to the cluster and return once a majority has stored them,
+* reads are served by the leader. A follower answers with a *NotLeaderError naming
+* the leader, and RPCClient retries there.
+*/
+type RaftMetaStore struct {
+    Node *RaftNode
+}
+
+/**
+* Create the replicated store of one cluster node, on top of an empty MetaStore.
+*/
+func NewRaftMetaStore(config RaftConfig, transport RaftTransport) (*RaftMetaStore, error) {
+    // Every replica applies the same log and must report the same history
+    metaStore := NewMetaStore()
+    metaStore.Epoch = raftEpoch(config.Peers)
+    node, err := NewRaftNode(config, transport, metaStore)
+    if err != nil {
+        return nil, err
+    }
+    return &RaftMetaStore{Node: node}, nil
+}
+
+func (m *RaftMetaStore) GetFileInfoMap(_ignore *bool, serverFileInfoMap *map[string]FileMetaData) error {
+    return m.Node.Read(func(metaStore *MetaStore) error {
+        // Copy, the map keeps changing while the reply is encoded
+        fileInfoMap := make(map[string]FileMetaData, len(metaStore.FileMetaMap))
+        for fileName, fileMetaData := range metaStore.FileMetaMap {
+            fileInfoMap[fileName] = fileMetaData
+        }
+        *serverFileInfoMap = fileInfoMap
+        return nil
+    })
+}
+
+func (m *RaftMetaStore) GetChangesSince(args ChangesArgs, reply *ChangesReply) error {
+    return m.Node.Read(func(metaStore *MetaStore) error {
+        return metaStore.GetChangesSince(args, reply)
+    })
+}
+
+func (m *RaftMetaStore) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) error {
+    version, err := m.Node.Propose(MetaLogEntry{Op: OpUpdateFile, FileMetaData: *fileMetaData, Time: time.Now()})
+    *latestVersion = version
+    return err
+}
+
+/**
+* The renames are computed on the leader, the whole commit is checked again when the entry is
+* applied.
+*/
+func (m *RaftMetaStore) CommitFiles(args CommitArgs, latestVersions *[]int) error {
+    var renames []RenamedFile
+    err := m.Node.Read(func(metaStore *MetaStore) error {
+        var err error
+        renames, err = metaStore.renamedFilesOf(args.Renames)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    if _, err := m.Node.Propose(MetaLogEntry{Op: OpCommitFiles, Files: args.Files, Renames: renames, Time: time.Now()}); err != nil {
+        return err
+    }
+    *latestVersions = committedVersions(args.Files, renames)
+    return nil
+}
+
+func (m *RaftMetaStore) GetFileHistory(fileName string, versions *[]FileVersion) error {
+    return m.Node.Read(func(metaStore *MetaStore) error {
+        return metaStore.GetFileHistory(fileName, versions)
+    })
+}
+
+/**
+* The leader looks up the old version and proposes it as a regular update, which fails with
+* a version conflict if the file changed in between.
+*/
+func (m *RaftMetaStore) RestoreFile(args RestoreArgs, latestVersion *int) error {
+    var restored FileMetaData
+    err := m.Node.Read(func(metaStore *MetaStore) error {
+        var err error
+        restored, err = metaStore.restoredFile(args)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    return m.UpdateFile(&restored, latestVersion)
+}
+
+/**
+* The rename is computed on the leader and checked again when the entry is applied, in case
+* the file changed in between.
+*/
+func (m *RaftMetaStore) RenameFile(args RenameArgs, latestVersion *int) error {
+    var source, target FileMetaData
+    err := m.Node.Read(func(metaStore *MetaStore) error {
+        var err error
+        source, target, err = metaStore.renamedFiles(args)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    version, err := m.Node.Propose(MetaLogEntry{Op: OpRenameFile, FileMetaData: target, Source: source, Time: time.Now()})
+    *latestVersion = version
+    return err
+}
+
+func (m *RaftMetaStore) CreateSnapshot(name string, succ *bool) error {
+    _, err := m.Node.Propose(MetaLogEntry{Op: OpCreateSnapshot, SnapshotName: name, Time: time.Now()})
+    *succ = err == nil
+    return err
+}
+
+func (m *RaftMetaStore) ListSnapshots(_ignore *bool, snapshots *[]SnapshotInfo) error {
+    return m.Node.Read(func(metaStore *MetaStore) error {
+        return metaStore.ListSnapshots(_ignore, snapshots)
+    })
+}
+
+func (m *RaftMetaStore) GetSnapshot(name string, files *map[string]FileMetaData) error {
+    return m.Node.Read(func(metaStore *MetaStore) error {
+        return metaStore.GetSnapshot(name, files)
+    })
+}
+
+/**
+* Only the leader purges, followers return a *NotLeaderError.
+*/
+func (m *RaftMetaStore) PurgeTombstones(cutoff time.Time) (int, error) {
+    expired := 0
+    err := m.Node.Read(func(metaStore *MetaStore) error {
+        expired = len(metaStore.expiredTombstones(cutoff))
+        return nil
+    })
+    if err != nil || expired == 0 {
+        return 0, err
+    }
+    return m.Node.Propose(MetaLogEntry{Op: OpPurgeTombstones, Time: cutoff})
+}
+
+/**
+* Blocks referenced by the committed metadata. Only the leader answers, after the read
+* barrier, a follower's copy may lag behind blocks that are referenced already. Followers
+* return a *NotLeaderError.
+*/
+func (m *RaftMetaStore) ReferencedBlocks() (map[string]bool, error) {
+    var live map[string]bool
+    err := m.Node.Read(func(metaStore *MetaStore) error {
+        var err error
+        live, err = metaStore.ReferencedBlocks()
+        return err
+    })
+    return live, err
+}
+
+/**
+* Signals the next change applied to this node's copy, whether or not it is the leader.
+*/
+func (m *RaftMetaStore) ChangeSignal() <-chan struct{} {
+    m.Node.mutex.Lock()
+    defer m.Node.mutex.Unlock()
+    return m.Node.metaStore.ChangeSignal()
+}
+
+var _ MetaStoreInterface = new(RaftMetaStore)
+var _ BlockReferencer = new(RaftMetaStore)
+var _ TombstonePurger = new(RaftMetaStore)
+var _ ChangeNotifier = new(RaftMetaStore)
+
+/**
+* The epoch of a cluster, derived from its members so that all of them agree on it.
+*/
+func raftEpoch(peers []string) string {
+    sorted := append([]string(nil), peers...)
+    sort.Strings(sorted)
+    return "raft-" + hashBlockData([]byte(strings.Join(sorted, ",")))[:16]
+}
@@ -0,0 +1,230 @@
+package surfstore
+
+import (
+    "bytes"
+    "encoding/gob"
+    "errors"
+    "strconv"
+    "sync"
+    "time"
+)
+
+/**
+* RaftTransport over net/rpc, calling the "Raft" service registered by ServeSurfstoreServer.
+* Peers are addressed by host:port.
+*/
+type rpcRaftTransport struct {
+    timeout time.Duration
+
+    mutex sync.Mutex
+    pools map[string]*connPool
+}
+
+/**
+* Create a transport whose calls give up after timeout, so an unreachable peer
+* cannot stall elections.
+*/
+func NewRPCRaftTransport(timeout time.Duration) RaftTransport {
+    return &rpcRaftTransport{timeout: timeout, pools: make(map[string]*connPool)}
+}
+
+func (t *rpcRaftTransport) RequestVote(peer string, args *RequestVoteArgs, reply *RequestVoteReply) error {
+    return t.pool(peer).call("Raft.RequestVote", args, reply)
+}
+
+func (t *rpcRaftTransport) AppendEntries(peer string, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+    return t.pool(peer).call("Raft.AppendEntries", args, reply)
+}
+
+func (t *rpcRaftTransport) pool(peer string) *connPool {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    pool, ok := t.pools[peer]
+    if !ok {
+        pool = newConnPool(peer, DefaultMaxIdleConns)
+        pool.timeout = t.timeout
+        t.pools[peer] = pool
+    }
+    return pool
+}
+
+var errRaftUnreachable = errors.New("Raft peer is unreachable")
+
+/**
+* LocalRaftNetwork connects the nodes of an in-process cluster, for tests.
+* Messages are copied through gob like real RPCs. Nodes can be cut off individually
+* with Disconnect, or split into groups that only reach each other with Partition.
+*/
+type LocalRaftNetwork struct {
+    mutex        sync.Mutex
+    nodes        map[string]*RaftNode
+    disconnected map[string]bool
+    // Partition group of each node, nodes in different groups cannot talk
+    group map[string]int
+}
+
+func NewLocalRaftNetwork() *LocalRaftNetwork {
+    return &LocalRaftNetwork{
+        nodes:        make(map[string]*RaftNode),
+        disconnected: make(map[string]bool),
+        group:        make(map[string]int),
+    }
+}
+
+/**
+* Start an in-process cluster of n nodes named node0, node1, ...
+* Returns the network, to inject partitions, and the started nodes.
+*/
+func StartLocalRaftCluster(n int, electionTimeout time.Duration) (*LocalRaftNetwork, []*RaftMetaStore, error) {
+    network := NewLocalRaftNetwork()
+    var peers []string
+    for i := 0; i < n; i++ {
+        peers = append(peers, "node" + strconv.Itoa(i))
+    }
+    var stores []*RaftMetaStore
+    for _, id := range peers {
+        config := RaftConfig{
+            ID:                id,
+            Peers:             peers,
+            ElectionTimeout:   electionTimeout,
+            HeartbeatInterval: electionTimeout / 6,
+        }
+        store, err := NewRaftMetaStore(config, network.Transport(id))
+        if err != nil {
+            return nil, nil, err
+        }
+        network.Register(id, store.Node)
+        stores = append(stores, store)
+    }
+    for _, store := range stores {
+        store.Node.Start()
+    }
+    return network, stores, nil
+}
+
+/**
+* Make node reachable under id.
+*/
+func (n *LocalRaftNetwork) Register(id string, node *RaftNode) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    n.nodes[id] = node
+}
+
+/**
+* The transport node id uses to send messages.
+*/
+func (n *LocalRaftNetwork) Transport(id string) RaftTransport {
+    return &localRaftTransport{network: n, from: id}
+}
+
+/**
+* Cut node id off from every other node.
+*/
+func (n *LocalRaftNetwork) Disconnect(id string) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    n.disconnected[id] = true
+}
+
+/**
+* Reconnect node id.
+*/
+func (n *LocalRaftNetwork) Connect(id string) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    delete(n.disconnected, id)
+}
+
+/**
+* Split the network, nodes can only reach nodes in the same group.
+* Nodes not listed form a group of their own.
+*/
+func (n *LocalRaftNetwork) Partition(groups ...[]string) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    n.group = make(map[string]int)
+    for i, members := range groups {
+        for _, id := range members {
+            n.group[id] = i + 1
+        }
+    }
+}
+
+/**
+* Remove all partitions and reconnect every node.
+*/
+func (n *LocalRaftNetwork) Heal() {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    n.group = make(map[string]int)
+    n.disconnected = make(map[string]bool)
+}
+
+/**
+* Returns the target node if from can reach to.
+*/
+func (n *LocalRaftNetwork) route(from string, to string) (*RaftNode, error) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    node, ok := n.nodes[to]
+    if !ok || n.disconnected[from] || n.disconnected[to] || n.group[from] != n.group[to] {
+        return nil, errRaftUnreachable
+    }
+    return node, nil
+}
+
+type localRaftTransport struct {
+    network *LocalRaftNetwork
+    from    string
+}
+
+func (t *localRaftTransport) RequestVote(peer string, args *RequestVoteArgs, reply *RequestVoteReply) error {
+    node, err := t.network.route(t.from, peer)
+    if err != nil {
+        return err
+    }
+    var argsCopy RequestVoteArgs
+    if err = gobCopy(args, &argsCopy); err != nil {
+        return err
+    }
+    var replyCopy RequestVoteReply
+    if err = node.RequestVote(&argsCopy, &replyCopy); err != nil {
+        return err
+    }
+    // The reply may be lost on the way back, too
+    if _, err = t.network.route(peer, t.from); err != nil {
+        return err
+    }
+    return gobCopy(&replyCopy, reply)
+}
+
+func (t *localRaftTransport) AppendEntries(peer string, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+    node, err := t.network.route(t.from, peer)
+    if err != nil {
+        return err
+    }
+    var argsCopy AppendEntriesArgs
+    if err = gobCopy(args, &argsCopy); err != nil {
+        return err
+    }
+    var replyCopy AppendEntriesReply
+    if err = node.AppendEntries(&argsCopy, &replyCopy); err != nil {
+        return err
+    }
+    if _, err = t.network.route(peer, t.from); err != nil {
+        return err
+    }
+    return gobCopy(&replyCopy, reply)
+}
+
+/**
+* Deep copy src into dst the way net/rpc would transmit it.
+*/
+func gobCopy(src interface{}, dst interface{}) error {
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+        return err
+    }
+    return gob.NewDecoder(&buf).Decode(dst)
+}
@@ -0,0 +1,340 @@
+package surfstore
+
+import (
+    "net"
+    "strconv"
+    "testing"
+    "time"
+)
+
+const testElectionTimeout = 150 * time.Millisecond
+
+func startTestRaftCluster(t *testing.T, n int) (*LocalRaftNetwork, []*RaftMetaStore) {
+    t.Helper()
+    network, stores, err := StartLocalRaftCluster(n, testElectionTimeout)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        for _, store := range stores {
+            store.Node.Stop()
+        }
+    })
+    return network, stores
+}
+
+/**
+* Wait until one of stores, other than those excluded, is leader and can serve reads.
+*/
+func waitForLeader(t *testing.T, stores []*RaftMetaStore, excluded ...*RaftMetaStore) *RaftMetaStore {
+    t.Helper()
+    deadline := time.Now().Add(20 * testElectionTimeout)
+    for time.Now().Before(deadline) {
+        for _, store := range stores {
+            if isExcluded(store, excluded) {
+                continue
+            }
+            if _, leader := store.Node.State(); leader && store.Node.Read(func(*MetaStore) error { return nil }) == nil {
+                return store
+            }
+        }
+        time.Sleep(testElectionTimeout / 10)
+    }
+    t.Fatal("No leader was elected")
+    return nil
+}
+
+func isExcluded(store *RaftMetaStore, excluded []*RaftMetaStore) bool {
+    for _, other := range excluded {
+        if store == other {
+            return true
+        }
+    }
+    return false
+}
+
+/**
+* The files a node has applied, read directly from its MetaStore.
+*/
+func appliedFiles(store *RaftMetaStore) map[string]FileMetaData {
+    store.Node.mutex.Lock()
+    defer store.Node.mutex.Unlock()
+    files := make(map[string]FileMetaData)
+    for fileName, fileMetaData := range store.Node.metaStore.FileMetaMap {
+        files[fileName] = fileMetaData
+    }
+    return files
+}
+
+func updateTestFile(store *RaftMetaStore, fileName string, version int) error {
+    var latestVersion int
+    return store.UpdateFile(&FileMetaData{Filename: fileName, Version: version, BlockHashList: []string{fileName}}, &latestVersion)
+}
+
+func TestRaftElectsSingleLeader(t *testing.T) {
+    _, stores := startTestRaftCluster(t, 3)
+    leader := waitForLeader(t, stores)
+    leaderTerm, _ := leader.Node.State()
+
+    for _, store := range stores {
+        term, isLeader := store.Node.State()
+        if store != leader && isLeader && term == leaderTerm {
+            t.Fatal("Two leaders in term", term)
+        }
+    }
+    for _, store := range stores {
+        if store == leader {
+            continue
+        }
+        var latestVersion int
+        err := store.UpdateFile(&FileMetaData{Filename: "a", Version: 1}, &latestVersion)
+        notLeader, ok := err.(*NotLeaderError)
+        if !ok {
+            t.Fatalf("Follower accepted an update: %v", err)
+        }
+        if notLeader.Leader != leader.Node.config.ID {
+            t.Fatalf("Follower names %q as leader, want %q", notLeader.Leader, leader.Node.config.ID)
+        }
+    }
+}
+
+func TestRaftSingleNodeCommitsAlone(t *testing.T) {
+    _, stores := startTestRaftCluster(t, 1)
+    leader := waitForLeader(t, stores)
+    leader.Node.config.ProposalTimeout = 4 * testElectionTimeout
+
+    start := time.Now()
+    for version := 1; version <= 3; version++ {
+        if err := updateTestFile(leader, "a", version); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if elapsed := time.Since(start); elapsed > 2 * testElectionTimeout {
+        t.Fatalf("Three updates took %v", elapsed)
+    }
+    var succ bool
+    var files map[string]FileMetaData
+    if err := leader.GetFileInfoMap(&succ, &files); err != nil {
+        t.Fatal(err)
+    }
+    if files["a"].Version != 3 {
+        t.Fatalf("Leader has %v", files)
+    }
+}
+
+func TestRaftFollowerForwardsWriteToLeader(t *testing.T) {
+    var addrs []string
+    for i := 0; i < 3; i++ {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        addrs = append(addrs, l.Addr().String())
+        l.Close()
+    }
+    var stores []*RaftMetaStore
+    for _, addr := range addrs {
+        server, err := NewSurfstoreServerFromConfig(ServerConfig{RaftID: addr, RaftPeers: addrs})
+        if err != nil {
+            t.Fatal(err)
+        }
+        store := server.MetaStore.(*RaftMetaStore)
+        store.Node.config.ElectionTimeout = testElectionTimeout
+        store.Node.config.HeartbeatInterval = testElectionTimeout / 6
+        stores = append(stores, store)
+        go ServeSurfstoreServer(addr, server)
+    }
+    t.Cleanup(func() {
+        for _, store := range stores {
+            store.Node.Stop()
+        }
+    })
+    leader := waitForLeader(t, stores)
+
+    // Start at a follower, the client must end up at the leader
+    var order []string
+    for i, store := range stores {
+        if store != leader {
+            order = append([]string{addrs[i]}, order...)
+        } else {
+            order = append(order, addrs[i])
+        }
+    }
+    client := NewSurfstoreRPCClient(order[0], t.TempDir(), 4096)
+    client.UseMetaCluster(order)
+    defer client.Close()
+
+    var latestVersion int
+    if err := client.UpdateFile(&FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h"}}, &latestVersion); err != nil {
+        t.Fatal(err)
+    }
+    if latestVersion != 1 {
+        t.Fatalf("Latest version %d, want 1", latestVersion)
+    }
+    var succ bool
+    var files map[string]FileMetaData
+    if err := client.GetFileInfoMap(&succ, &files); err != nil {
+        t.Fatal(err)
+    }
+    if files["a"].Version != 1 {
+        t.Fatalf("Server has %v", files)
+    }
+}
+
+func TestRaftMinorityLeaderCannotCommit(t *testing.T) {
+    network, stores := startTestRaftCluster(t, 5)
+    leader := waitForLeader(t, stores)
+    if err := updateTestFile(leader, "a", 1); err != nil {
+        t.Fatal(err)
+    }
+
+    // The leader and one follower on one side, three nodes on the other
+    minority := []string{leader.Node.config.ID}
+    var majority []string
+    for _, store := range stores {
+        if store == leader {
+            continue
+        }
+        if len(minority) < 2 {
+            minority = append(minority, store.Node.config.ID)
+        } else {
+            majority = append(majority, store.Node.config.ID)
+        }
+    }
+    network.Partition(minority, majority)
+
+    leader.Node.config.ProposalTimeout = 4 * testElectionTimeout
+    if err := updateTestFile(leader, "b", 1); err == nil {
+        t.Fatal("A leader cut off from the majority committed an update")
+    }
+    var files map[string]FileMetaData
+    var succ bool
+    if err := leader.GetFileInfoMap(&succ, &files); err == nil {
+        t.Fatal("A leader cut off from the majority served a read")
+    }
+    if _, ok := appliedFiles(leader)["b"]; ok {
+        t.Fatal("The uncommitted update was applied")
+    }
+}
+
+func TestRaftMajorityKeepsServing(t *testing.T) {
+    network, stores := startTestRaftCluster(t, 3)
+    leader := waitForLeader(t, stores)
+    if err := updateTestFile(leader, "a", 1); err != nil {
+        t.Fatal(err)
+    }
+
+    network.Disconnect(leader.Node.config.ID)
+    newLeader := waitForLeader(t, stores, leader)
+    if err := updateTestFile(newLeader, "a", 2); err != nil {
+        t.Fatal(err)
+    }
+    if err := updateTestFile(newLeader, "b", 1); err != nil {
+        t.Fatal(err)
+    }
+    var succ bool
+    var files map[string]FileMetaData
+    if err := newLeader.GetFileInfoMap(&succ, &files); err != nil {
+        t.Fatal(err)
+    }
+    if files["a"].Version != 2 || files["b"].Version != 1 {
+        t.Fatalf("Leader has %v", files)
+    }
+}
+
+func TestRaftLogsConvergeAfterHeal(t *testing.T) {
+    network, stores := startTestRaftCluster(t, 3)
+    oldLeader := waitForLeader(t, stores)
+    if err := updateTestFile(oldLeader, "a", 1); err != nil {
+        t.Fatal(err)
+    }
+
+    var others []string
+    for _, store := range stores {
+        if store != oldLeader {
+            others = append(others, store.Node.config.ID)
+        }
+    }
+    network.Partition([]string{oldLeader.Node.config.ID}, others)
+
+    // The old leader appends an entry it can never commit
+    oldLeader.Node.config.ProposalTimeout = 2 * testElectionTimeout
+    if err := updateTestFile(oldLeader, "lost", 1); err == nil {
+        t.Fatal("The isolated leader committed an update")
+    }
+    newLeader := waitForLeader(t, stores, oldLeader)
+    for i := 1; i <= 3; i++ {
+        if err := updateTestFile(newLeader, "f" + strconv.Itoa(i), 1); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    network.Heal()
+    // Make sure the last entry reaches everyone before comparing
+    leader := waitForLeader(t, stores)
+    if err := updateTestFile(leader, "after-heal", 1); err != nil {
+        t.Fatal(err)
+    }
+    want := appliedFiles(leader)
+    if _, ok := want["lost"]; ok {
+        t.Fatal("The uncommitted entry of the old leader survived")
+    }
+    if len(want) != 5 {
+        t.Fatalf("Leader has %v", want)
+    }
+
+    deadline := time.Now().Add(20 * testElectionTimeout)
+    for _, store := range stores {
+        for {
+            got := appliedFiles(store)
+            if len(got) == len(want) && sameFiles(got, want) {
+                break
+            }
+            if time.Now().After(deadline) {
+                t.Fatalf("%s did not converge: %v, want %v", store.Node.config.ID, got, want)
+            }
+            time.Sleep(testElectionTimeout / 10)
+        }
+    }
+}
+
+func sameFiles(a map[string]FileMetaData, b map[string]FileMetaData) bool {
+    for fileName, fileMetaData := range a {
+        other, ok := b[fileName]
+        if !ok || other.Version != fileMetaData.Version || !sameHashList(other.BlockHashList, fileMetaData.BlockHashList) {
+            return false
+        }
+    }
+    return true
+}
+
+func TestRaftProposalDoesNotBlockBlockCalls(t *testing.T) {
+    network, stores := startTestRaftCluster(t, 3)
+    leader := waitForLeader(t, stores)
+    server := NewSurfstoreServerWithStores(&BlockStore{BlockMap: map[string]Block{}}, leader)
+
+    network.Disconnect(leader.Node.config.ID)
+    leader.Node.config.ProposalTimeout = 20 * testElectionTimeout
+    pending := make(chan error, 1)
+    go func() {
+        var latestVersion int
+        pending <- server.UpdateFile(&FileMetaData{Filename: "a", Version: 1}, &latestVersion)
+    }()
+    time.Sleep(testElectionTimeout / 2)
+
+    done := make(chan error, 1)
+    go func() {
+        var succ bool
+        done <- server.PutBlock(Block{BlockData: []byte("data"), BlockSize: 4}, &succ)
+    }()
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-pending:
+        t.Fatal("The proposal returned before the block call")
+    case <-time.After(5 * testElectionTimeout):
+        t.Fatal("PutBlock waited for the pending proposal")
+    }
+}
@@ -0,0 +1,138 @@
+package surfstore
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+const (
+    maxRecordSize = 1 << 30
+)
+
+/**
+* recordLog is an append-only file of records framed as [4 byte length][4 byte CRC-32][payload].
+* Every append is fsynced, and a record torn by a crash is detected by its length or checksum
+* and cut off when the log is opened again.
+*/
+type recordLog struct {
+    file *os.File
+}
+
+/**
+* Open (or create) the log at path, calling fn with every intact record in order.
+* A torn or corrupted record at the tail is the result of a crash during append,
+* it was never acknowledged, so it is cut off. Returns the number of records read.
+*/
+func openRecordLog(path string, fn func(payload []byte) error) (*recordLog, int, error) {
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    reader := bufio.NewReader(file)
+    var offset int64
+    count := 0
+    header := make([]byte, 8)
+    for {
+        if _, err = io.ReadFull(reader, header); err != nil {
+            break
+        }
+        size := binary.BigEndian.Uint32(header[0:4])
+        if size > maxRecordSize {
+            err = errors.New("record too large")
+            break
+        }
+        payload := make([]byte, size)
+        if _, err = io.ReadFull(reader, payload); err != nil {
+            break
+        }
+        if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+            err = errors.New("checksum mismatch")
+            break
+        }
+        if err = fn(payload); err != nil {
+            file.Close()
+            return nil, 0, err
+        }
+        offset += int64(len(header) + len(payload))
+        count++
+    }
+    if err != io.EOF {
+        logError("Dropping torn log tail of", path, "at offset", offset, ": ", err)
+    }
+
+    if err = file.Truncate(offset); err != nil {
+        file.Close()
+        return nil, 0, err
+    }
+    if _, err = file.Seek(offset, io.SeekStart); err != nil {
+        file.Close()
+        return nil, 0, err
+    }
+    return &recordLog{file: file}, count, nil
+}
+
+/**
+* Append a record and fsync it.
+*/
+func (l *recordLog) append(payload []byte) error {
+    record := make([]byte, 8 + len(payload))
+    binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+    binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+    copy(record[8:], payload)
+
+    if _, err := l.file.Write(record); err != nil {
+        return err
+    }
+    return l.file.Sync()
+}
+
+/**
+* Drop every record.
+*/
+func (l *recordLog) reset() error {
+    if err := l.file.Truncate(0); err != nil {
+        return err
+    }
+    if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    return l.file.Sync()
+}
+
+func (l *recordLog) Close() error {
+    return l.file.Close()
+}
+
+/**
+* Replace dir/name with data. The data is written to a temp file, fsynced and renamed,
+* so the old content stays valid until the new one is complete.
+*/
+func writeFileAtomic(dir string, name string, data []byte) error {
+    tmp, err := ioutil.TempFile(dir, name + ".tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err = tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        return err
+    }
+    if err = os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+        return err
+    }
+    return syncDir(dir)
+}
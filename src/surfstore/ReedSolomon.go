@@ -0,0 +1,230 @@
+package surfstore
+
+import (
+    "errors"
+    "strconv"
+)
+
+/**
+* reedSolomon splits data into dataShards equally sized shards and computes parityShards
+* parity shards, so that the data can be rebuilt from any dataShards of them.
+*
+* The code is systematic: the first dataShards shards are the data itself. The parity
+* shards are rows of a Vandermonde matrix, normalized so that its top is the identity,
+* multiplied with the data over GF(2^8). Any dataShards rows of that matrix are linearly
+* independent, so the data is rebuilt by inverting the rows of the shards at hand.
+*/
+type reedSolomon struct {
+    dataShards   int
+    parityShards int
+    // (dataShards + parityShards) x dataShards
+    matrix [][]byte
+}
+
+func newReedSolomon(dataShards int, parityShards int) (*reedSolomon, error) {
+    if dataShards <= 0 || parityShards < 0 || dataShards + parityShards > 256 {
+        return nil, errors.New("Invalid shard counts " + strconv.Itoa(dataShards) + "+" + strconv.Itoa(parityShards))
+    }
+    total := dataShards + parityShards
+    vandermonde := make([][]byte, total)
+    for r := range vandermonde {
+        vandermonde[r] = make([]byte, dataShards)
+        for c := range vandermonde[r] {
+            vandermonde[r][c] = gfPow(byte(r), c)
+        }
+    }
+    top, err := gfInvert(vandermonde[:dataShards])
+    if err != nil {
+        return nil, err
+    }
+    return &reedSolomon{
+        dataShards:   dataShards,
+        parityShards: parityShards,
+        matrix:       gfMultiply(vandermonde, top),
+    }, nil
+}
+
+/**
+* Split data into dataShards + parityShards shards. The last data shard is zero padded,
+* the original length must be kept to reconstruct the data.
+*/
+func (rs *reedSolomon) encode(data []byte) [][]byte {
+    shardSize := (len(data) + rs.dataShards - 1) / rs.dataShards
+    if shardSize == 0 {
+        shardSize = 1
+    }
+    padded := make([]byte, shardSize * rs.dataShards)
+    copy(padded, data)
+
+    shards := make([][]byte, rs.dataShards + rs.parityShards)
+    for i := 0; i < rs.dataShards; i++ {
+        shards[i] = padded[i * shardSize:(i + 1) * shardSize]
+    }
+    for i := rs.dataShards; i < len(shards); i++ {
+        shards[i] = make([]byte, shardSize)
+        for j := 0; j < rs.dataShards; j++ {
+            gfMulAdd(rs.matrix[i][j], shards[j], shards[i])
+        }
+    }
+    return shards
+}
+
+/**
+* Rebuild the original size bytes from the shards, a missing shard is nil.
+* At least dataShards shards of the same size are needed.
+*/
+func (rs *reedSolomon) reconstruct(shards [][]byte, size int) ([]byte, error) {
+    if len(shards) != rs.dataShards + rs.parityShards {
+        return nil, errors.New("Wrong number of shards")
+    }
+    var rows [][]byte
+    var present [][]byte
+    shardSize := -1
+    for i, shard := range shards {
+        if shard == nil || len(present) == rs.dataShards {
+            continue
+        }
+        if shardSize >= 0 && len(shard) != shardSize {
+            return nil, errors.New("Shards differ in size")
+        }
+        shardSize = len(shard)
+        rows = append(rows, rs.matrix[i])
+        present = append(present, shard)
+    }
+    if len(present) < rs.dataShards {
+        return nil, errors.New("Only " + strconv.Itoa(len(present)) + " of " + strconv.Itoa(rs.dataShards) + " required shards are available")
+    }
+    if size > shardSize * rs.dataShards {
+        return nil, errors.New("Shards are too small for the block size")
+    }
+
+    decode, err := gfInvert(rows)
+    if err != nil {
+        return nil, err
+    }
+    data := make([]byte, shardSize * rs.dataShards)
+    for i := 0; i < rs.dataShards; i++ {
+        out := data[i * shardSize:(i + 1) * shardSize]
+        if shards[i] != nil && len(shards[i]) == shardSize {
+            copy(out, shards[i])
+            continue
+        }
+        for j, shard := range present {
+            gfMulAdd(decode[i][j], shard, out)
+        }
+    }
+    return data[:size], nil
+}
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var gfExp, gfLog = func() ([512]byte, [256]byte) {
+    var exp [512]byte
+    var log [256]byte
+    x := 1
+    for i := 0; i < 255; i++ {
+        exp[i] = byte(x)
+        log[x] = byte(i)
+        x <<= 1
+        if x & 0x100 != 0 {
+            x ^= 0x11d
+        }
+    }
+    for i := 255; i < len(exp); i++ {
+        exp[i] = exp[i - 255]
+    }
+    return exp, log
+}()
+
+func gfMul(a byte, b byte) byte {
+    if a == 0 || b == 0 {
+        return 0
+    }
+    return gfExp[int(gfLog[a]) + int(gfLog[b])]
+}
+
+func gfDiv(a byte, b byte) byte {
+    if a == 0 {
+        return 0
+    }
+    return gfExp[int(gfLog[a]) + 255 - int(gfLog[b])]
+}
+
+func gfPow(a byte, n int) byte {
+    if n == 0 {
+        return 1
+    }
+    if a == 0 {
+        return 0
+    }
+    return gfExp[(int(gfLog[a]) * n) % 255]
+}
+
+/**
+* out += c * in, element-wise.
+*/
+func gfMulAdd(c byte, in []byte, out []byte) {
+    if c == 0 {
+        return
+    }
+    logC := int(gfLog[c])
+    for i, b := range in {
+        if b != 0 {
+            out[i] ^= gfExp[logC + int(gfLog[b])]
+        }
+    }
+}
+
+func gfMultiply(a [][]byte, b [][]byte) [][]byte {
+    result := make([][]byte, len(a))
+    for r := range a {
+        result[r] = make([]byte, len(b[0]))
+        for c := range result[r] {
+            var sum byte
+            for k := range b {
+                sum ^= gfMul(a[r][k], b[k][c])
+            }
+            result[r][c] = sum
+        }
+    }
+    return result
+}
+
+/**
+* Invert a square matrix by Gauss-Jordan elimination.
+*/
+func gfInvert(matrix [][]byte) ([][]byte, error) {
+    n := len(matrix)
+    work := make([][]byte, n)
+    for r := range matrix {
+        work[r] = make([]byte, 2 * n)
+        copy(work[r], matrix[r])
+        work[r][n + r] = 1
+    }
+    for c := 0; c < n; c++ {
+        pivot := c
+        for pivot < n && work[pivot][c] == 0 {
+            pivot++
+        }
+        if pivot == n {
+            return nil, errors.New("Matrix is singular")
+        }
+        work[c], work[pivot] = work[pivot], work[c]
+        scale := work[c][c]
+        for i := range work[c] {
+            work[c][i] = gfDiv(work[c][i], scale)
+        }
+        for r := 0; r < n; r++ {
+            if r != c && work[r][c] != 0 {
+                factor := work[r][c]
+                for i := range work[r] {
+                    work[r][i] ^= gfMul(factor, work[c][i])
+                }
+            }
+        }
+    }
+    inverse := make([][]byte, n)
+    for r := range work {
+        inverse[r] = work[r][n:]
+    }
+    return inverse, nil
+}
@@ -0,0 +1,63 @@
+package surfstore
+
+import (
+    "bytes"
+    "math/bits"
+    "math/rand"
+    "testing"
+)
+
+func TestReedSolomonReconstructsFromAnyDataShards(t *testing.T) {
+    random := rand.New(rand.NewSource(1))
+    for _, counts := range [][2]int{{1, 1}, {2, 1}, {3, 2}, {4, 2}, {5, 3}} {
+        dataShards, parityShards := counts[0], counts[1]
+        rs, err := newReedSolomon(dataShards, parityShards)
+        if err != nil {
+            t.Fatal(err)
+        }
+        total := dataShards + parityShards
+        for _, size := range []int{0, 1, dataShards * 7, dataShards * 7 + 1, 1000} {
+            data := make([]byte, size)
+            random.Read(data)
+            shards := rs.encode(data)
+            if len(shards) != total {
+                t.Fatalf("%d+%d: %d shards", dataShards, parityShards, len(shards))
+            }
+            if size > 0 && !bytes.Equal(bytes.Join(shards[:dataShards], nil)[:size], data) {
+                t.Fatalf("%d+%d: the data shards are not the data", dataShards, parityShards)
+            }
+
+            // Every set of missing shards, as a bit mask over the shards
+            for missing := 0; missing < 1 << uint(total); missing++ {
+                lost := bits.OnesCount(uint(missing))
+                present := make([][]byte, total)
+                for i := range shards {
+                    if missing & (1 << uint(i)) == 0 {
+                        present[i] = shards[i]
+                    }
+                }
+                got, err := rs.reconstruct(present, size)
+                if lost > parityShards {
+                    if err == nil {
+                        t.Fatalf("%d+%d: rebuilt %d bytes with %d shards missing", dataShards, parityShards, size, lost)
+                    }
+                    continue
+                }
+                if err != nil {
+                    t.Fatalf("%d+%d, missing %b: %v", dataShards, parityShards, missing, err)
+                }
+                if !bytes.Equal(got, data) {
+                    t.Fatalf("%d+%d, missing %b: rebuilt data differs", dataShards, parityShards, missing)
+                }
+            }
+        }
+    }
+}
+
+func TestReedSolomonRejectsInvalidShardCounts(t *testing.T) {
+    for _, counts := range [][2]int{{0, 1}, {1, -1}, {200, 57}} {
+        if _, err := newReedSolomon(counts[0], counts[1]); err == nil {
+            t.Fatalf("Accepted %d+%d shards", counts[0], counts[1])
+        }
+    }
+}
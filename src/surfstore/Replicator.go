@@ -0,0 +1,521 @@
+package surfstore
+
+import (
+    "crypto/sha256"
+    "errors"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    // Bound on each call to another block server, a dead server must not stall the replicator
+    replicationCallTimeout = 30 * time.Second
+)
+
+/**
+* How a block cluster protects blocks against the loss of servers: either full copies of
+* every block, or Reed-Solomon erasure coding.
+*/
+type ReplicationConfig struct {
+    // Copies of every block, 0 or 1 means no replication
+    Factor int
+    // Copies, or shards when erasure coding, that must be stored before a write succeeds.
+    // 0 means a majority of Factor, or DataShards plus half of ParityShards.
+    WriteQuorum int
+
+    // Erasure coding instead of copies: every block is split into DataShards data shards
+    // and ParityShards parity shards on different servers, and can be rebuilt from any
+    // DataShards of them. 0 means no erasure coding.
+    DataShards   int
+    ParityShards int
+}
+
+/**
+* Fill in defaults for a cluster of the given number of servers.
+*/
+func (c ReplicationConfig) normalize(servers int) ReplicationConfig {
+    if c.Factor <= 0 {
+        c.Factor = 1
+    }
+    if c.Factor > servers {
+        c.Factor = servers
+    }
+    if c.erasureCoded() {
+        total := c.DataShards + c.ParityShards
+        if c.WriteQuorum <= 0 {
+            c.WriteQuorum = c.DataShards + (c.ParityShards + 1) / 2
+        }
+        if c.WriteQuorum > total {
+            c.WriteQuorum = total
+        }
+        return c
+    }
+    if c.WriteQuorum <= 0 {
+        c.WriteQuorum = c.Factor / 2 + 1
+    }
+    if c.WriteQuorum > c.Factor {
+        c.WriteQuorum = c.Factor
+    }
+    return c
+}
+
+func (c ReplicationConfig) Validate() error {
+    if c.Factor < 0 || c.WriteQuorum < 0 || c.DataShards < 0 || c.ParityShards < 0 {
+        return errors.New("Replication settings must not be negative")
+    }
+    if !c.erasureCoded() {
+        if c.ParityShards > 0 {
+            return errors.New("Parity shards need data shards")
+        }
+        if c.Factor > 0 && c.WriteQuorum > c.Factor {
+            return errors.New("Write quorum must not exceed the replication factor")
+        }
+        return nil
+    }
+    if c.Factor > 1 {
+        return errors.New("Choose either replication or erasure coding")
+    }
+    if c.ParityShards == 0 {
+        return errors.New("Erasure coding needs at least one parity shard")
+    }
+    if c.DataShards + c.ParityShards > maxShardIndex + 1 {
+        return errors.New("At most " + strconv.Itoa(maxShardIndex + 1) + " shards per block")
+    }
+    if c.WriteQuorum > 0 && (c.WriteQuorum < c.DataShards || c.WriteQuorum > c.DataShards + c.ParityShards) {
+        return errors.New("Write quorum must be between the data shards and all shards")
+    }
+    return nil
+}
+
+func (c ReplicationConfig) erasureCoded() bool {
+    return c.DataShards > 0
+}
+
+/**
+* blockReplicator keeps the blocks of one server of a block cluster replicated.
+*
+* A block belongs on the first Factor servers clockwise from its hash on the ring, its
+* replica set. Every round the replicator compares Merkle trees with each live peer over
+* the blocks both should hold, and copies the blocks one of them is missing in either
+* direction, so a replica that missed writes while it was down catches up. When a server
+* of a replica set is down, the next live server on the ring takes its place and receives
+* a copy as well, which restores the replication factor. Blocks left on a server after the
+* ring changed are copied to their new replica set the same way.
+*
+* In an erasure coded cluster the replicator rebuilds lost shards instead, see rebuildShards.
+*
+* Copies refresh the access times garbage collection goes by, so when this server collects
+* garbage only blocks the committed metadata references are copied, see referencedBlocks.
+*/
+type blockReplicator struct {
+    server *Server
+    self   string
+    ring   *HashRing
+    factor int
+    // Set when the cluster erasure codes blocks instead of copying them
+    codec *reedSolomon
+    pools map[string]*connPool
+
+    // The block listing and the Merkle tree shared with each replica, kept while the
+    // generation of the block store stays the same
+    merkleMutex      sync.Mutex
+    merkleStore      BlockStoreInterface
+    merkleGeneration int
+    merkleBlocks     []string
+    merkleTrees      map[string]*merkleTree
+}
+
+/**
+* Run one round of anti-entropy with every live peer, then hand off the blocks that this
+* server holds outside of their replica set, and the blocks whose replica set has a server
+* that is down. Returns the number of copied blocks.
+*/
+func (r *blockReplicator) replicate() (int, error) {
+    live := r.liveServers()
+    referenced := r.referencedBlocks()
+    if r.codec != nil {
+        return r.rebuildShards(live, referenced)
+    }
+    copied := 0
+    for _, addr := range r.ring.Nodes() {
+        if addr == r.self || !live[addr] {
+            continue
+        }
+        n, err := r.antiEntropy(addr, referenced)
+        copied += n
+        if err != nil {
+            logError("Anti-entropy with " + addr + " Error: ", err)
+        }
+    }
+
+    lister, ok := r.server.BlockStore.(BlockLister)
+    if !ok {
+        return copied, errors.New("BlockStore cannot list its blocks")
+    }
+    r.server.Mutex.RLock()
+    blockHashes, err := lister.ListBlocks()
+    r.server.Mutex.RUnlock()
+    if err != nil {
+        return copied, err
+    }
+    targets := make(map[string][]string)
+    for _, blockHash := range blockHashes {
+        if !copyable(referenced, blockHash) {
+            continue
+        }
+        // Anti-entropy already covers the live servers of the replica set of this server
+        covered := make(map[string]bool)
+        for _, addr := range r.ring.Lookup(blockHash, r.factor) {
+            covered[addr] = true
+        }
+        if !covered[r.self] {
+            covered = nil
+        }
+        for _, addr := range r.replicasOf(blockHash, live) {
+            if !covered[addr] && addr != r.self {
+                targets[addr] = append(targets[addr], blockHash)
+            }
+        }
+    }
+    var addrs []string
+    for addr := range targets {
+        addrs = append(addrs, addr)
+    }
+    sort.Strings(addrs)
+    for _, addr := range addrs {
+        n, err := r.copyTo(addr, targets[addr])
+        copied += n
+        if err != nil {
+            logError("Replicate to " + addr + " Error: ", err)
+        }
+    }
+    return copied, nil
+}
+
+/**
+* Find the blocks this server and peer disagree on by walking down their Merkle trees
+* from the root, only into subtrees whose hashes differ, then copy the missing blocks
+* both ways, those in referenced unless it is nil. Returns the number of copied blocks.
+*/
+func (r *blockReplicator) antiEntropy(peer string, referenced map[string]bool) (int, error) {
+    local, err := r.server.merkleTree(peer)
+    if err != nil {
+        return 0, err
+    }
+    pool := r.pool(peer)
+    prefixes := []string{""}
+    for {
+        var remote []MerkleNode
+        err := pool.call("Server.GetMerkleNodes", MerkleArgs{Replica: r.self, Prefixes: prefixes}, &remote)
+        if err != nil {
+            return 0, err
+        }
+        if len(remote) != len(prefixes) {
+            return 0, errors.New("Peer returned the wrong number of Merkle nodes")
+        }
+        var differing []string
+        for i, node := range remote {
+            if node.Hash != local.node(prefixes[i]).Hash {
+                differing = append(differing, prefixes[i])
+            }
+        }
+        if len(differing) == 0 {
+            return 0, nil
+        }
+        if len(differing[0]) == merkleDepth {
+            prefixes = differing
+            break
+        }
+        prefixes = nil
+        for _, prefix := range differing {
+            prefixes = append(prefixes, merkleChildren(prefix)...)
+        }
+    }
+
+    var remoteHashes []string
+    err = pool.call("Server.GetMerkleLeaves", MerkleArgs{Replica: r.self, Prefixes: prefixes}, &remoteHashes)
+    if err != nil {
+        return 0, err
+    }
+    remoteHas := make(map[string]bool)
+    for _, blockHash := range remoteHashes {
+        remoteHas[blockHash] = true
+    }
+    localHas := make(map[string]bool)
+    var push []string
+    for _, prefix := range prefixes {
+        for _, blockHash := range local.leaves[prefix] {
+            localHas[blockHash] = true
+            if !remoteHas[blockHash] && copyable(referenced, blockHash) {
+                push = append(push, blockHash)
+            }
+        }
+    }
+    var pull []string
+    for _, blockHash := range remoteHashes {
+        if !localHas[blockHash] && copyable(referenced, blockHash) {
+            pull = append(pull, blockHash)
+        }
+    }
+
+    pushed, err := r.pushBlocks(peer, push)
+    if err != nil {
+        return pushed, err
+    }
+    pulled, err := r.pullBlocks(peer, pull)
+    return pushed + pulled, err
+}
+
+/**
+* The blocks the committed metadata references, nil to copy every block. Unreferenced blocks
+* are not copied, that would keep them from ever aging past the grace period of garbage
+* collection. A server of a block cluster only collects garbage with GCMetaAddrs, without them
+* every block is copied. So it is when the metadata cannot be had this round, losing a
+* referenced block is worse than keeping an unreferenced one a little longer.
+*/
+func (r *blockReplicator) referencedBlocks() map[string]bool {
+    if len(r.server.GCMetaAddrs) == 0 {
+        return nil
+    }
+    referenced, err := r.server.referencedBlocks()
+    if err != nil {
+        logError("Replicator referenced blocks Error: ", err)
+        return nil
+    }
+    return referenced
+}
+
+func copyable(referenced map[string]bool, blockHash string) bool {
+    return referenced == nil || referenced[blockHash]
+}
+
+/**
+* The servers that answer, this server always counts as live.
+*/
+func (r *blockReplicator) liveServers() map[string]bool {
+    live := map[string]bool{r.self: true}
+    for _, addr := range r.ring.Nodes() {
+        if addr == r.self {
+            continue
+        }
+        var blockHashesOut []string
+        if err := r.pool(addr).call("Server.HasBlocks", []string{}, &blockHashesOut); err == nil {
+            live[addr] = true
+        }
+    }
+    return live
+}
+
+/**
+* The first factor live servers clockwise from blockHash.
+*/
+func (r *blockReplicator) replicasOf(blockHash string, live map[string]bool) []string {
+    var replicas []string
+    for _, addr := range r.ring.Lookup(blockHash, len(r.ring.nodes)) {
+        if len(replicas) == r.factor {
+            break
+        }
+        if live[addr] {
+            replicas = append(replicas, addr)
+        }
+    }
+    return replicas
+}
+
+/**
+* The blocks whose replica set holds both this server and replica.
+*/
+func (r *blockReplicator) shared(blockHashes []string, replica string) []string {
+    var shared []string
+    for _, blockHash := range blockHashes {
+        self, other := false, false
+        for _, addr := range r.ring.Lookup(blockHash, r.factor) {
+            self = self || addr == r.self
+            other = other || addr == replica
+        }
+        if self && other {
+            shared = append(shared, blockHash)
+        }
+    }
+    return shared
+}
+
+/**
+* Send the blocks addr is missing, asking it with HasBlocks first.
+*/
+func (r *blockReplicator) copyTo(addr string, blockHashes []string) (int, error) {
+    perCall := r.server.maxBatchBytes() / (sha256.Size * 2) + 1
+    copied := 0
+    for start := 0; start < len(blockHashes); start += perCall {
+        end := start + perCall
+        if end > len(blockHashes) {
+            end = len(blockHashes)
+        }
+        var present []string
+        if err := r.pool(addr).call("Server.HasBlocks", blockHashes[start:end], &present); err != nil {
+            return copied, err
+        }
+        has := make(map[string]bool)
+        for _, blockHash := range present {
+            has[blockHash] = true
+        }
+        var missing []string
+        for _, blockHash := range blockHashes[start:end] {
+            if !has[blockHash] {
+                missing = append(missing, blockHash)
+            }
+        }
+        n, err := r.pushBlocks(addr, missing)
+        copied += n
+        if err != nil {
+            return copied, err
+        }
+    }
+    return copied, nil
+}
+
+/**
+* Send local blocks to addr in batches of at most MaxBatchBytes.
+*/
+func (r *blockReplicator) pushBlocks(addr string, blockHashes []string) (int, error) {
+    pool := r.pool(addr)
+    copied := 0
+    var batch []Block
+    batchBytes := 0
+    flush := func() error {
+        if len(batch) == 0 {
+            return nil
+        }
+        var succ bool
+        if err := pool.call("Server.PutBlocks", batch, &succ); err != nil {
+            return err
+        }
+        copied += len(batch)
+        batch, batchBytes = nil, 0
+        return nil
+    }
+    for _, blockHash := range blockHashes {
+        var block Block
+        r.server.Mutex.RLock()
+        err := r.server.BlockStore.GetBlock(blockHash, &block)
+        r.server.Mutex.RUnlock()
+        if err != nil || len(block.BlockData) == 0 {
+            // Collected since it was listed
+            continue
+        }
+        if len(batch) > 0 && batchBytes + len(block.BlockData) > r.server.maxBatchBytes() {
+            if err := flush(); err != nil {
+                return copied, err
+            }
+        }
+        batch = append(batch, block)
+        batchBytes += len(block.BlockData)
+    }
+    return copied, flush()
+}
+
+/**
+* Fetch blocks from addr and store them locally.
+*/
+func (r *blockReplicator) pullBlocks(addr string, blockHashes []string) (int, error) {
+    pool := r.pool(addr)
+    copied := 0
+    for len(blockHashes) > 0 {
+        // The peer trims the reply to its batch size
+        var blocks []Block
+        if err := pool.call("Server.GetBlocks", blockHashes, &blocks); err != nil {
+            return copied, err
+        }
+        if len(blocks) == 0 {
+            return copied, errors.New("Peer returned an empty batch")
+        }
+        blockHashes = blockHashes[len(blocks):]
+
+        var present []Block
+        for _, block := range blocks {
+            // Collected on the peer since it was listed
+            if len(block.BlockData) > 0 {
+                present = append(present, block)
+            }
+        }
+        var succ bool
+        r.server.Mutex.Lock()
+        err := r.server.BlockStore.PutBlocks(present, &succ)
+        r.server.Mutex.Unlock()
+        if err != nil {
+            return copied, err
+        }
+        copied += len(present)
+    }
+    return copied, nil
+}
+
+func (r *blockReplicator) pool(addr string) *connPool {
+    pool, ok := r.pools[addr]
+    if !ok {
+        pool = newConnPool(addr, DefaultMaxIdleConns)
+        pool.timeout = replicationCallTimeout
+        r.pools[addr] = pool
+    }
+    return pool
+}
+
+/**
+* Repair and re-replicate the blocks of this server every interval until the returned stop
+* function is called, as the Replication of the server asks. self is the address of this
+* server and must be one of peers, the block servers of the cluster. Every server of the
+* cluster should run a replicator, and it must be started before the server is served.
+*/
+func (s *Server) StartBlockReplicator(self string, peers []string, interval time.Duration) (stop func(), err error) {
+    ring := NewHashRing(peers, DefaultVirtualNodes)
+    if !ring.nodes[self] {
+        return nil, errors.New("Block server " + self + " is not one of its peers")
+    }
+    replication := s.Replication.normalize(len(ring.nodes))
+    r := &blockReplicator{
+        server: s,
+        self:   self,
+        ring:   ring,
+        factor: replication.Factor,
+        pools:  make(map[string]*connPool),
+    }
+    if replication.erasureCoded() {
+        if len(ring.nodes) < replication.DataShards + replication.ParityShards {
+            return nil, errors.New("Erasure coding needs a block server for every shard")
+        }
+        codec, err := newReedSolomon(replication.DataShards, replication.ParityShards)
+        if err != nil {
+            return nil, err
+        }
+        r.codec = codec
+    }
+    s.replicator = r
+    done := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                copied, err := r.replicate()
+                if err != nil {
+                    logError("Replicate Error: ", err)
+                } else if copied > 0 && r.codec != nil {
+                    logInfo("Replicator rebuilt", copied, "shards")
+                } else if copied > 0 {
+                    logInfo("Replicator copied", copied, "blocks to restore replication factor", r.factor)
+                }
+            case <-done:
+                for _, pool := range r.pools {
+                    pool.Close()
+                }
+                return
+            }
+        }
+    }()
+    return func() {
+        close(done)
+    }, nil
+}
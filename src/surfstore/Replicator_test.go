@@ -0,0 +1,133 @@
+package surfstore
+
+import (
+    "testing"
+    "time"
+)
+
+/**
+* Start block servers replicating with factor copies, with rounds run by hand.
+*/
+func startTestReplicatedServers(t *testing.T, n int, factor int) ([]string, []*Server) {
+    t.Helper()
+    addrs, _, servers := startTestBlockServers(t, n, ReplicationConfig{Factor: factor})
+    for i, server := range servers {
+        stop, err := server.StartBlockReplicator(addrs[i], addrs, time.Hour)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(stop)
+    }
+    return addrs, servers
+}
+
+func hasBlock(server *Server, blockHash string) bool {
+    server.Mutex.RLock()
+    defer server.Mutex.RUnlock()
+    var present []string
+    server.BlockStore.HasBlocks([]string{blockHash}, &present)
+    return len(present) == 1
+}
+
+func TestReplicatorSkipsUnreferencedBlocks(t *testing.T) {
+    blocks, hashes := testBlocks(2, 100)
+    metaServer := NewSurfstoreServer()
+    var latestVersion int
+    if err := metaServer.MetaStore.UpdateFile(&FileMetaData{Filename: "f", Version: 1, BlockHashList: hashes[:1]}, &latestVersion); err != nil {
+        t.Fatal(err)
+    }
+    metaAddr := startTestServer(t, &metaServer)
+
+    _, servers := startTestReplicatedServers(t, 2, 2)
+    for _, server := range servers {
+        server.GCMetaAddrs = []string{metaAddr}
+    }
+    var succ bool
+    if err := servers[0].BlockStore.PutBlocks(blocks, &succ); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := servers[0].replicator.replicate(); err != nil {
+        t.Fatal(err)
+    }
+    if !hasBlock(servers[1], hashes[0]) {
+        t.Fatal("The referenced block was not copied")
+    }
+    if hasBlock(servers[1], hashes[1]) {
+        t.Fatal("The unreferenced block was copied")
+    }
+}
+
+func TestDivergedReplicasConvergeThroughMerkleExchange(t *testing.T) {
+    addrs, servers := startTestReplicatedServers(t, 2, 2)
+    blocks, hashes := testBlocks(300, 50)
+    var succ bool
+    // Both hold the first third, each one of the other thirds
+    if err := servers[0].BlockStore.PutBlocks(blocks[:200], &succ); err != nil {
+        t.Fatal(err)
+    }
+    if err := servers[1].BlockStore.PutBlocks(blocks[:100], &succ); err != nil {
+        t.Fatal(err)
+    }
+    if err := servers[1].BlockStore.PutBlocks(blocks[200:], &succ); err != nil {
+        t.Fatal(err)
+    }
+
+    copied, err := servers[0].replicator.antiEntropy(addrs[1], nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if copied != 200 {
+        t.Fatalf("Copied %d blocks, want 200", copied)
+    }
+    for i, server := range servers {
+        for _, hash := range hashes {
+            if !hasBlock(server, hash) {
+                t.Fatalf("Server %d is missing a block after the exchange", i)
+            }
+        }
+    }
+    roots := make([]MerkleNode, 2)
+    for i, server := range servers {
+        tree, err := server.merkleTree(addrs[1 - i])
+        if err != nil {
+            t.Fatal(err)
+        }
+        roots[i] = tree.node("")
+    }
+    if roots[0].Hash != roots[1].Hash || roots[0].Count != len(hashes) {
+        t.Fatalf("Merkle roots %v and %v differ", roots[0], roots[1])
+    }
+    if copied, err := servers[0].replicator.antiEntropy(addrs[1], nil); err != nil || copied != 0 {
+        t.Fatalf("A second exchange copied %d blocks: %v", copied, err)
+    }
+}
+
+func TestMerkleTreeCachedUntilBlocksChange(t *testing.T) {
+    addrs, servers := startTestReplicatedServers(t, 2, 2)
+    blocks, _ := testBlocks(2, 50)
+    var succ bool
+    if err := servers[0].BlockStore.PutBlock(blocks[0], &succ); err != nil {
+        t.Fatal(err)
+    }
+    first, err := servers[0].merkleTree(addrs[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+    again, err := servers[0].merkleTree(addrs[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again != first {
+        t.Fatal("The tree was built again without a change")
+    }
+    if err := servers[0].BlockStore.PutBlock(blocks[1], &succ); err != nil {
+        t.Fatal(err)
+    }
+    changed, err := servers[0].merkleTree(addrs[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if changed == first || changed.node("").Count != 2 {
+        t.Fatal("The tree did not pick up the new block")
+    }
+}
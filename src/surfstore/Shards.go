@@ -0,0 +1,145 @@
+package surfstore
+
+import (
+    "crypto/sha256"
+    "errors"
+    "strconv"
+    "strings"
+)
+
+const (
+    // Reed-Solomon over GF(2^8) allows at most 256 shards per block
+    maxShardIndex = 255
+)
+
+/**
+* Stores shards of erasure coded blocks.
+*/
+func (s *Server) PutShards(shards []Shard, succ *bool) error {
+    logDebug("PutShards: ", len(shards), "shards")
+    shardStore, err := s.shardStore()
+    if err != nil {
+        logError("PutShards Error: ", err)
+        return err
+    }
+    if err := s.checkShards(shards); err != nil {
+        logError("PutShards Error: ", err)
+        return err
+    }
+    size := 0
+    for _, shard := range shards {
+        size += len(shard.Data)
+    }
+    if len(shards) > 1 && size > s.maxBatchBytes() {
+        err := errors.New("Batch of " + strconv.Itoa(size) + " bytes exceeds the limit of " + strconv.Itoa(s.maxBatchBytes()) + " bytes")
+        logError("PutShards Error: ", err)
+        return err
+    }
+
+    s.Mutex.Lock()
+    defer func() {
+        s.Mutex.Unlock()
+    }()
+    err = shardStore.PutShards(shards, succ)
+    if err != nil {
+        logError("PutShards Error: ", err)
+    }
+    return err
+}
+
+/**
+* Returns the requested shards in order, stopping early once the batch reaches MaxBatchBytes.
+* At least one shard is always returned, the client asks again for the rest.
+*/
+func (s *Server) GetShards(keys []ShardKey, shards *[]Shard) error {
+    logDebug("GetShards: ", len(keys), "keys")
+    shardStore, err := s.shardStore()
+    if err != nil {
+        logError("GetShards Error: ", err)
+        return err
+    }
+    s.Mutex.RLock()
+    defer func() {
+        s.Mutex.RUnlock()
+    }()
+    var all []Shard
+    err = shardStore.GetShards(keys, &all)
+    if err != nil {
+        logError("GetShards Error: ", err)
+        return err
+    }
+    size := 0
+    for i, shard := range all {
+        size += len(shard.Data)
+        if i > 0 && size > s.maxBatchBytes() {
+            break
+        }
+        *shards = append(*shards, shard)
+    }
+    return nil
+}
+
+func (s *Server) HasShards(keysIn []ShardKey, keysOut *[]ShardKey) error {
+    logDebug("HasShards: ", len(keysIn), "keys")
+    shardStore, err := s.shardStore()
+    if err != nil {
+        logError("HasShards Error: ", err)
+        return err
+    }
+    s.Mutex.Lock()
+    defer func() {
+        s.Mutex.Unlock()
+    }()
+    err = shardStore.HasShards(keysIn, keysOut)
+    if err != nil {
+        logError("HasShards Error: ", err)
+    }
+    return err
+}
+
+/**
+* Reject shards unless the block cluster of this server erasure codes blocks into that many
+* shards, the client was configured for another cluster.
+*/
+func (s *Server) checkShards(shards []Shard) error {
+    if !s.Replication.erasureCoded() {
+        return errors.New("Block cluster does not erasure code blocks, it stores whole blocks")
+    }
+    total := s.Replication.DataShards + s.Replication.ParityShards
+    for _, shard := range shards {
+        if shard.Index < 0 || shard.Index >= total {
+            return errors.New("Shard " + strconv.Itoa(shard.Index) + " of a block coded into " + strconv.Itoa(total) + " shards")
+        }
+    }
+    return nil
+}
+
+func (s *Server) shardStore() (ShardStore, error) {
+    shardStore, ok := s.BlockStore.(ShardStore)
+    if !ok {
+        return nil, errors.New("BlockStore cannot store shards")
+    }
+    return shardStore, nil
+}
+
+/**
+* Name of a shard, <block hash>.<index>.
+*/
+func shardName(key ShardKey) string {
+    return key.BlockHash + "." + strconv.Itoa(key.Index)
+}
+
+/**
+* Inverse of shardName, reports false for anything else.
+*/
+func parseShardName(name string) (ShardKey, bool) {
+    dot := strings.LastIndex(name, ".")
+    if dot < 0 {
+        return ShardKey{}, false
+    }
+    index, err := strconv.Atoi(name[dot + 1:])
+    if err != nil || index < 0 || index > maxShardIndex || len(name[:dot]) != sha256.Size * 2 {
+        return ShardKey{}, false
+    }
+    return ShardKey{BlockHash: name[:dot], Index: index}, true
+}
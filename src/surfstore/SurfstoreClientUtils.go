@@ -2,15 +2,26 @@ package surfstore
 
 import (
     "crypto/sha256"
-    "encoding/hex"
+    "errors"
     "io/ioutil"
     "fmt"
     "log"
-    "io"
-    "math"
+    "net/rpc"
     "os"
+    "path/filepath"
+    "sort"
     "strings"
     "strconv"
+    "time"
+)
+
+const (
+    // The client's copy of the server's FileInfoMap, in the format of index.txt
+    serverIndexFileName = "index.server"
+    // Position in the server's change feed that index.server is up to date with
+    cursorFileName = "index.cursor"
+    // Suffix of the temporary files downloads are written to, never synced
+    downloadSuffix = ".surfstore-download"
 )
 
 /*
@@ -22,15 +33,18 @@ import (
  * since the last time the client was executed (i.e., the hash list is different).
  */
 func ClientSync(client RPCClient) {
-    baseDir, readErr := ioutil.ReadDir(client.BaseDir)
+    dirMap, readErr := scanBaseDir(client.BaseDir)
     if readErr != nil {
         log.Println("Read client base directory error: ", readErr)
     }
-    dirMap := make(map[string]os.FileInfo)
-    for _, file := range baseDir {
-        dirMap[file.Name()] = file
-    }
-    
+    syncBaseDir(client, dirMap)
+}
+
+/**
+* Sync BaseDir, whose paths are listed in dirMap as scanBaseDir lists them. The daemon passes
+* the paths it knows of without walking the whole directory again.
+*/
+func syncBaseDir(client RPCClient, dirMap map[string]os.FileInfo) {
     // Check basic index.txt file
     // index.txt format example: File1.dat,3,h0 h1 h2 h3
     indexFilePath := client.BaseDir + "/index.txt"
@@ -54,18 +68,29 @@ func ClientSync(client RPCClient) {
         indexMap[fileMetaData.Filename] = i
     }
 
+    // Before hashing the local files, a reset of the change feed drops the cached hashes
+    serverFileInfoMap, cursor, purged, getInfoMapErr := fetchServerFileInfoMap(client, indexFileInfoMap)
+    if getInfoMapErr != nil {
+        log.Println("Get file info map from server error: ", getInfoMapErr)
+    }
+    if purged != nil {
+        log.Println("Deleted files were forgotten by the server since the last sync, comparing all files")
+    }
+
     // Iterate baseDir files and sync with index.txt, update file status in a new map
     clientFileInfoMap := localSync(client, indexFileInfoMap, &indexMap , dirMap , &indexLines)
 
-    var succ bool
-    serverFileInfoMap := make(map[string]FileMetaData)
-    getInfoMapErr := client.GetFileInfoMap(&succ, &serverFileInfoMap)
-    if getInfoMapErr != nil {
-        log.Println("Get file info map from server error: ", getInfoMapErr)
+    // Upload updated file to server, the new versions and renames are committed together at the end
+    var commit []FileMetaData
+    var renames []RenameArgs
+    if getInfoMapErr == nil {
+        uploadRenames(indexFileInfoMap, clientFileInfoMap, serverFileInfoMap, indexMap, indexLines, &renames)
+        applyRemoteRenames(client, clientFileInfoMap, serverFileInfoMap, indexMap, &indexLines)
     }
 
-    // Upload updated file to server
-    for fileName, info := range clientFileInfoMap {
+    // Paths are visited children first, so a deleted directory is already empty when it is removed
+    for _, fileName := range sortedPathsChildrenFirst(clientFileInfoMap) {
+        info := clientFileInfoMap[fileName]
         // Check if the server has the file
         if _, ok := serverFileInfoMap[fileName]; ok {
             serverFileMetaData := serverFileInfoMap[fileName]
@@ -75,26 +100,41 @@ func ClientSync(client RPCClient) {
             } else if (clientFileMetaData.Version > serverFileMetaData.Version) || 
                       (clientFileMetaData.Version == serverFileMetaData.Version && info.Status == Modified) {
                 // Server side file is old, or version is same and update only if file is modified
-                updateServerFile(client, clientFileMetaData, indexMap, &indexLines, info.Status)
+                updateServerFile(client, clientFileMetaData, indexMap, &indexLines, info.Status, &commit)
             } else {
                 // Client side file is old, or the file version is the same, update the client file.
+                // Local edits since the last sync are kept aside first.
+                if info.Status != Unchanged {
+                    merged, err := resolveConflict(client, clientFileMetaData, serverFileMetaData, indexMap, &indexLines, &commit)
+                    if err != nil || merged {
+                        continue
+                    }
+                }
                 updateClientFile(client, serverFileMetaData, indexMap, &indexLines)
             }
+        } else if purged[fileName] && info.Status == Unchanged {
+            // Deleted on the server while this client was away, uploading would bring it back
+            removeExpiredFile(client, fileName, indexMap, indexLines)
         } else {
             // upload file to the server
-            upload(client, info.FileMetaData, indexMap, &indexLines)
+            upload(client, info.FileMetaData, &commit)
         }
     }
     
     // Only download NEW files from server
-    for fileName, serverFileMetaData := range serverFileInfoMap {
+    for _, fileName := range sortedPathsChildrenFirst(serverFileInfoMap) {
+        serverFileMetaData := serverFileInfoMap[fileName]
+        if !validRelativePath(fileName) {
+            log.Println("Ignoring invalid path from server: ", fileName)
+            continue
+        }
         if _, ok := clientFileInfoMap[fileName]; !ok {
             if _, okay := indexMap[fileName]; okay {
                 // The file is deleted locally, check the version
                 deletedFileMetaData := encode(indexLines[indexMap[fileName]])
                 if deletedFileMetaData.Version > serverFileMetaData.Version {
                     // Upload deleted fileMetaData to the server
-                    updateServerFile(client, deletedFileMetaData, indexMap, &indexLines, Deleted)
+                    updateServerFile(client, deletedFileMetaData, indexMap, &indexLines, Deleted, &commit)
                 } else {
                     // Download file from the server
                     updateClientFile(client, serverFileMetaData, indexMap, &indexLines)
@@ -103,13 +143,43 @@ func ClientSync(client RPCClient) {
                 // Download brand new file.
                 line, err := download(client, fileName, serverFileMetaData)
                 if err != nil {
+                    // Not recorded, the next sync tries again
                     log.Println("Download file from server failed: ", err)
+                    continue
                 }
                 indexLines = append((indexLines), line)
             }
         }
     }
 
+    // A new file the server did not take is not recorded, or after purged deletions it could
+    // pass for a file deleted on the server. The next sync finds it new again, and finds a
+    // rename the server did not take again as well.
+    uncommitted, uncommittedRenames := commitFiles(client, commit, renames, indexMap, &indexLines)
+    for _, fileMetaData := range uncommitted {
+        if _, ok := indexFileInfoMap[fileMetaData.Filename]; !ok {
+            indexLines[indexMap[fileMetaData.Filename]] = ""
+        }
+    }
+    for _, rename := range uncommittedRenames {
+        source := indexFileInfoMap[rename.Source]
+        indexLines[indexMap[rename.Source]] = source.Filename + "," + strconv.Itoa(source.Version) + "," + strings.Join(source.BlockHashList, " ")
+        indexLines[indexMap[rename.Target]] = ""
+    }
+
+    // Deleted files the server no longer knows need no record
+    if getInfoMapErr == nil {
+        for i, indexLine := range indexLines {
+            if indexLine == "" {
+                continue
+            }
+            fileMetaData := encode(indexLine)
+            if _, ok := serverFileInfoMap[fileMetaData.Filename]; !ok && isTombstone(fileMetaData) {
+                indexLines[i] = ""
+            }
+        }
+    }
+
     // Update index.txt file
     updatedIndexFile := ""
     for _, indexLine := range indexLines {
@@ -122,10 +192,122 @@ func ClientSync(client RPCClient) {
     err := ioutil.WriteFile(indexFilePath, []byte(updatedIndexFile), 0755)
     if err != nil {
         log.Println("Updating index.txt file failed: ", err)
+    } else if purged != nil {
+        if err := saveServerIndex(client, serverFileInfoMap, cursor); err != nil {
+            log.Println("Saving the server index failed: ", err)
+        }
     }
 }
 
 
+/**
+* The server's FileInfoMap. The client keeps a copy of it in index.server and the cursor
+* of the server's change feed in index.cursor, both next to index.txt, so only the entries
+* that changed since the last sync are fetched. A server without a change feed sends the
+* whole map.
+* If the server purged deleted files the client has not seen, purged holds the files of
+* index.txt, given as indexFileInfoMap, and of the client's copy that the server no longer
+* knows, and is nil otherwise. The copy may be missing or older than index.txt. The copy and
+* cursor are then only saved by saveServerIndex once ClientSync has removed those files.
+* A cursor the server does not know anymore also drops the cached hashes of the local files,
+* so the sync compares everything from scratch. A reset without purged files, e.g. after a
+* restart of an in-memory server, lost no deletions, the files it lacks are uploaded again.
+*/
+func fetchServerFileInfoMap(client RPCClient, indexFileInfoMap map[string]FileMetaData) (fileInfoMap map[string]FileMetaData, cursor ChangeCursor, purged map[string]bool, err error) {
+    serverFileInfoMap := make(map[string]FileMetaData)
+    if data, err := ioutil.ReadFile(localPath(client, serverIndexFileName)); err == nil {
+        for _, line := range strings.Split(string(data), "\n") {
+            if line == "" {
+                continue
+            }
+            fileMetaData := encode(line)
+            serverFileInfoMap[fileMetaData.Filename] = fileMetaData
+        }
+        cursor = readCursor(client)
+    }
+    cachedFileInfoMap := serverFileInfoMap
+
+    expired, reset := false, false
+    for {
+        var reply ChangesReply
+        err := client.GetChangesSince(ChangesArgs{Cursor: cursor, Limit: DefaultChangesPageSize}, &reply)
+        if err != nil {
+            log.Println("Get changes from server error: ", err)
+            var succ bool
+            fullMap := make(map[string]FileMetaData)
+            err = client.GetFileInfoMap(&succ, &fullMap)
+            return fullMap, ChangeCursor{}, nil, err
+        }
+        expired = expired || reply.Expired
+        if reply.Reset {
+            reset = true
+            serverFileInfoMap = make(map[string]FileMetaData)
+        }
+        for _, fileMetaData := range reply.Changes {
+            serverFileInfoMap[fileMetaData.Filename] = fileMetaData
+        }
+        cursor = reply.Cursor
+        if !reply.More {
+            break
+        }
+    }
+
+    if reset && client.hashes != nil {
+        client.hashes.invalidate("")
+    }
+    if expired {
+        purged = make(map[string]bool)
+        for _, known := range []map[string]FileMetaData{cachedFileInfoMap, indexFileInfoMap} {
+            for fileName := range known {
+                if _, ok := serverFileInfoMap[fileName]; !ok {
+                    purged[fileName] = true
+                }
+            }
+        }
+        return serverFileInfoMap, cursor, purged, nil
+    }
+    if err := saveServerIndex(client, serverFileInfoMap, cursor); err != nil {
+        log.Println("Saving the server index failed: ", err)
+    }
+    return serverFileInfoMap, cursor, nil, nil
+}
+
+/**
+* Save the client's copy of the server's FileInfoMap and the cursor it is current at.
+* The map first, a crash in between only fetches the same changes again.
+*/
+func saveServerIndex(client RPCClient, serverFileInfoMap map[string]FileMetaData, cursor ChangeCursor) error {
+    var lines []string
+    for _, fileName := range sortedPathsChildrenFirst(serverFileInfoMap) {
+        fileMetaData := serverFileInfoMap[fileName]
+        lines = append(lines, fileName + "," + strconv.Itoa(fileMetaData.Version) + "," + strings.Join(fileMetaData.BlockHashList, " ") + "\n")
+    }
+    err := writeFileAtomic(client.BaseDir, serverIndexFileName, []byte(strings.Join(lines, "")))
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(client.BaseDir, cursorFileName, []byte(cursor.Epoch + "," + strconv.Itoa(cursor.Sequence) + "\n"))
+}
+
+/**
+* The cursor saved by the last sync, the beginning of the history if there is none.
+*/
+func readCursor(client RPCClient) ChangeCursor {
+    data, err := ioutil.ReadFile(localPath(client, cursorFileName))
+    if err != nil {
+        return ChangeCursor{}
+    }
+    tokens := strings.Split(strings.TrimSpace(string(data)), ",")
+    if len(tokens) != 2 {
+        return ChangeCursor{}
+    }
+    sequence, err := strconv.Atoi(tokens[1])
+    if err != nil {
+        return ChangeCursor{}
+    }
+    return ChangeCursor{Epoch: tokens[0], Sequence: sequence}
+}
+
 /**
 * Encode line in the index.txt file.
 */
@@ -158,24 +340,14 @@ func localSync(client RPCClient, indexFileInfoMap map[string]FileMetaData, index
     
     localMap := make(map[string]FileInfo)
     // Record file status
-    for fileName, f := range dirMap {
-        if fileName == "index.txt" {
-            continue
-        }
-
-        file, openErr := os.Open(client.BaseDir + "/" + fileName)
-        if openErr != nil {
-            log.Println("Open file Error: ", openErr)
-        }
-        fileSize := f.Size()
-        numBlock := int(math.Ceil(float64(fileSize) / float64(client.BlockSize)))
+    for fileName := range dirMap {
 
         // Check if file is a new file that is not recorded in index.txt or modified or unchanged
         var info FileInfo
 
         if fileMetaData, ok := indexFileInfoMap[fileName]; ok {
             // index.txt has the file record
-            changed, hashList := getHashList(file, fileMetaData, numBlock, client.BlockSize)
+            changed, hashList := localHashList(client, fileName, dirMap[fileName], fileMetaData)
             info.FileMetaData.Filename = fileName
             info.FileMetaData.Version = fileMetaData.Version
             hashStr := ""
@@ -197,7 +369,7 @@ func localSync(client RPCClient, indexFileInfoMap map[string]FileMetaData, index
         } else {
             // index.txt does not have the file record, i.e, no such a FileMetaData recorded.
             var metaData FileMetaData
-            _, hashList := getHashList(file, metaData, numBlock, client.BlockSize)
+            _, hashList := localHashList(client, fileName, dirMap[fileName], metaData)
             info.FileMetaData.Filename = fileName
             info.FileMetaData.Version = 1
             hashStr := ""
@@ -240,100 +412,234 @@ func checkDeletedFiles(indexFileInfoMap map[string]FileMetaData, indexMap map[st
 }
 
 /**
-* Generate hashList from file data blocks.
+* Generate the hashList of a local path. A directory has the hash list "dir".
 */
-func getHashList(file *os.File, fileMetaData FileMetaData, numBlock int, blockSize int) (bool, []string) {
-    hashList := make([]string, numBlock)
-    var changed bool
-    for i := 0; i < numBlock; i++ {
-        // For each block, generate the hashList
-        buf := make([]byte, blockSize)
-        n, e := file.Read(buf)
-        if e != nil {
-            log.Println("read error when getting hashList: ", e)
-        }
-        // Trim the buf
-        buf = buf[:n]
+func localHashList(client RPCClient, fileName string, f os.FileInfo, fileMetaData FileMetaData) (bool, []string) {
+    if f.IsDir() {
+        hashList := []string{directoryHash}
+        return !isDirectory(fileMetaData), hashList
+    }
 
-        hash := sha256.New()
-        hash.Write(buf)
-        hashBytes := hash.Sum(nil)
-        hashCode := hex.EncodeToString(hashBytes)
-        hashList[i] = hashCode
-        if i >= len(fileMetaData.BlockHashList) || hashCode != fileMetaData.BlockHashList[i] {
-            changed = true
+    if client.hashes != nil {
+        if hashList, ok := client.hashes.lookup(fileName, f); ok {
+            return !sameHashList(hashList, fileMetaData.BlockHashList), hashList
         }
     }
-    if numBlock != len(fileMetaData.BlockHashList) {
-        changed = true
+
+    file, openErr := os.Open(localPath(client, fileName))
+    if openErr != nil {
+        log.Println("Open file Error: ", openErr)
+        return true, []string{}
+    }
+    defer file.Close()
+    changed, hashList := getHashList(client, file, fileMetaData)
+    if client.hashes != nil {
+        client.hashes.store(fileName, f, hashList)
     }
     return changed, hashList
 }
 
+/**
+* Generate hashList from file data blocks, cut according to the client's chunking mode.
+*/
+func getHashList(client RPCClient, file *os.File, fileMetaData FileMetaData) (bool, []string) {
+    hashList := []string{}
+    err := splitChunks(file, client.Chunking, client.BlockSize, func(chunk []byte) error {
+        // For each block, generate the hashList
+        hashList = append(hashList, hashBlockData(chunk))
+        return nil
+    })
+    if err != nil {
+        log.Println("read error when getting hashList: ", err)
+    }
+
+    return !sameHashList(hashList, fileMetaData.BlockHashList), hashList
+}
+
+func sameHashList(a []string, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
 /**
 * Upload file to the server
-* UpdateFile and PutBlock
+* PutBlock now, the new metadata is added to the sync's commit
 */
-func upload(client RPCClient, fileMetaData FileMetaData, indexMap map[string]int, indexLines *[]string) error {
-    // Update file blocks
-    var err error
+func upload(client RPCClient, fileMetaData FileMetaData, commit *[]FileMetaData) {
+    // Update file blocks, a deleted file or a directory has none
+    filePath := localPath(client, fileMetaData.Filename)
+    if !isTombstone(fileMetaData) && !isDirectory(fileMetaData) {
+        putFileBlocks(client, filePath, fileMetaData)
+    }
+    *commit = append(*commit, fileMetaData)
+}
 
-    filePath := client.BaseDir + "/" + fileMetaData.Filename
-    if _, e := os.Stat(filePath); os.IsNotExist(e) {
-        // local file has been deleted, do not need to push blocks
-        err = client.UpdateFile(&fileMetaData, &fileMetaData.Version)
-        if err != nil {
-            log.Println("Update file failed: ", err)
+/**
+* Commit the new versions and renames of a sync's uploads in one transaction, so a crash never
+* leaves the server with only some of them. A file the server has a newer version of is
+* downloaded, unless the local edits were merged into it, and the rest is committed again. A
+* rename the server refuses is committed as a deletion and a new file instead. If the commit
+* fails otherwise, the versions in the index are still ahead of the server's and the next sync
+* uploads the files again. Returns the files and renames that were not committed.
+*/
+func commitFiles(client RPCClient, commit []FileMetaData, renames []RenameArgs, indexMap map[string]int, indexLines *[]string) (uncommitted []FileMetaData, uncommittedRenames []RenameArgs) {
+    for len(commit) > 0 || len(renames) > 0 {
+        var latestVersions []int
+        err := client.CommitFiles(CommitArgs{Files: commit, Renames: renames}, &latestVersions)
+        if err == nil {
+            return nil, nil
         }
-        return err
+        log.Println("Commit files failed: ", err)
+        conflict, ok := err.(*VersionConflictError)
+        if !ok {
+            if _, refused := err.(rpc.ServerError); refused && len(renames) > 0 {
+                // Refused renames, e.g. of a file changed meanwhile, become plain updates
+                commit = append(commit, renamedFileUpdates(renames, indexMap, *indexLines)...)
+                renames = nil
+                continue
+            }
+            return commit, renames
+        }
+        if j := renameOf(renames, conflict.Filename); j >= 0 {
+            commit = append(commit, renamedFileUpdates(renames[j:j + 1], indexMap, *indexLines)...)
+            renames = append(renames[:j:j], renames[j + 1:]...)
+            continue
+        }
+        i := 0
+        for i < len(commit) && commit[i].Filename != conflict.Filename {
+            i++
+        }
+        if i == len(commit) {
+            return commit, renames
+        }
+        fileMetaData := commit[i]
+        commit = append(commit[:i:i], commit[i + 1:]...)
+        merged, resolveErr := resolveConflict(client, fileMetaData, conflict.FileMetaData(), indexMap, indexLines, &commit)
+        if resolveErr == nil && !merged {
+            updateClientFile(client, conflict.FileMetaData(), indexMap, indexLines)
+        }
+    }
+    return nil, nil
+}
+
+/**
+* The index of the rename that moves a file from or to fileName, -1 if there is none.
+*/
+func renameOf(renames []RenameArgs, fileName string) int {
+    for j, rename := range renames {
+        if rename.Source == fileName || rename.Target == fileName {
+            return j
+        }
+    }
+    return -1
+}
+
+/**
+* A deletion of the old path and a new file at the new path for each rename, the versions the
+* index already records for them.
+*/
+func renamedFileUpdates(renames []RenameArgs, indexMap map[string]int, indexLines []string) []FileMetaData {
+    var files []FileMetaData
+    for _, rename := range renames {
+        files = append(files, encode(indexLines[indexMap[rename.Source]]), encode(indexLines[indexMap[rename.Target]]))
     }
+    return files
+}
 
+/**
+* Upload the blocks of a local file that the server does not have yet.
+*/
+func putFileBlocks(client RPCClient, filePath string, fileMetaData FileMetaData) {
     file, openErr := os.Open(filePath)
     if openErr != nil {
         log.Println("Open file Error: ", openErr)
+        return
     }
 
     defer file.Close()
 
-    f, _ := os.Stat(filePath)
-    numBlock := int(math.Ceil(float64(f.Size()) / float64(client.BlockSize)))
+    // Only blocks the server does not have yet need to be sent
+    skip := serverBlocks(client, fileMetaData.BlockHashList)
+
+    // Put Blocks, batching them up to the client's batch size
+    var batch []Block
+    batchBytes := 0
+    readErr := splitChunks(file, client.Chunking, client.BlockSize, func(chunk []byte) error {
+        hashCode := hashBlockData(chunk)
+        if skip[hashCode] {
+            return nil
+        }
+        // A block repeated within the file is sent once
+        skip[hashCode] = true
 
-    // Put Block
-    for i := 0; i < numBlock; i++ {
         var block Block
-        block.BlockData = make([]byte, client.BlockSize)
-        n, readErr := file.Read(block.BlockData)
-        if readErr != nil && readErr != io.EOF{
-            log.Println("Read file error: ", readErr)
+        block.BlockData = append([]byte(nil), chunk...)
+        block.BlockSize = len(chunk)
+
+        if len(batch) > 0 && batchBytes + block.BlockSize > client.maxBatchBytes() {
+            putBlocks(client, batch)
+            batch, batchBytes = nil, 0
         }
-        block.BlockSize = n 
-        // Trim the blockData
-        block.BlockData = block.BlockData[:n]
+        batch = append(batch, block)
+        batchBytes += block.BlockSize
+        return nil
+    })
+    if readErr != nil {
+        log.Println("Read file error: ", readErr)
+    }
+    if len(batch) > 0 {
+        putBlocks(client, batch)
+    }
+}
 
-        var succ bool
-        err = client.PutBlock(block, &succ)
+/**
+* Ask the server which of the given blocks it already stores.
+* If the server cannot be asked, every block is treated as missing.
+*/
+func serverBlocks(client RPCClient, hashList []string) map[string]bool {
+    present := make(map[string]bool)
+    // Keep each request small, a large file has hundreds of thousands of hashes
+    perCall := client.maxBatchBytes() / (sha256.Size * 2) + 1
+    for start := 0; start < len(hashList); start += perCall {
+        end := start + perCall
+        if end > len(hashList) {
+            end = len(hashList)
+        }
+        var blockHashesOut []string
+        err := client.HasBlocks(hashList[start:end], &blockHashesOut)
         if err != nil {
-            log.Println("Put block failed: ", err)
+            log.Println("Has blocks failed: ", err)
+            return make(map[string]bool)
         }
-    } 
+        for _, hash := range blockHashesOut {
+            present[hash] = true
+        }
+    }
+    return present
+}
 
-    // Update file
-    err = client.UpdateFile(&fileMetaData, &fileMetaData.Version)
+/**
+* Put one batch of blocks to the server.
+*/
+func putBlocks(client RPCClient, blocks []Block) {
+    var succ bool
+    err := client.PutBlocks(blocks, &succ)
     if err != nil {
-        log.Println("Update file failed: ", err)
-        // Update file failed, download from the server
-        serverFileInfoMap := make(map[string]FileMetaData)
-        var succ bool
-        client.GetFileInfoMap(&succ, &serverFileInfoMap)
-        updateClientFile(client, serverFileInfoMap[fileMetaData.Filename], indexMap, indexLines)
+        log.Println("Put blocks failed: ", err)
     }
-    return err
 }
 
 /**
 * Upload new client side file to the server.
 */
-func updateServerFile(client RPCClient, clientFileMetaData FileMetaData, indexMap map[string]int, indexLines *[]string, status State) {
+func updateServerFile(client RPCClient, clientFileMetaData FileMetaData, indexMap map[string]int, indexLines *[]string, status State, commit *[]FileMetaData) {
     // Update file
     // If client file has updated, version should plus 1.
     if status == Modified {
@@ -344,61 +650,119 @@ func updateServerFile(client RPCClient, clientFileMetaData FileMetaData, indexMa
         (*indexLines)[index] = line[:strings.Index(line, ",")] + "," + strconv.Itoa(clientFileMetaData.Version) + "," + line[strings.LastIndex(line, ",") + 1:]
     }
 
-    err := upload(client, clientFileMetaData, indexMap, indexLines)
-
-    if err != nil {
-        log.Println("Upload file failed: ", err)
-    }
+    upload(client, clientFileMetaData, commit)
 }
 
 /**
-* Download file from server.
-* If the file exists in the client dir, overwrite the file, otherwise create the file.
+* Download file from server and return its index.txt line.
+* A file is written to a temporary file next to it and renamed into place once every block
+* has arrived, so a failed download leaves the old file alone. On error nothing was changed
+* and the line is empty.
 */
 func download(client RPCClient, fileName string, fileMetaData FileMetaData) (string, error) {
-    filePath := client.BaseDir + "/" + fileName
-    if _, e := os.Stat(filePath); os.IsNotExist(e) {
-        os.Create(filePath)
-    } else {
-        os.Truncate(filePath, 0)    // Clean the current file.
-    }
+    filePath := localPath(client, fileName)
 
-    if len(fileMetaData.BlockHashList) == 1 && fileMetaData.BlockHashList[0] == "0" {
-        // file in the server has been deleted
+    if isTombstone(fileMetaData) {
+        // file in the server has been deleted, a deleted directory is empty by now
         err := os.Remove(filePath)
-        if err != nil {
+        if err != nil && !os.IsNotExist(err) {
             log.Println("Cannot remove file: ", err)
+            return "", err
         }
+        client.written.add(fileName)
         line := fileMetaData.Filename + "," + strconv.Itoa(fileMetaData.Version) + ",0"
-        return line, err
+        return line, nil
     }
 
-    file, _ := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)    // Add file access mode.
-    defer file.Close()
+    // A file may have become a directory or the other way around
+    if f, e := os.Stat(filePath); e == nil && f.IsDir() != isDirectory(fileMetaData) {
+        if err := os.Remove(filePath); err != nil {
+            log.Println("Cannot replace path: ", err)
+            return "", err
+        }
+        client.written.add(fileName)
+    }
 
-    hashStr := ""
-    var err error
-    for i, hash := range fileMetaData.BlockHashList {
-        var blockData Block
-        err = client.GetBlock(hash, &blockData)
+    if isDirectory(fileMetaData) {
+        err := os.MkdirAll(filePath, 0755)
         if err != nil {
-            log.Println("Get block failed: ", err)
+            log.Println("Cannot create directory: ", err)
+            return "", err
         }
+        client.written.add(fileName)
+        line := fileMetaData.Filename + "," + strconv.Itoa(fileMetaData.Version) + "," + directoryHash
+        return line, nil
+    }
 
-        data := string(blockData.BlockData)
+    dir := filepath.Dir(filePath)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        log.Println("Cannot create parent directory: ", err)
+        return "", err
+    }
+    mode := os.FileMode(0755)
+    if f, e := os.Stat(filePath); e == nil {
+        mode = f.Mode().Perm()
+    }
+    file, err := ioutil.TempFile(dir, "." + filepath.Base(filePath) + ".*" + downloadSuffix)
+    if err != nil {
+        log.Println("Open file Error: ", err)
+        return "", err
+    }
+    defer os.Remove(file.Name())
 
-        _, err = io.WriteString(file, data)
-        if err != nil {
-            log.Println("Write file failed: ", err)
-        }
+    hashList := fileMetaData.BlockHashList
+    err = writeBlocks(client, file, hashList)
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Chmod(file.Name(), mode)
+    }
+    if err == nil {
+        err = os.Rename(file.Name(), filePath)
+    }
+    if err != nil {
+        log.Println("Write file failed: ", err)
+        return "", err
+    }
+    client.written.add(fileName)
+    if f, e := os.Stat(filePath); e == nil && client.hashes != nil {
+        // Known content, the next sync need not hash it again
+        client.hashes.store(fileName, f, hashList)
+    }
+    hashStr := strings.Join(hashList, " ")
+    line := fileMetaData.Filename + "," + strconv.Itoa(fileMetaData.Version) + "," + hashStr
+    return line, nil
+}
 
-        hashStr += hash
-        if i != len(fileMetaData.BlockHashList) - 1 {
-            hashStr += " "
+/**
+* Fetch the blocks of hashList in batches and write them to file, stopping at the first
+* batch that fails, comes back short or does not match its hashes.
+*/
+func writeBlocks(client RPCClient, file *os.File, hashList []string) error {
+    for start := 0; start < len(hashList); start += client.blocksPerBatch() {
+        end := start + client.blocksPerBatch()
+        if end > len(hashList) {
+            end = len(hashList)
+        }
+        var blocks []Block
+        if err := client.GetBlocks(hashList[start:end], &blocks); err != nil {
+            log.Println("Get blocks failed: ", err)
+            return err
+        }
+        if len(blocks) != end - start {
+            return errors.New("Server returned " + strconv.Itoa(len(blocks)) + " of " + strconv.Itoa(end - start) + " blocks")
+        }
+        for i, blockData := range blocks {
+            if hashBlockData(blockData.BlockData) != hashList[start + i] {
+                return errors.New("Block " + hashList[start + i] + " does not match its hash")
+            }
+            if _, err := file.Write(blockData.BlockData); err != nil {
+                return err
+            }
         }
     }
-    line := fileMetaData.Filename + "," + strconv.Itoa(fileMetaData.Version) + "," + hashStr
-    return line, err
+    return nil
 }
 
 /**
@@ -412,10 +776,534 @@ func updateClientFile(client RPCClient, serverFileMetaData FileMetaData, indexMa
         log.Println("Download file from server failed: ", err)
     }
 
+    if line == "" {
+        // Nothing was written, keep the old record
+        return
+    }
     index := indexMap[serverFileMetaData.Filename]
     (*indexLines)[index] = line
 }
 
+/**
+* Remove a file that was deleted on the server and then purged from it, together with its
+* index record. A directory that still has files is kept and uploaded by the next sync.
+*/
+func removeExpiredFile(client RPCClient, fileName string, indexMap map[string]int, indexLines []string) {
+    err := os.Remove(localPath(client, fileName))
+    if err != nil && !os.IsNotExist(err) {
+        log.Println("Cannot remove file: ", err)
+        return
+    }
+    client.written.add(fileName)
+    indexLines[indexMap[fileName]] = ""
+}
+
+/**
+* Add local renames to the sync's commit as renames, so other clients move their copy instead of
+* downloading it again. A new file is taken as a rename of a file that vanished since the last
+* sync if it has the same content and the server still has the vanished file at the version in
+* the index. Renames the server refuses are committed as a deletion and a new file.
+*/
+func uploadRenames(indexFileInfoMap map[string]FileMetaData, clientFileInfoMap map[string]FileInfo, serverFileInfoMap map[string]FileMetaData, indexMap map[string]int, indexLines []string, renames *[]RenameArgs) {
+    vanished := make(map[string][]string)
+    for fileName, fileMetaData := range indexFileInfoMap {
+        if _, ok := clientFileInfoMap[fileName]; ok || !isRenameCandidate(fileMetaData) {
+            continue
+        }
+        serverFileMetaData, ok := serverFileInfoMap[fileName]
+        if !ok || serverFileMetaData.Version != fileMetaData.Version || !sameHashList(serverFileMetaData.BlockHashList, fileMetaData.BlockHashList) {
+            continue
+        }
+        key := strings.Join(fileMetaData.BlockHashList, " ")
+        vanished[key] = append(vanished[key], fileName)
+    }
+    if len(vanished) == 0 {
+        return
+    }
+    for _, fileNames := range vanished {
+        sort.Strings(fileNames)
+    }
+
+    for _, fileName := range sortedPathsChildrenFirst(clientFileInfoMap) {
+        info := clientFileInfoMap[fileName]
+        key := strings.Join(info.FileMetaData.BlockHashList, " ")
+        if info.Status != New || !isRenameCandidate(info.FileMetaData) || len(vanished[key]) == 0 {
+            continue
+        }
+        targetVersion := 0
+        if serverFileMetaData, ok := serverFileInfoMap[fileName]; ok {
+            if !isTombstone(serverFileMetaData) {
+                // Created elsewhere as well, resolved like any other new file
+                continue
+            }
+            targetVersion = serverFileMetaData.Version
+        }
+        source := vanished[key][0]
+        vanished[key] = vanished[key][1:]
+        sourceVersion := indexFileInfoMap[source].Version
+
+        *renames = append(*renames, RenameArgs{Source: source, SourceVersion: sourceVersion, Target: fileName, TargetVersion: targetVersion})
+        renamed := FileMetaData{Filename: fileName, Version: targetVersion + 1, BlockHashList: info.FileMetaData.BlockHashList}
+        tombstone := FileMetaData{Filename: source, Version: sourceVersion + 1, BlockHashList: []string{tombstoneHash}}
+        clientFileInfoMap[fileName] = FileInfo{FileMetaData: renamed, Status: Unchanged}
+        serverFileInfoMap[fileName] = renamed
+        serverFileInfoMap[source] = tombstone
+        indexLines[indexMap[fileName]] = fileName + "," + strconv.Itoa(renamed.Version) + "," + key
+        indexLines[indexMap[source]] = source + "," + strconv.Itoa(tombstone.Version) + ",0"
+    }
+}
+
+/**
+* Move local files that were renamed on the server, instead of removing them and downloading
+* the new path. A file deleted on the server and unchanged here is moved to a path new to
+* this client with the same content.
+*/
+func applyRemoteRenames(client RPCClient, clientFileInfoMap map[string]FileInfo, serverFileInfoMap map[string]FileMetaData, indexMap map[string]int, indexLines *[]string) {
+    deleted := make(map[string][]string)
+    for fileName, info := range clientFileInfoMap {
+        serverFileMetaData, ok := serverFileInfoMap[fileName]
+        if !ok || info.Status != Unchanged || !isRenameCandidate(info.FileMetaData) ||
+            !isTombstone(serverFileMetaData) || serverFileMetaData.Version <= info.FileMetaData.Version {
+            continue
+        }
+        key := strings.Join(info.FileMetaData.BlockHashList, " ")
+        deleted[key] = append(deleted[key], fileName)
+    }
+    if len(deleted) == 0 {
+        return
+    }
+    for _, fileNames := range deleted {
+        sort.Strings(fileNames)
+    }
+
+    for _, fileName := range sortedPathsChildrenFirst(serverFileInfoMap) {
+        serverFileMetaData := serverFileInfoMap[fileName]
+        key := strings.Join(serverFileMetaData.BlockHashList, " ")
+        if _, ok := clientFileInfoMap[fileName]; ok || !isRenameCandidate(serverFileMetaData) || len(deleted[key]) == 0 || !validRelativePath(fileName) {
+            continue
+        }
+        if index, ok := indexMap[fileName]; ok && encode((*indexLines)[index]).Version > serverFileMetaData.Version {
+            // Deleted here after the rename, the deletion is uploaded
+            continue
+        }
+        source := deleted[key][0]
+        deleted[key] = deleted[key][1:]
+
+        filePath := localPath(client, fileName)
+        if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+            log.Println("Cannot create parent directory: ", err)
+            continue
+        }
+        if err := os.Rename(localPath(client, source), filePath); err != nil {
+            log.Println("Moving renamed file failed: ", err)
+            continue
+        }
+        client.written.add(source)
+        client.written.add(fileName)
+        line := fileName + "," + strconv.Itoa(serverFileMetaData.Version) + "," + key
+        if index, ok := indexMap[fileName]; ok {
+            (*indexLines)[index] = line
+        } else {
+            *indexLines = append(*indexLines, line)
+            indexMap[fileName] = len(*indexLines) - 1
+        }
+        (*indexLines)[indexMap[source]] = source + "," + strconv.Itoa(serverFileInfoMap[source].Version) + ",0"
+        delete(clientFileInfoMap, source)
+        clientFileInfoMap[fileName] = FileInfo{FileMetaData: serverFileMetaData, Status: Unchanged}
+    }
+}
+
+/**
+* Only regular files with content are matched up as renames, any two empty files would match.
+*/
+func isRenameCandidate(fileMetaData FileMetaData) bool {
+    return len(fileMetaData.BlockHashList) > 0 && !isTombstone(fileMetaData) && !isDirectory(fileMetaData)
+}
+
+/**
+* Called before the server version replaces a local file that was edited since the last sync.
+* With MergeText, a text file is merged with the server version and the result uploaded, merged
+* is true then. Otherwise the local edits are renamed to a conflicted copy, which the next sync
+* uploads as a new file. Nothing is done if the local version is not a regular file or has the
+* same content as the server's. On error the local file must not be replaced.
+*/
+func resolveConflict(client RPCClient, localFileMetaData FileMetaData, serverFileMetaData FileMetaData, indexMap map[string]int, indexLines *[]string, commit *[]FileMetaData) (merged bool, err error) {
+    if isTombstone(localFileMetaData) || isDirectory(localFileMetaData) ||
+        sameHashList(localFileMetaData.BlockHashList, serverFileMetaData.BlockHashList) {
+        return false, nil
+    }
+    if client.MergeText && mergeConflict(client, localFileMetaData.Filename, serverFileMetaData, indexMap, indexLines, commit) {
+        return true, nil
+    }
+
+    copyName := conflictedCopyName(client, localFileMetaData.Filename, time.Now(), indexMap)
+    err = os.Rename(localPath(client, localFileMetaData.Filename), localPath(client, copyName))
+    if err != nil {
+        log.Println("Keeping conflicted copy failed: ", err)
+        return false, err
+    }
+    log.Println("Local edits conflict with the server, kept as: ", copyName)
+    return false, nil
+}
+
+/**
+* Three-way merge of a local text file with the server version, using the version recorded
+* in index.txt as the common ancestor, and upload of the result as the next version.
+* Returns false if the file can not be merged.
+*/
+func mergeConflict(client RPCClient, fileName string, serverFileMetaData FileMetaData, indexMap map[string]int, indexLines *[]string, commit *[]FileMetaData) bool {
+    baseFileMetaData, ok := recordedFileMetaData(client, fileName)
+    if !ok || isTombstone(baseFileMetaData) || isDirectory(baseFileMetaData) ||
+        isTombstone(serverFileMetaData) || isDirectory(serverFileMetaData) {
+        return false
+    }
+    filePath := localPath(client, fileName)
+    local, err := ioutil.ReadFile(filePath)
+    if err != nil || !isMergeableText(local) {
+        return false
+    }
+    base, err := readServerFile(client, baseFileMetaData.BlockHashList)
+    if err != nil {
+        log.Println("Reading the common ancestor failed: ", err)
+        return false
+    }
+    server, err := readServerFile(client, serverFileMetaData.BlockHashList)
+    if err != nil {
+        log.Println("Reading the server version failed: ", err)
+        return false
+    }
+    if !isMergeableText(base) || !isMergeableText(server) {
+        return false
+    }
+    merged, conflicts, ok := mergeText(base, local, server)
+    if !ok {
+        return false
+    }
+
+    if err := ioutil.WriteFile(filePath, merged, 0755); err != nil {
+        log.Println("Writing merged file failed: ", err)
+        return false
+    }
+    client.written.add(fileName)
+    if conflicts {
+        log.Println("Local edits merged with conflict markers: ", fileName)
+    } else {
+        log.Println("Local edits merged: ", fileName)
+    }
+    file, err := os.Open(filePath)
+    if err != nil {
+        log.Println("Open file Error: ", err)
+        return true
+    }
+    _, hashList := getHashList(client, file, serverFileMetaData)
+    file.Close()
+
+    mergedFileMetaData := FileMetaData{Filename: fileName, Version: serverFileMetaData.Version + 1, BlockHashList: hashList}
+    upload(client, mergedFileMetaData, commit)
+    (*indexLines)[indexMap[fileName]] = fileName + "," + strconv.Itoa(mergedFileMetaData.Version) + "," + strings.Join(hashList, " ")
+    return true
+}
+
+/**
+* The version of a file recorded in index.txt by the last sync. ClientSync only rewrites
+* index.txt once it is done.
+*/
+func recordedFileMetaData(client RPCClient, fileName string) (FileMetaData, bool) {
+    data, err := ioutil.ReadFile(client.BaseDir + "/index.txt")
+    if err != nil {
+        return FileMetaData{}, false
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+        if strings.HasPrefix(line, fileName + ",") {
+            if fileMetaData := encode(line); fileMetaData.Filename == fileName {
+                return fileMetaData, true
+            }
+        }
+    }
+    return FileMetaData{}, false
+}
+
+/**
+* The content of a file version, fetched from the server. Fails for files too large to merge.
+*/
+func readServerFile(client RPCClient, hashList []string) ([]byte, error) {
+    var data []byte
+    for start := 0; start < len(hashList); start += client.blocksPerBatch() {
+        end := start + client.blocksPerBatch()
+        if end > len(hashList) {
+            end = len(hashList)
+        }
+        var blocks []Block
+        if err := client.GetBlocks(hashList[start:end], &blocks); err != nil {
+            return nil, err
+        }
+        if len(blocks) != end - start {
+            return nil, errors.New("Server returned " + strconv.Itoa(len(blocks)) + " of " + strconv.Itoa(end - start) + " blocks")
+        }
+        for _, block := range blocks {
+            data = append(data, block.BlockData...)
+        }
+        if len(data) > maxMergeBytes {
+            return nil, errors.New("File is too large to merge")
+        }
+    }
+    return data, nil
+}
+
+/**
+* "dir/name (conflicted copy host 2006-01-02).ext", numbered if that is taken locally or
+* known from the index.
+*/
+func conflictedCopyName(client RPCClient, fileName string, now time.Time, indexMap map[string]int) string {
+    host, err := os.Hostname()
+    if err != nil || host == "" {
+        host = "unknown"
+    }
+    dir := ""
+    base := fileName
+    if slash := strings.LastIndex(fileName, "/"); slash >= 0 {
+        dir, base = fileName[:slash + 1], fileName[slash + 1:]
+    }
+    ext := filepath.Ext(base)
+    if ext == base {
+        // A dot file has no extension
+        ext = ""
+    }
+    stem := strings.TrimSuffix(base, ext)
+    label := "conflicted copy " + host + " " + now.Format("2006-01-02")
+
+    for i := 1; ; i++ {
+        copyName := dir + stem + " (" + label + ")" + ext
+        if i > 1 {
+            copyName = dir + stem + " (" + label + " " + strconv.Itoa(i) + ")" + ext
+        }
+        if _, known := indexMap[copyName]; known {
+            continue
+        }
+        if _, err := os.Lstat(localPath(client, copyName)); os.IsNotExist(err) {
+            return copyName
+        }
+    }
+}
+
+/**
+* The files the client keeps in the root of BaseDir, which are never synced.
+*/
+func isClientIndexFile(fileName string) bool {
+    return fileName == "index.txt" || fileName == serverIndexFileName || fileName == cursorFileName
+}
+
+/**
+* A temporary file of a download, possibly left behind by a crash.
+*/
+func isDownloadTempFile(fileName string) bool {
+    return strings.HasSuffix(fileName, downloadSuffix)
+}
+
+/**
+* Recursively list BaseDir. Keys are slash-separated paths relative to BaseDir,
+* directories are included and the client's index and temporary files are not.
+*/
+func scanBaseDir(baseDir string) (map[string]os.FileInfo, error) {
+    dirMap := make(map[string]os.FileInfo)
+    err := scanPath(baseDir, ".", dirMap)
+    return dirMap, err
+}
+
+/**
+* Add a path below baseDir and everything below it to dirMap, like scanBaseDir.
+*/
+func scanPath(baseDir string, fileName string, dirMap map[string]os.FileInfo) error {
+    return filepath.Walk(filepath.Join(baseDir, filepath.FromSlash(fileName)), func(path string, f os.FileInfo, err error) error {
+        if err != nil {
+            log.Println("Read client directory error: ", err)
+            return nil
+        }
+        relPath, err := filepath.Rel(baseDir, path)
+        if err != nil {
+            return err
+        }
+        fileName := filepath.ToSlash(relPath)
+        if fileName == "." || isClientIndexFile(fileName) || isDownloadTempFile(fileName) {
+            return nil
+        }
+        if !f.IsDir() && !f.Mode().IsRegular() {
+            // Symlinks, sockets etc. are not synced
+            return nil
+        }
+        dirMap[fileName] = f
+        return nil
+    })
+}
+
+/**
+* Remove a path and everything below it from dirMap.
+*/
+func removePath(dirMap map[string]os.FileInfo, fileName string) {
+    delete(dirMap, fileName)
+    for other := range dirMap {
+        if strings.HasPrefix(other, fileName + "/") {
+            delete(dirMap, other)
+        }
+    }
+}
+
+/**
+* Local path of a slash-separated file name.
+*/
+func localPath(client RPCClient, fileName string) string {
+    return filepath.Join(client.BaseDir, filepath.FromSlash(fileName))
+}
+
+/**
+* A file name from the server must stay inside BaseDir.
+*/
+func validRelativePath(fileName string) bool {
+    if fileName == "" || isClientIndexFile(fileName) || isDownloadTempFile(fileName) || strings.HasPrefix(fileName, "/") {
+        return false
+    }
+    for _, part := range strings.Split(fileName, "/") {
+        if part == "" || part == "." || part == ".." {
+            return false
+        }
+    }
+    return true
+}
+
+/**
+* Print the retained versions of a file on the server, newest first.
+*/
+func PrintFileHistory(client RPCClient, fileName string) error {
+    var versions []FileVersion
+    if err := client.GetFileHistory(fileName, &versions); err != nil {
+        return err
+    }
+    if len(versions) == 0 {
+        return errors.New("File not found: " + fileName)
+    }
+    for i := len(versions) - 1; i >= 0; i-- {
+        fileMetaData := versions[i].FileMetaData
+        state := strconv.Itoa(len(fileMetaData.BlockHashList)) + " blocks"
+        if isTombstone(fileMetaData) {
+            state = "deleted"
+        } else if isDirectory(fileMetaData) {
+            state = "directory"
+        }
+        stored := "unknown time"
+        if !versions[i].Time.IsZero() {
+            stored = versions[i].Time.Local().Format("2006-01-02 15:04:05")
+        }
+        fmt.Println("\t", fileMetaData.Version, stored, state)
+    }
+    return nil
+}
+
+/**
+* Print the snapshots on the server, oldest first.
+*/
+func PrintSnapshots(client RPCClient) error {
+    var succ bool
+    var snapshots []SnapshotInfo
+    if err := client.ListSnapshots(&succ, &snapshots); err != nil {
+        return err
+    }
+    for _, snapshot := range snapshots {
+        fmt.Println("\t", snapshot.Name, snapshot.Time.Local().Format("2006-01-02 15:04:05"), snapshot.Files, "files")
+    }
+    return nil
+}
+
+/**
+* Download the files of a snapshot into dir, which must be empty or not exist yet. BaseDir and
+* its index are not touched, dir must not be inside BaseDir.
+*/
+func MaterializeSnapshot(client RPCClient, name string, dir string) error {
+    if inside, err := isInsideDir(dir, client.BaseDir); err != nil || inside {
+        return errors.New("Cannot materialize a snapshot inside the base directory: " + dir)
+    }
+    if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+        return errors.New("Directory is not empty: " + dir)
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+
+    var files map[string]FileMetaData
+    if err := client.GetSnapshot(name, &files); err != nil {
+        return err
+    }
+    target := client
+    target.BaseDir = dir
+    paths := sortedPathsChildrenFirst(files)
+    // Parents first
+    for i := len(paths) - 1; i >= 0; i-- {
+        fileMetaData := files[paths[i]]
+        if isTombstone(fileMetaData) {
+            continue
+        }
+        if !validRelativePath(paths[i]) {
+            log.Println("Ignoring invalid path from server: ", paths[i])
+            continue
+        }
+        if _, err := download(target, paths[i], fileMetaData); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/**
+* Whether path is dir or below it.
+*/
+func isInsideDir(path string, dir string) (bool, error) {
+    absPath, err := filepath.Abs(path)
+    if err != nil {
+        return false, err
+    }
+    absDir, err := filepath.Abs(dir)
+    if err != nil {
+        return false, err
+    }
+    relPath, err := filepath.Rel(absDir, absPath)
+    if err != nil {
+        return false, nil
+    }
+    return relPath != ".." && !strings.HasPrefix(relPath, ".." + string(filepath.Separator)), nil
+}
+
+/**
+* Store an old version of a file as its next version on the server, then sync it down.
+*/
+func RestoreFile(client RPCClient, fileName string, version int) error {
+    var latestVersion int
+    err := client.RestoreFile(RestoreArgs{Filename: fileName, Version: version}, &latestVersion)
+    if err != nil {
+        return err
+    }
+    fmt.Println("Restored version", version, "of", fileName, "as version", latestVersion)
+    ClientSync(client)
+    return nil
+}
+
+/**
+* Sorted paths in reverse order, a directory is preceded by everything inside it.
+*/
+func sortedPathsChildrenFirst(fileMap interface{}) []string {
+    var paths []string
+    switch m := fileMap.(type) {
+    case map[string]FileInfo:
+        for path := range m {
+            paths = append(paths, path)
+        }
+    case map[string]FileMetaData:
+        for path := range m {
+            paths = append(paths, path)
+        }
+    }
+    sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+    return paths
+}
+
 /*
 * Helper function to print the contents of the metadata map.
 */
@@ -0,0 +1,404 @@
+package surfstore
+
+import (
+    "errors"
+    "io/ioutil"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/rpc"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+/**
+* Serve a Server on a free local port until the test ends, returns its address.
+*/
+func startTestServer(t *testing.T, server *Server) string {
+    t.Helper()
+    addr, _ := startStoppableTestServer(t, server)
+    return addr
+}
+
+/**
+* Like startTestServer, also returns a function that takes the server down earlier,
+* closing the connections clients still hold to it.
+*/
+func startStoppableTestServer(t *testing.T, server *Server) (string, func()) {
+    t.Helper()
+    inner, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // RPC connections are hijacked from the HTTP server, which no longer closes them
+    l := &trackingListener{Listener: inner}
+    rpcServer := rpc.NewServer()
+    if err := rpcServer.RegisterName("Server", server); err != nil {
+        t.Fatal(err)
+    }
+    mux := http.NewServeMux()
+    mux.Handle(rpc.DefaultRPCPath, rpcServer)
+    httpServer := &http.Server{Handler: mux}
+    go httpServer.Serve(l)
+    stop := func() {
+        httpServer.Close()
+        l.closeConns()
+    }
+    t.Cleanup(stop)
+    return l.Addr().String(), stop
+}
+
+type trackingListener struct {
+    net.Listener
+
+    mutex sync.Mutex
+    conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+    conn, err := l.Listener.Accept()
+    if err == nil {
+        l.mutex.Lock()
+        l.conns = append(l.conns, conn)
+        l.mutex.Unlock()
+    }
+    return conn, err
+}
+
+func (l *trackingListener) closeConns() {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    for _, conn := range l.conns {
+        conn.Close()
+    }
+    l.conns = nil
+}
+
+/**
+* A BlockStore that counts the block bytes it is sent.
+*/
+type countingBlockStore struct {
+    BlockStoreInterface
+
+    mutex    sync.Mutex
+    putBytes int
+}
+
+func (c *countingBlockStore) PutBlock(block Block, succ *bool) error {
+    c.count([]Block{block})
+    return c.BlockStoreInterface.PutBlock(block, succ)
+}
+
+func (c *countingBlockStore) PutBlocks(blocks []Block, succ *bool) error {
+    c.count(blocks)
+    return c.BlockStoreInterface.PutBlocks(blocks, succ)
+}
+
+func (c *countingBlockStore) count(blocks []Block) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    for _, block := range blocks {
+        c.putBytes += len(block.BlockData)
+    }
+}
+
+func (c *countingBlockStore) takeBytes() int {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    n := c.putBytes
+    c.putBytes = 0
+    return n
+}
+
+func TestSyncUploadsOnlyChangedBlocks(t *testing.T) {
+    const blockSize = 4096
+    const blocks = 256
+
+    blockStore := &countingBlockStore{BlockStoreInterface: &BlockStore{BlockMap: map[string]Block{}}}
+    server := NewSurfstoreServerWithStores(blockStore, NewMetaStore())
+    addr := startTestServer(t, &server)
+
+    baseDir := t.TempDir()
+    client := NewSurfstoreRPCClient(addr, baseDir, blockSize)
+    defer client.Close()
+
+    data := make([]byte, blocks * blockSize)
+    rand.New(rand.NewSource(1)).Read(data)
+    filePath := filepath.Join(baseDir, "large.bin")
+    if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    ClientSync(client)
+    if sent := blockStore.takeBytes(); sent != len(data) {
+        t.Fatalf("first sync sent %d bytes, want %d", sent, len(data))
+    }
+
+    data[len(data) / 2]++
+    if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    ClientSync(client)
+    if sent := blockStore.takeBytes(); sent != blockSize {
+        t.Fatalf("one byte edit sent %d bytes, want one block of %d", sent, blockSize)
+    }
+
+    // The server has the edited version
+    otherDir := t.TempDir()
+    other := NewSurfstoreRPCClient(addr, otherDir, blockSize)
+    defer other.Close()
+    ClientSync(other)
+    got, err := ioutil.ReadFile(filepath.Join(otherDir, "large.bin"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(got) != string(data) {
+        t.Fatal("downloaded file differs from the edited one")
+    }
+}
+
+/**
+* A BlockStore that can be told to drop the last block of every GetBlocks reply.
+*/
+type shortBlockStore struct {
+    BlockStoreInterface
+
+    mutex sync.Mutex
+    short bool
+}
+
+func (s *shortBlockStore) GetBlocks(blockHashes []string, blocks *[]Block) error {
+    if err := s.BlockStoreInterface.GetBlocks(blockHashes, blocks); err != nil {
+        return err
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.short && len(*blocks) > 0 {
+        *blocks = (*blocks)[:len(*blocks) - 1]
+    }
+    return nil
+}
+
+func (s *shortBlockStore) setShort(short bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.short = short
+}
+
+func TestFailedDownloadKeepsFileAndIndex(t *testing.T) {
+    const blockSize = 1024
+    blockStore := &shortBlockStore{BlockStoreInterface: &BlockStore{BlockMap: map[string]Block{}}}
+    server := NewSurfstoreServerWithStores(blockStore, NewMetaStore())
+    addr := startTestServer(t, &server)
+
+    dirA, dirB := t.TempDir(), t.TempDir()
+    a := NewSurfstoreRPCClient(addr, dirA, blockSize)
+    defer a.Close()
+    b := NewSurfstoreRPCClient(addr, dirB, blockSize)
+    defer b.Close()
+
+    v1 := make([]byte, 4 * blockSize)
+    rand.New(rand.NewSource(1)).Read(v1)
+    if err := ioutil.WriteFile(filepath.Join(dirA, "f"), v1, 0644); err != nil {
+        t.Fatal(err)
+    }
+    ClientSync(a)
+    ClientSync(b)
+    indexV1, err := ioutil.ReadFile(filepath.Join(dirB, "index.txt"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    v2 := append([]byte(nil), v1...)
+    v2[0]++
+    v2[len(v2) - 1]++
+    if err := ioutil.WriteFile(filepath.Join(dirA, "f"), v2, 0644); err != nil {
+        t.Fatal(err)
+    }
+    ClientSync(a)
+
+    blockStore.setShort(true)
+    ClientSync(b)
+    got, err := ioutil.ReadFile(filepath.Join(dirB, "f"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(got) != string(v1) {
+        t.Fatal("A failed download changed the local file")
+    }
+    index, err := ioutil.ReadFile(filepath.Join(dirB, "index.txt"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(index) != string(indexV1) {
+        t.Fatalf("A failed download changed index.txt to %q", index)
+    }
+    entries, err := ioutil.ReadDir(dirB)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, entry := range entries {
+        if isDownloadTempFile(entry.Name()) {
+            t.Fatal("Temporary file left behind: ", entry.Name())
+        }
+    }
+
+    blockStore.setShort(false)
+    ClientSync(b)
+    got, err = ioutil.ReadFile(filepath.Join(dirB, "f"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(got) != string(v2) {
+        t.Fatal("The next sync did not download the file")
+    }
+}
+
+/**
+* A MetaStore whose commits can be made to fail.
+*/
+type failingCommitMetaStore struct {
+    *MetaStore
+
+    mutex sync.Mutex
+    fail  bool
+}
+
+func (m *failingCommitMetaStore) CommitFiles(args CommitArgs, latestVersions *[]int) error {
+    m.mutex.Lock()
+    fail := m.fail
+    m.mutex.Unlock()
+    if fail {
+        return errors.New("commit failed")
+    }
+    return m.MetaStore.CommitFiles(args, latestVersions)
+}
+
+func (m *failingCommitMetaStore) setFail(fail bool) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    m.fail = fail
+}
+
+func writeTestFile(t *testing.T, path string, data string) {
+    t.Helper()
+    if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestPurgedDeletionsFoundWithoutServerIndex(t *testing.T) {
+    metaStore := &failingCommitMetaStore{MetaStore: NewMetaStore()}
+    server := NewSurfstoreServerWithStores(&BlockStore{BlockMap: map[string]Block{}}, metaStore)
+    addr := startTestServer(t, &server)
+
+    dirA, dirB := t.TempDir(), t.TempDir()
+    a := NewSurfstoreRPCClient(addr, dirA, 1024)
+    defer a.Close()
+    b := NewSurfstoreRPCClient(addr, dirB, 1024)
+    defer b.Close()
+
+    writeTestFile(t, filepath.Join(dirA, "deleted"), "deleted elsewhere")
+    ClientSync(a)
+    ClientSync(b)
+
+    // A new file of B that the server does not take
+    writeTestFile(t, filepath.Join(dirB, "new"), "not committed yet")
+    metaStore.setFail(true)
+    ClientSync(b)
+    metaStore.setFail(false)
+
+    // B loses its copy of the server index while A deletes a file the server then forgets
+    for _, name := range []string{serverIndexFileName, cursorFileName} {
+        if err := os.Remove(filepath.Join(dirB, name)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := os.Remove(filepath.Join(dirA, "deleted")); err != nil {
+        t.Fatal(err)
+    }
+    ClientSync(a)
+    if n, err := metaStore.PurgeTombstones(time.Now()); err != nil || n != 1 {
+        t.Fatalf("Purged %d tombstones: %v", n, err)
+    }
+
+    ClientSync(b)
+    if _, err := os.Stat(filepath.Join(dirB, "deleted")); !os.IsNotExist(err) {
+        t.Fatal("The file deleted on the server is still there: ", err)
+    }
+    if _, err := os.Stat(filepath.Join(dirB, "new")); err != nil {
+        t.Fatal("The uncommitted new file was removed: ", err)
+    }
+    var succ bool
+    var files map[string]FileMetaData
+    if err := metaStore.GetFileInfoMap(&succ, &files); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := files["deleted"]; ok {
+        t.Fatal("The deleted file was uploaded again")
+    }
+    if _, ok := files["new"]; !ok {
+        t.Fatal("The new file was not uploaded")
+    }
+}
+
+/**
+* A MetaStore that counts the renames it is sent outside of a commit.
+*/
+type renameCountingMetaStore struct {
+    *failingCommitMetaStore
+
+    mutex   sync.Mutex
+    renames int
+}
+
+func (m *renameCountingMetaStore) RenameFile(args RenameArgs, latestVersion *int) error {
+    m.mutex.Lock()
+    m.renames++
+    m.mutex.Unlock()
+    return m.failingCommitMetaStore.RenameFile(args, latestVersion)
+}
+
+func TestRenameIsCommittedWithOtherChanges(t *testing.T) {
+    metaStore := &renameCountingMetaStore{failingCommitMetaStore: &failingCommitMetaStore{MetaStore: NewMetaStore()}}
+    server := NewSurfstoreServerWithStores(&BlockStore{BlockMap: map[string]Block{}}, metaStore)
+    addr := startTestServer(t, &server)
+
+    dir := t.TempDir()
+    client := NewSurfstoreRPCClient(addr, dir, 1024)
+    defer client.Close()
+    writeTestFile(t, filepath.Join(dir, "old"), "renamed content")
+    writeTestFile(t, filepath.Join(dir, "other"), "v1")
+    ClientSync(client)
+
+    if err := os.Rename(filepath.Join(dir, "old"), filepath.Join(dir, "new")); err != nil {
+        t.Fatal(err)
+    }
+    writeTestFile(t, filepath.Join(dir, "other"), "v2")
+
+    // Neither the rename nor the edit reaches the server alone
+    metaStore.setFail(true)
+    ClientSync(client)
+    metaStore.setFail(false)
+    var succ bool
+    var files map[string]FileMetaData
+    if err := metaStore.GetFileInfoMap(&succ, &files); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := files["new"]; ok || isTombstone(files["old"]) || files["other"].Version != 1 {
+        t.Fatalf("A failed commit changed the server: %v", files)
+    }
+
+    ClientSync(client)
+    if err := metaStore.GetFileInfoMap(&succ, &files); err != nil {
+        t.Fatal(err)
+    }
+    if !isTombstone(files["old"]) || files["new"].Version != 1 || files["other"].Version != 2 {
+        t.Fatalf("Server has %v", files)
+    }
+    if metaStore.renames != 0 {
+        t.Fatal("The rename was sent outside of the commit")
+    }
+}
@@ -1,16 +1,109 @@
 package surfstore
 
+import (
+    "time"
+)
+
 type Block struct {
     BlockData []byte
     BlockSize int
 }
 
+// Identifies shard Index of the erasure coded block BlockHash
+type ShardKey struct {
+    BlockHash string
+    Index     int
+}
+
+// One shard of an erasure coded block, BlockSize is the size of the whole block
+type Shard struct {
+    ShardKey
+    BlockSize int
+    Data      []byte
+}
+
 type FileMetaData struct {
     Filename      string
     Version       int
     BlockHashList []string
 }
 
+// Position in the change history of a MetaStore
+type ChangeCursor struct {
+    Epoch    string
+    Sequence int
+}
+
+type ChangesArgs struct {
+    Cursor ChangeCursor
+    // Maximum number of changes to return, 0 means DefaultChangesPageSize
+    Limit int
+}
+
+type ChangesReply struct {
+    // Files changed after the cursor, in the order of their last change
+    Changes []FileMetaData
+    // Where the next call continues
+    Cursor ChangeCursor
+    // More changes follow, call again with Cursor
+    More bool
+    // The cursor was not valid, Changes start from the beginning of the history
+    Reset bool
+    // Deleted files were purged after the cursor, so a file missing from the changes may
+    // have been deleted. Reset is set as well.
+    Expired bool
+}
+
+// One version of a file in its history
+type FileVersion struct {
+    FileMetaData FileMetaData
+    // When the version was stored, zero if that is not known
+    Time time.Time
+}
+
+// An immutable copy of all files of a MetaStore
+type NamespaceSnapshot struct {
+    Name  string
+    Time  time.Time
+    Files map[string]FileMetaData
+}
+
+// A snapshot as listed, without its files
+type SnapshotInfo struct {
+    Name string
+    Time time.Time
+    // Number of files, including deleted ones
+    Files int
+}
+
+type RestoreArgs struct {
+    Filename string
+    // Version in the file's history to store again
+    Version int
+}
+
+type RenameArgs struct {
+    Source string
+    // Version of Source the client has
+    SourceVersion int
+    Target string
+    // Version of Target the client has, 0 if it does not know the file
+    TargetVersion int
+}
+
+type CommitArgs struct {
+    // New versions of files
+    Files []FileMetaData
+    // Files moved to a new path, committed together with Files
+    Renames []RenameArgs
+}
+
+type WaitArgs struct {
+    Cursor ChangeCursor
+    // How long to wait for a change, 0 means DefaultWaitTimeout
+    Timeout time.Duration
+}
+
 type Surfstore interface {
     MetaStoreInterface
     BlockStoreInterface
@@ -22,6 +115,30 @@ type MetaStoreInterface interface {
 
     // Update a file's fileinfo entry
     UpdateFile(fileMetaData *FileMetaData, latestVersion *int) (err error)
+
+    // Update several files' fileinfo entries and rename files, all or none of them
+    CommitFiles(args CommitArgs, latestVersions *[]int) error
+
+    // Retrieves the entries changed after a cursor, one page at a time
+    GetChangesSince(args ChangesArgs, reply *ChangesReply) error
+
+    // Retrieves the retained versions of a file, oldest first
+    GetFileHistory(fileName string, versions *[]FileVersion) error
+
+    // Store an old version of a file as its next version
+    RestoreFile(args RestoreArgs, latestVersion *int) error
+
+    // Move a file to a new path, checking the versions of both
+    RenameFile(args RenameArgs, latestVersion *int) error
+
+    // Create an immutable snapshot of all files
+    CreateSnapshot(name string, succ *bool) error
+
+    // Retrieves the snapshots, oldest first
+    ListSnapshots(_ignore *bool, snapshots *[]SnapshotInfo) error
+
+    // Retrieves the files of a snapshot
+    GetSnapshot(name string, files *map[string]FileMetaData) error
 }
 
 type BlockStoreInterface interface {
@@ -34,4 +151,67 @@ type BlockStoreInterface interface {
 
     // Check if certain blocks are alredy present on the server
     HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error
+
+    // Get blocks based on their hashes, in order. A server may return only a prefix
+    // of the requested blocks if they do not fit in one batch
+    GetBlocks(blockHashes []string, blocks *[]Block) error
+
+    // Put many blocks at once
+    PutBlocks(blocks []Block, succ *bool) error
+}
+
+// Implemented by metadata services that can block until the metadata changes
+type ChangeWatcher interface {
+    // Like GetChangesSince, but waits up to args.Timeout for a change after the cursor
+    // instead of returning an empty page
+    WaitForChanges(args WaitArgs, reply *ChangesReply) error
+}
+
+// Implemented by metadata stores that can notify about their changes
+type ChangeNotifier interface {
+    // Returns a channel that is closed by the next change
+    ChangeSignal() <-chan struct{}
+}
+
+// Implemented by metadata stores that can forget deleted files
+type TombstonePurger interface {
+    // Remove the entries of files deleted before cutoff, returns how many were removed
+    PurgeTombstones(cutoff time.Time) (int, error)
+}
+
+// Implemented by metadata stores that can report which blocks they still need
+type BlockReferencer interface {
+    // Returns the set of block hashes referenced by any live or retained file version of the
+    // committed metadata, or an error if this store cannot vouch for it being current
+    ReferencedBlocks() (map[string]bool, error)
+}
+
+// Implemented by block stores that can reclaim unreferenced blocks
+type BlockSweeper interface {
+    // Remove blocks not in live that have not been put or referenced since cutoff
+    SweepBlocks(live map[string]bool, cutoff time.Time) (int, error)
+}
+
+// Implemented by block stores that can enumerate their blocks
+type BlockLister interface {
+    // Returns the hashes of all stored blocks, sorted
+    ListBlocks() ([]string, error)
+
+    // Returns a number that changes whenever a block is stored or removed
+    Generation() int
+}
+
+// Implemented by block stores that can hold the shards of erasure coded blocks
+type ShardStore interface {
+    // Store shards
+    PutShards(shards []Shard, succ *bool) error
+
+    // Get shards in order, a missing shard has no Data
+    GetShards(keys []ShardKey, shards *[]Shard) error
+
+    // Returns the subset of keys that are stored
+    HasShards(keysIn []ShardKey, keysOut *[]ShardKey) error
+
+    // Returns the keys of all stored shards
+    ListShards() ([]ShardKey, error)
 }
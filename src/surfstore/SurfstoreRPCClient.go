@@ -1,6 +1,7 @@
 package surfstore
 
 import (
+    "errors"
     "net/rpc"
 )
 
@@ -8,81 +9,270 @@ type RPCClient struct {
     ServerAddr string
     BaseDir    string
     BlockSize  int
+
+    // Maximum block payload of one GetBlocks or PutBlocks call
+    MaxBatchBytes int
+
+    // How files are cut into blocks, fixed BlockSize chunks by default
+    Chunking ChunkingConfig
+
+    // Merge text files edited on both sides instead of keeping a conflicted copy
+    MergeText bool
+
+    // Metadata servers of a Raft cluster, empty means ServerAddr serves the metadata
+    MetaAddrs []string
+
+    // Block servers sharded by hash, empty means ServerAddr stores the blocks
+    BlockAddrs []string
+
+    // Shared by all copies of the client, nil means dial per call.
+    pool   *connPool
+    meta   *metaRouter
+    blocks *blockRouter
+    // Hash lists of unchanged files, set by the daemon while it watches BaseDir
+    hashes *hashCache
+    // Paths a sync wrote itself, set by the daemon to tell them from the user's changes
+    written *pathSet
 }
 
 func (surfClient *RPCClient) GetBlock(blockHash string, block *Block) error {
-    // connect to the server
-    conn, e := rpc.DialHTTP("tcp", surfClient.ServerAddr)
-    if e != nil {
-        return e
+    if surfClient.blocks != nil {
+        return surfClient.blocks.GetBlock(blockHash, block)
     }
+    return surfClient.call("Server.GetBlock", blockHash, block)
+}
 
-    // perform the call
-    e = conn.Call("Server.GetBlock", blockHash, block)
-    if e != nil {
-        conn.Close()
-        return e
+func (surfClient *RPCClient) PutBlock(block Block, succ *bool) error {
+    if surfClient.blocks != nil {
+        return surfClient.blocks.PutBlock(block, succ)
     }
+    return surfClient.call("Server.PutBlock", block, succ)
+}
 
-    // close the connection
-    return conn.Close()
+func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error {
+    if surfClient.blocks != nil {
+        return surfClient.blocks.HasBlocks(blockHashesIn, blockHashesOut)
+    }
+    return surfClient.call("Server.HasBlocks", blockHashesIn, blockHashesOut)
 }
 
-func (surfClient *RPCClient) PutBlock(block Block, succ *bool) error {
-    // connect to the server
-    conn, e := rpc.DialHTTP("tcp", surfClient.ServerAddr)
-    if e != nil {
-        return e
+/**
+* Fetch all requested blocks, in as many batches as the server needs.
+*/
+func (surfClient *RPCClient) GetBlocks(blockHashes []string, blocks *[]Block) error {
+    if surfClient.blocks != nil {
+        return surfClient.blocks.GetBlocks(blockHashes, blocks)
     }
+    return getBlocksBatched(surfClient.call, blockHashes, blocks)
+}
 
-    // perform the call
-    e = conn.Call("Server.PutBlock", block, succ)
-    if e != nil {
-        conn.Close()
-        return e
+/**
+* Upload blocks in batches of at most MaxBatchBytes, a larger block is sent on its own.
+*/
+func (surfClient *RPCClient) PutBlocks(blocks []Block, succ *bool) error {
+    if surfClient.blocks != nil {
+        return surfClient.blocks.PutBlocks(blocks, surfClient.maxBatchBytes(), succ)
     }
+    return putBlocksBatched(surfClient.call, blocks, surfClient.maxBatchBytes(), succ)
+}
 
-    // close the connection
-    return conn.Close()
+func (surfClient *RPCClient) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
+    return surfClient.callMeta("Server.GetFileInfoMap", succ, serverFileInfoMap)
 }
 
-func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error {
-    // connect to the server
-    conn, e := rpc.DialHTTP("tcp", surfClient.ServerAddr)
-    if e != nil {
-        return e
+func (surfClient *RPCClient) GetChangesSince(args ChangesArgs, reply *ChangesReply) error {
+    return surfClient.callMeta("Server.GetChangesSince", args, reply)
+}
+
+func (surfClient *RPCClient) GetFileHistory(fileName string, versions *[]FileVersion) error {
+    return surfClient.callMeta("Server.GetFileHistory", fileName, versions)
+}
+
+/**
+* A version conflict means the file changed while it was restored, it is returned as
+* *VersionConflictError.
+*/
+func (surfClient *RPCClient) RestoreFile(args RestoreArgs, latestVersion *int) error {
+    return surfClient.callMeta("Server.RestoreFile", args, latestVersion)
+}
+
+/**
+* A version mismatch of either path is returned as *VersionConflictError.
+*/
+func (surfClient *RPCClient) RenameFile(args RenameArgs, latestVersion *int) error {
+    return surfClient.callMeta("Server.RenameFile", args, latestVersion)
+}
+
+func (surfClient *RPCClient) CreateSnapshot(name string, succ *bool) error {
+    return surfClient.callMeta("Server.CreateSnapshot", name, succ)
+}
+
+func (surfClient *RPCClient) ListSnapshots(succ *bool, snapshots *[]SnapshotInfo) error {
+    return surfClient.callMeta("Server.ListSnapshots", succ, snapshots)
+}
+
+func (surfClient *RPCClient) GetSnapshot(name string, files *map[string]FileMetaData) error {
+    return surfClient.callMeta("Server.GetSnapshot", name, files)
+}
+
+/**
+* Blocks on the server until a file changes after args.Cursor or args.Timeout passes.
+*/
+func (surfClient *RPCClient) WaitForChanges(args WaitArgs, reply *ChangesReply) error {
+    return surfClient.callMeta("Server.WaitForChanges", args, reply)
+}
+
+var errWaitStopped = errors.New("Waiting for changes was stopped")
+
+/**
+* WaitForChanges on a connection of its own, which is closed as soon as stop is closed
+* instead of waiting for the server to answer. Returns errWaitStopped then.
+*/
+func (surfClient *RPCClient) waitForChangesUntil(args WaitArgs, reply *ChangesReply, stop <-chan struct{}) error {
+    addr := surfClient.ServerAddr
+    if surfClient.meta != nil {
+        addr, _ = surfClient.meta.current()
     }
+    conn, err := rpc.DialHTTP("tcp", addr)
+    if err != nil {
+        if surfClient.meta != nil {
+            surfClient.meta.redirect(addr, "")
+        }
+        return err
+    }
+    defer conn.Close()
 
-    // perform the call
-    e = conn.Call("Server.HasBlocks", blockHashesIn, blockHashesOut)
-    if e != nil {
+    call := conn.Go("Server.WaitForChanges", args, reply, make(chan *rpc.Call, 1))
+    select {
+    case <-call.Done:
+    case <-stop:
+        // Closing the connection ends the call
         conn.Close()
-        return e
+        <-call.Done
+        return errWaitStopped
+    }
+    err = decodeRPCError(call.Error)
+    if surfClient.meta != nil {
+        if notLeader, ok := err.(*NotLeaderError); ok {
+            surfClient.meta.redirect(addr, notLeader.Leader)
+        } else if err != nil && isConnError(err) {
+            surfClient.meta.redirect(addr, "")
+        }
     }
+    return err
+}
 
-    // close the connection
-    return conn.Close()
+/**
+* A version mismatch is returned as *VersionConflictError and latestVersion is set to the
+* server's version.
+*/
+func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) error {
+    err := surfClient.callMeta("Server.UpdateFile", fileMetaData, latestVersion)
+    if conflict, ok := err.(*VersionConflictError); ok {
+        *latestVersion = conflict.Version
+    }
+    return err
 }
 
-func (surfClient *RPCClient) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
-    // connect to the server
-    conn, e := rpc.DialHTTP("tcp", surfClient.ServerAddr)
-    if e != nil {
-        return e
+/**
+* A version mismatch of any of the files or rename paths is returned as *VersionConflictError,
+* none of them is updated or renamed then.
+*/
+func (surfClient *RPCClient) CommitFiles(args CommitArgs, latestVersions *[]int) error {
+    return surfClient.callMeta("Server.CommitFiles", args, latestVersions)
+}
+
+/**
+* Send metadata calls to a Raft cluster instead of ServerAddr.
+* Calls go to the leader, following redirects from followers.
+*/
+func (surfClient *RPCClient) UseMetaCluster(addrs []string) {
+    surfClient.MetaAddrs = addrs
+    surfClient.meta = newMetaRouter(addrs)
+}
+
+/**
+* Spread blocks over several block servers instead of storing them on ServerAddr.
+* Each block goes to the server that owns its hash on a consistent hash ring, and to the
+* next servers on the ring if the cluster keeps more than one copy. With erasure coding
+* the shards of a block go to that many consecutive servers instead. The replication
+* settings are those of the servers, writeQuorum overrides their default quorum if not 0.
+*/
+func (surfClient *RPCClient) UseBlockCluster(addrs []string, writeQuorum int) error {
+    replication, err := fetchReplicationConfig(addrs)
+    if err != nil {
+        return err
+    }
+    replication.WriteQuorum = writeQuorum
+    blocks, err := newBlockRouter(addrs, replication)
+    if err != nil {
+        return err
     }
+    surfClient.BlockAddrs = addrs
+    surfClient.blocks = blocks
+    return nil
+}
 
-    // perform the call
-    e = conn.Call("Server.GetFileInfoMap", succ, serverFileInfoMap)
-    if e != nil {
-        conn.Close()
-        return e
+/**
+* Close the pooled connections to the servers.
+*/
+func (surfClient *RPCClient) Close() error {
+    if surfClient.meta != nil {
+        surfClient.meta.Close()
+    }
+    if surfClient.blocks != nil {
+        surfClient.blocks.Close()
+    }
+    if surfClient.pool == nil {
+        return nil
     }
+    return surfClient.pool.Close()
+}
 
-    // close the connection
-    return conn.Close()
+/**
+* Perform a metadata RPC call, on the metadata cluster if there is one.
+* Typed errors are decoded.
+*/
+func (surfClient *RPCClient) callMeta(serviceMethod string, args interface{}, reply interface{}) error {
+    if surfClient.meta != nil {
+        return surfClient.meta.call(serviceMethod, args, reply)
+    }
+    return decodeRPCError(surfClient.call(serviceMethod, args, reply))
 }
 
-func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) error {
+/**
+* Number of blocks of the expected block size that fit in one batch.
+*/
+func (surfClient *RPCClient) blocksPerBatch() int {
+    blockSize := surfClient.BlockSize
+    if surfClient.Chunking.Mode == CDCChunking && surfClient.Chunking.AvgSize > 0 {
+        blockSize = surfClient.Chunking.AvgSize
+    }
+    if blockSize <= 0 {
+        return 1
+    }
+    n := surfClient.maxBatchBytes() / blockSize
+    if n < 1 {
+        return 1
+    }
+    return n
+}
+
+func (surfClient *RPCClient) maxBatchBytes() int {
+    if surfClient.MaxBatchBytes <= 0 {
+        return DefaultMaxBatchBytes
+    }
+    return surfClient.MaxBatchBytes
+}
+
+/**
+* Perform an RPC call, on a pooled connection if the client has a pool.
+*/
+func (surfClient *RPCClient) call(serviceMethod string, args interface{}, reply interface{}) error {
+    if surfClient.pool != nil {
+        return surfClient.pool.call(serviceMethod, args, reply)
+    }
+
     // connect to the server
     conn, e := rpc.DialHTTP("tcp", surfClient.ServerAddr)
     if e != nil {
@@ -90,7 +280,7 @@ func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersio
     }
 
     // perform the call
-    e = conn.Call("Server.UpdateFile", fileMetaData, latestVersion)
+    e = conn.Call(serviceMethod, args, reply)
     if e != nil {
         conn.Close()
         return e
@@ -100,14 +290,57 @@ func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersio
     return conn.Close()
 }
 
+type rpcCaller func(serviceMethod string, args interface{}, reply interface{}) error
+
+/**
+* Fetch blocks from one server, in as many batches as the server needs.
+*/
+func getBlocksBatched(call rpcCaller, blockHashes []string, blocks *[]Block) error {
+    for len(blockHashes) > 0 {
+        var batch []Block
+        err := call("Server.GetBlocks", blockHashes, &batch)
+        if err != nil {
+            return err
+        }
+        if len(batch) == 0 {
+            return errors.New("Server returned an empty batch")
+        }
+        *blocks = append(*blocks, batch...)
+        blockHashes = blockHashes[len(batch):]
+    }
+    return nil
+}
+
+/**
+* Upload blocks to one server in batches of at most maxBatchBytes.
+*/
+func putBlocksBatched(call rpcCaller, blocks []Block, maxBatchBytes int, succ *bool) error {
+    for len(blocks) > 0 {
+        n, size := 0, 0
+        for n < len(blocks) && (n == 0 || size + len(blocks[n].BlockData) <= maxBatchBytes) {
+            size += len(blocks[n].BlockData)
+            n++
+        }
+        err := call("Server.PutBlocks", blocks[:n], succ)
+        if err != nil {
+            return err
+        }
+        blocks = blocks[n:]
+    }
+    return nil
+}
+
 var _ Surfstore = new(RPCClient)
+var _ ChangeWatcher = new(RPCClient)
 
 // Create an Surfstore RPC client
 func NewSurfstoreRPCClient(hostPort, baseDir string, blockSize int) RPCClient {
 
     return RPCClient{
-        ServerAddr: hostPort,
-        BaseDir:    baseDir,
-        BlockSize:  blockSize,
+        ServerAddr:    hostPort,
+        BaseDir:       baseDir,
+        BlockSize:     blockSize,
+        MaxBatchBytes: DefaultMaxBatchBytes,
+        pool:          newConnPool(hostPort, DefaultMaxIdleConns),
     }
 }
@@ -1,104 +1,531 @@
 package surfstore
 
 import (
-    "log"
+    "errors"
     "net"
     "net/http"
     "net/rpc"
+    "path/filepath"
+    "strconv"
     "sync"
+    "time"
+)
+
+const (
+    // Default upper bound on the block payload of one GetBlocks or PutBlocks call.
+    DefaultMaxBatchBytes = 4 * 1024 * 1024
+
+    // Wait of a WaitForChanges call that does not set a timeout
+    DefaultWaitTimeout = 30 * time.Second
+    // Longer waits are cut short, the client simply calls again
+    MaxWaitTimeout = 5 * time.Minute
 )
 
 type Server struct {
     BlockStore BlockStoreInterface
     MetaStore  MetaStoreInterface
+    // Guards the BlockStore
     Mutex      *sync.RWMutex
+    // Guards the MetaStore, see lockMeta
+    metaMutex *sync.RWMutex
+
+    // Maximum block payload of one batch call, 0 means DefaultMaxBatchBytes
+    MaxBatchBytes int
+    // Maximum size of a single block, 0 means no limit
+    MaxBlockSize int
+
+    // How the block cluster this server belongs to protects blocks, clients fetch it with
+    // GetReplicationConfig. An erasure coded cluster only accepts shards, any other only blocks.
+    Replication ReplicationConfig
+
+    // Metadata servers whose files reference the blocks of this server, asked by the garbage
+    // collector for the live blocks. Empty means the MetaStore of this server.
+    GCMetaAddrs []string
+
+    // Replicator of the block cluster this server belongs to, nil if none
+    replicator *blockReplicator
 }
 
 func (s *Server) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
-    s.Mutex.RLock()
+    logDebug("GetFileInfoMap")
+    unlock := s.lockMeta(false)
     defer func() {
-        s.Mutex.RUnlock()
+        unlock()
     }()
     err := s.MetaStore.GetFileInfoMap(succ, serverFileInfoMap)
     if err != nil {
-        log.Println("GetFileInfoMap Error: ", err)
+        logError("GetFileInfoMap Error: ", err)
     }
     return err
 }
 
 func (s *Server) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) error {
-    s.Mutex.Lock()
+    logDebug("UpdateFile: ", fileMetaData.Filename, fileMetaData.Version)
+    unlock := s.lockMeta(true)
     defer func() {
-        s.Mutex.Unlock()
+        unlock()
     }()
     err := s.MetaStore.UpdateFile(fileMetaData, latestVersion)
     if err != nil {
-        log.Println("UpdateFile Error: ", err)
+        logError("UpdateFile Error: ", err)
+    }
+    return err
+}
+
+func (s *Server) CommitFiles(args CommitArgs, latestVersions *[]int) error {
+    logDebug("CommitFiles: ", len(args.Files), len(args.Renames))
+    unlock := s.lockMeta(true)
+    defer func() {
+        unlock()
+    }()
+    err := s.MetaStore.CommitFiles(args, latestVersions)
+    if err != nil {
+        logError("CommitFiles Error: ", err)
+    }
+    return err
+}
+
+/**
+* Returns one page of the files changed after a cursor.
+* Takes the write lock, the MetaStore may rebuild its change index.
+*/
+func (s *Server) GetChangesSince(args ChangesArgs, reply *ChangesReply) error {
+    logDebug("GetChangesSince: ", args.Cursor.Epoch, args.Cursor.Sequence)
+    unlock := s.lockMeta(true)
+    defer func() {
+        unlock()
+    }()
+    err := s.MetaStore.GetChangesSince(args, reply)
+    if err != nil {
+        logError("GetChangesSince Error: ", err)
+    }
+    return err
+}
+
+func (s *Server) GetFileHistory(fileName string, versions *[]FileVersion) error {
+    logDebug("GetFileHistory: ", fileName)
+    unlock := s.lockMeta(false)
+    defer func() {
+        unlock()
+    }()
+    err := s.MetaStore.GetFileHistory(fileName, versions)
+    if err != nil {
+        logError("GetFileHistory Error: ", err)
+    }
+    return err
+}
+
+func (s *Server) RestoreFile(args RestoreArgs, latestVersion *int) error {
+    logDebug("RestoreFile: ", args.Filename, args.Version)
+    unlock := s.lockMeta(true)
+    defer func() {
+        unlock()
+    }()
+    err := s.MetaStore.RestoreFile(args, latestVersion)
+    if err != nil {
+        logError("RestoreFile Error: ", err)
+    }
+    return err
+}
+
+func (s *Server) RenameFile(args RenameArgs, latestVersion *int) error {
+    logDebug("RenameFile: ", args.Source, args.Target)
+    unlock := s.lockMeta(true)
+    defer func() {
+        unlock()
+    }()
+    err := s.MetaStore.RenameFile(args, latestVersion)
+    if err != nil {
+        logError("RenameFile Error: ", err)
+    }
+    return err
+}
+
+func (s *Server) CreateSnapshot(name string, succ *bool) error {
+    logDebug("CreateSnapshot: ", name)
+    unlock := s.lockMeta(true)
+    defer func() {
+        unlock()
+    }()
+    err := s.MetaStore.CreateSnapshot(name, succ)
+    if err != nil {
+        logError("CreateSnapshot Error: ", err)
     }
     return err
 }
 
+func (s *Server) ListSnapshots(succ *bool, snapshots *[]SnapshotInfo) error {
+    logDebug("ListSnapshots")
+    unlock := s.lockMeta(false)
+    defer func() {
+        unlock()
+    }()
+    err := s.MetaStore.ListSnapshots(succ, snapshots)
+    if err != nil {
+        logError("ListSnapshots Error: ", err)
+    }
+    return err
+}
+
+func (s *Server) GetSnapshot(name string, files *map[string]FileMetaData) error {
+    logDebug("GetSnapshot: ", name)
+    unlock := s.lockMeta(false)
+    defer func() {
+        unlock()
+    }()
+    err := s.MetaStore.GetSnapshot(name, files)
+    if err != nil {
+        logError("GetSnapshot Error: ", err)
+    }
+    return err
+}
+
+/**
+* Returns the files changed after a cursor as soon as there are any, or an empty page with
+* the same cursor once the timeout has passed. Does not hold the lock while waiting.
+*/
+func (s *Server) WaitForChanges(args WaitArgs, reply *ChangesReply) error {
+    logDebug("WaitForChanges: ", args.Cursor.Epoch, args.Cursor.Sequence, args.Timeout)
+    notifier, ok := s.MetaStore.(ChangeNotifier)
+    if !ok {
+        err := errors.New("MetaStore does not support waiting for changes")
+        logError("WaitForChanges Error: ", err)
+        return err
+    }
+    timeout := args.Timeout
+    if timeout <= 0 {
+        timeout = DefaultWaitTimeout
+    } else if timeout > MaxWaitTimeout {
+        timeout = MaxWaitTimeout
+    }
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    for {
+        // Take the signal before looking, a change in between closes it
+        unlock := s.lockMeta(true)
+        changed := notifier.ChangeSignal()
+        unlock()
+        var page ChangesReply
+        if err := s.GetChangesSince(ChangesArgs{Cursor: args.Cursor}, &page); err != nil {
+            return err
+        }
+        if len(page.Changes) > 0 || page.Reset {
+            *reply = page
+            return nil
+        }
+        select {
+        case <-changed:
+        case <-timer.C:
+            *reply = page
+            return nil
+        }
+    }
+}
+
+/**
+* Lock the MetaStore for a call, exclusively for a write. A Raft-replicated MetaStore is not
+* locked, its node serializes the commands itself, and a lock held while a proposal waits for
+* a majority would stall every other metadata call. Blocks have a lock of their own.
+*/
+func (s *Server) lockMeta(write bool) (unlock func()) {
+    if _, ok := s.MetaStore.(*RaftMetaStore); ok {
+        return func() {}
+    }
+    if write {
+        s.metaMutex.Lock()
+        return s.metaMutex.Unlock
+    }
+    s.metaMutex.RLock()
+    return s.metaMutex.RUnlock
+}
+
 func (s *Server) GetBlock(blockHash string, blockData *Block) error {
+    logDebug("GetBlock: ", blockHash)
     s.Mutex.RLock()
     defer func() {
         s.Mutex.RUnlock()
     }()
     err := s.BlockStore.GetBlock(blockHash, blockData)
     if err != nil {
-        log.Println("GetBlock Error: ", err)
+        logError("GetBlock Error: ", err)
     }
     return err
 }
 
 func (s *Server) PutBlock(blockData Block, succ *bool) error {
+    logDebug("PutBlock: ", len(blockData.BlockData), "bytes")
+    if err := s.checkWholeBlocks(); err != nil {
+        logError("PutBlock Error: ", err)
+        return err
+    }
+    if err := s.checkBlockSize(blockData); err != nil {
+        logError("PutBlock Error: ", err)
+        return err
+    }
     s.Mutex.Lock()
     defer func() {
         s.Mutex.Unlock()
     }()
     err := s.BlockStore.PutBlock(blockData, succ)
     if err != nil {
-        log.Println("PutBlock Error: ", err)
+        logError("PutBlock Error: ", err)
     }
     return err
 }
 
 func (s *Server) HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error {
+    logDebug("HasBlocks: ", len(blockHashesIn), "hashes")
     s.Mutex.Lock()
     defer func() {
         s.Mutex.Unlock()
     }()
     err := s.BlockStore.HasBlocks(blockHashesIn, blockHashesOut)
     if err != nil {
-        log.Println("HasBlocks Error: ", err)
+        logError("HasBlocks Error: ", err)
     }
     return err
-}   
+}
+
+/**
+* Returns the requested blocks in order, stopping early once the batch reaches MaxBatchBytes.
+* At least one block is always returned, the client asks again for the rest.
+*/
+func (s *Server) GetBlocks(blockHashes []string, blocks *[]Block) error {
+    logDebug("GetBlocks: ", len(blockHashes), "hashes")
+    s.Mutex.RLock()
+    defer func() {
+        s.Mutex.RUnlock()
+    }()
+    var all []Block
+    err := s.BlockStore.GetBlocks(blockHashes, &all)
+    if err != nil {
+        logError("GetBlocks Error: ", err)
+        return err
+    }
+    size := 0
+    for i, block := range all {
+        size += len(block.BlockData)
+        if i > 0 && size > s.maxBatchBytes() {
+            break
+        }
+        *blocks = append(*blocks, block)
+    }
+    return nil
+}
+
+func (s *Server) PutBlocks(blocks []Block, succ *bool) error {
+    logDebug("PutBlocks: ", len(blocks), "blocks")
+    if err := s.checkWholeBlocks(); err != nil {
+        logError("PutBlocks Error: ", err)
+        return err
+    }
+    size := 0
+    for _, block := range blocks {
+        if err := s.checkBlockSize(block); err != nil {
+            logError("PutBlocks Error: ", err)
+            return err
+        }
+        size += len(block.BlockData)
+    }
+    if len(blocks) > 1 && size > s.maxBatchBytes() {
+        err := errors.New("Batch of " + strconv.Itoa(size) + " bytes exceeds the limit of " + strconv.Itoa(s.maxBatchBytes()) + " bytes")
+        logError("PutBlocks Error: ", err)
+        return err
+    }
+
+    s.Mutex.Lock()
+    defer func() {
+        s.Mutex.Unlock()
+    }()
+    err := s.BlockStore.PutBlocks(blocks, succ)
+    if err != nil {
+        logError("PutBlocks Error: ", err)
+    }
+    return err
+}
+
+/**
+* Returns the replication settings of the block cluster of this server. WriteQuorum is left
+* to the client.
+*/
+func (s *Server) GetReplicationConfig(_ignore *bool, config *ReplicationConfig) error {
+    logDebug("GetReplicationConfig")
+    *config = s.Replication
+    config.WriteQuorum = 0
+    return nil
+}
+
+/**
+* Reject whole blocks on a server of an erasure coded cluster, the client was configured for
+* another cluster.
+*/
+func (s *Server) checkWholeBlocks() error {
+    if s.Replication.erasureCoded() {
+        return errors.New("Block cluster is erasure coded, it stores shards instead of blocks")
+    }
+    return nil
+}
+
+/**
+* Reject blocks larger than MaxBlockSize.
+*/
+func (s *Server) checkBlockSize(block Block) error {
+    if s.MaxBlockSize > 0 && len(block.BlockData) > s.MaxBlockSize {
+        return errors.New("Block of " + strconv.Itoa(len(block.BlockData)) + " bytes exceeds the limit of " + strconv.Itoa(s.MaxBlockSize) + " bytes")
+    }
+    return nil
+}
+
+func (s *Server) maxBatchBytes() int {
+    if s.MaxBatchBytes <= 0 {
+        return DefaultMaxBatchBytes
+    }
+    return s.MaxBatchBytes
+}
 
 // This line guarantees all method for surfstore are implemented
 var _ Surfstore = new(Server)
+var _ ChangeWatcher = new(Server)
 
 func NewSurfstoreServer() Server {
     blockStore := BlockStore{BlockMap: map[string]Block{}}
-    metaStore := MetaStore{FileMetaMap: map[string]FileMetaData{}}
+    metaStore := NewMetaStore()
+
+    return NewSurfstoreServerWithStores(&blockStore, metaStore)
+}
+
+/**
+* Create a server on top of the given stores, e.g. a DiskBlockStore instead of the
+* in-memory BlockStore.
+*/
+func NewSurfstoreServerWithStores(blockStore BlockStoreInterface, metaStore MetaStoreInterface) Server {
     mutex := &sync.RWMutex{}
 
     return Server{
-        BlockStore: &blockStore,
-        MetaStore:  &metaStore,
+        BlockStore: blockStore,
+        MetaStore:  metaStore,
         Mutex: mutex,
+        metaMutex: &sync.RWMutex{},
+        MaxBatchBytes: DefaultMaxBatchBytes,
+    }
+}
+
+const (
+    // Keep blocks and metadata in memory only
+    MemoryBackend = "memory"
+    // Keep blocks and metadata on disk under the data directory
+    DiskBackend = "disk"
+)
+
+/**
+* Everything needed to build a server, usually filled in from command-line flags.
+*/
+type ServerConfig struct {
+    Backend       string
+    DataDir       string
+    MaxBlockSize  int
+    MaxBatchBytes int
+
+    // Replicate the metadata with Raft among these servers, the address of this server
+    // must be RaftID and be one of them. Empty means no replication.
+    RaftID    string
+    RaftPeers []string
+
+    // How the block cluster of this server protects blocks
+    Replication ReplicationConfig
+
+    // Metadata servers whose files reference the blocks of this server, for garbage
+    // collection. Defaults to RaftPeers, empty means the metadata of this server.
+    GCMetaAddrs []string
+}
+
+/**
+* Create a server with the storage backend selected in config.
+* The disk backend keeps blocks in DataDir/blocks and the metadata log in DataDir/meta,
+* or the Raft state in DataDir/raft if the metadata is replicated.
+*/
+func NewSurfstoreServerFromConfig(config ServerConfig) (Server, error) {
+    if err := config.Replication.Validate(); err != nil {
+        return Server{}, err
     }
+    var blockStore BlockStoreInterface
+    var metaStore MetaStoreInterface
+    switch config.Backend {
+    case MemoryBackend, "":
+        blockStore = &BlockStore{BlockMap: map[string]Block{}}
+        metaStore = NewMetaStore()
+    case DiskBackend:
+        if config.DataDir == "" {
+            return Server{}, errors.New("The disk backend needs a data directory")
+        }
+        diskBlockStore, err := NewDiskBlockStore(filepath.Join(config.DataDir, "blocks"))
+        if err != nil {
+            return Server{}, err
+        }
+        blockStore = diskBlockStore
+        if len(config.RaftPeers) == 0 {
+            persistentMetaStore, err := NewPersistentMetaStore(filepath.Join(config.DataDir, "meta"), DefaultSnapshotInterval)
+            if err != nil {
+                return Server{}, err
+            }
+            metaStore = persistentMetaStore
+        }
+    default:
+        return Server{}, errors.New("Unknown storage backend: " + config.Backend)
+    }
+
+    if len(config.RaftPeers) > 0 {
+        raftConfig := RaftConfig{ID: config.RaftID, Peers: config.RaftPeers}
+        if config.Backend == DiskBackend {
+            raftConfig.DataDir = filepath.Join(config.DataDir, "raft")
+        }
+        raftMetaStore, err := NewRaftMetaStore(raftConfig, NewRPCRaftTransport(DefaultRaftElectionTimeout))
+        if err != nil {
+            return Server{}, err
+        }
+        metaStore = raftMetaStore
+    }
+
+    server := NewSurfstoreServerWithStores(blockStore, metaStore)
+    server.MaxBlockSize = config.MaxBlockSize
+    server.Replication = config.Replication
+    // Every node asks the leader, a follower's copy may lag behind
+    server.GCMetaAddrs = config.GCMetaAddrs
+    if len(server.GCMetaAddrs) == 0 {
+        server.GCMetaAddrs = config.RaftPeers
+    }
+    if config.MaxBatchBytes > 0 {
+        server.MaxBatchBytes = config.MaxBatchBytes
+    }
+    return server, nil
 }
 
 /**
 * RPC server.
+* A Raft-replicated server also serves the "Raft" service for its peers.
+* Returns an error if the address cannot be listened on.
 */
 func ServeSurfstoreServer(hostAddr string, surfstoreServer Server) error {
-    log.Println("Server started, hostAddr: ", hostAddr)
-    rpc.Register(&surfstoreServer)
-    rpc.HandleHTTP()
     l, err := net.Listen("tcp", hostAddr)
     if err != nil {
-        log.Println("listen error: ", err)
+        logError("listen error: ", err)
+        return err
+    }
+    logInfo("Server started, hostAddr: ", hostAddr)
+
+    // A server of its own, so that several servers can run in one process
+    rpcServer := rpc.NewServer()
+    if err = rpcServer.RegisterName("Server", &surfstoreServer); err != nil {
+        return err
+    }
+    if raftStore, ok := surfstoreServer.MetaStore.(*RaftMetaStore); ok {
+        if err = rpcServer.RegisterName("Raft", raftStore.Node); err != nil {
+            return err
+        }
+        raftStore.Node.Start()
     }
-    return http.Serve(l, nil)
+    mux := http.NewServeMux()
+    mux.Handle(rpc.DefaultRPCPath, rpcServer)
+    return http.Serve(l, mux)
 }
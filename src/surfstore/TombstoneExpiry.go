@@ -0,0 +1,59 @@
+package surfstore
+
+import (
+    "errors"
+    "time"
+)
+
+const (
+    // How often a server with a tombstone retention looks for expired tombstones
+    DefaultTombstoneCheckInterval = time.Hour
+)
+
+/**
+* Tombstone expiry removes deleted files from the MetaStore once they have been deleted for
+* longer than retention. Clients that have not synced since are told by GetChangesSince, and
+* remove files that were deleted in the meantime instead of uploading them again.
+* Returns the number of purged files.
+*/
+func (s *Server) ExpireTombstones(retention time.Duration) (int, error) {
+    purger, ok := s.MetaStore.(TombstonePurger)
+    if !ok {
+        return 0, errors.New("MetaStore cannot purge tombstones")
+    }
+
+    unlock := s.lockMeta(true)
+    defer func() {
+        unlock()
+    }()
+    removed, err := purger.PurgeTombstones(time.Now().Add(-retention))
+    if _, notLeader := err.(*NotLeaderError); err != nil && !notLeader {
+        logError("ExpireTombstones Error: ", err)
+    }
+    return removed, err
+}
+
+/**
+* Run ExpireTombstones every interval until the returned stop function is called.
+*/
+func (s *Server) StartTombstoneExpiry(interval time.Duration, retention time.Duration) (stop func()) {
+    done := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                removed, err := s.ExpireTombstones(retention)
+                if err == nil && removed > 0 {
+                    logInfo("Tombstone expiry purged", removed, "deleted files")
+                }
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func() {
+        close(done)
+    }
+}
@@ -0,0 +1,209 @@
+package surfstore
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+    "unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+    syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+/**
+* Watches a directory tree with inotify. Changed paths are sent on Events relative to the
+* root and slash-separated, "" means events were lost and anything may have changed.
+* Events is closed when the watcher is closed.
+*/
+type dirWatcher struct {
+    Events chan string
+    Errors chan error
+
+    root string
+    fd   int
+    file *os.File
+    // Closed by Close, pending sends give up
+    done chan struct{}
+    // Closed when the reading goroutine exits
+    stopped   chan struct{}
+    closeOnce sync.Once
+    closeErr  error
+    // Relative directory of each watch descriptor, only used by the reading goroutine
+    watches map[int32]string
+}
+
+func newDirWatcher(root string) (*dirWatcher, error) {
+    fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+    if err != nil {
+        return nil, os.NewSyscallError("inotify_init1", err)
+    }
+    w := &dirWatcher{
+        Events:  make(chan string, 256),
+        Errors:  make(chan error, 1),
+        root:    root,
+        fd:      fd,
+        // Non-blocking, so reads wait in the runtime poller and Close interrupts them
+        file:    os.NewFile(uintptr(fd), "inotify"),
+        done:    make(chan struct{}),
+        stopped: make(chan struct{}),
+        watches: make(map[int32]string),
+    }
+    if err := w.addTree("", false); err != nil {
+        w.file.Close()
+        return nil, err
+    }
+    go w.readEvents()
+    return w, nil
+}
+
+var errWatcherClosed = errors.New("Watcher is closed")
+
+/**
+* Stop watching and wait for the reading goroutine to exit.
+*/
+func (w *dirWatcher) Close() error {
+    w.closeOnce.Do(func() {
+        close(w.done)
+        // Wake up a pending read, the descriptor is closed once nothing uses it anymore
+        w.file.SetReadDeadline(time.Now())
+        <-w.stopped
+        w.closeErr = w.file.Close()
+    })
+    return w.closeErr
+}
+
+/**
+* Send an event unless the watcher was closed, which is reported as false.
+*/
+func (w *dirWatcher) send(fileName string) bool {
+    select {
+    case w.Events <- fileName:
+        return true
+    case <-w.done:
+        return false
+    }
+}
+
+/**
+* Watch a directory and every directory below it. With emit, every path found is sent as
+* an event, they may have been created before the watch was in place.
+*/
+func (w *dirWatcher) addTree(dir string, emit bool) error {
+    return filepath.Walk(filepath.Join(w.root, filepath.FromSlash(dir)), func(path string, f os.FileInfo, err error) error {
+        if err != nil {
+            // Removed while walking, its events say so
+            return nil
+        }
+        relPath, err := filepath.Rel(w.root, path)
+        if err != nil {
+            return err
+        }
+        fileName := filepath.ToSlash(relPath)
+        if fileName == "." {
+            fileName = ""
+        }
+        if emit && !w.send(fileName) {
+            return errWatcherClosed
+        }
+        if !f.IsDir() {
+            return nil
+        }
+        wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+        if err == syscall.ENOENT || err == syscall.ENOTDIR {
+            return nil
+        }
+        if err != nil {
+            return os.NewSyscallError("inotify_add_watch", err)
+        }
+        // Watching a moved directory again returns its old descriptor
+        w.watches[int32(wd)] = fileName
+        return nil
+    })
+}
+
+/**
+* Stop watching a directory that was moved away, its descriptors would report wrong paths.
+*/
+func (w *dirWatcher) removeTree(dir string) {
+    for wd, fileName := range w.watches {
+        if fileName == dir || strings.HasPrefix(fileName, dir + "/") {
+            syscall.InotifyRmWatch(w.fd, uint32(wd))
+            delete(w.watches, wd)
+        }
+    }
+}
+
+func (w *dirWatcher) readEvents() {
+    defer close(w.stopped)
+    defer close(w.Events)
+    buf := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+    for {
+        n, err := w.file.Read(buf)
+        if err != nil {
+            select {
+            case <-w.done:
+            default:
+                w.reportError(err)
+            }
+            return
+        }
+        for offset := 0; offset + syscall.SizeofInotifyEvent <= n; {
+            event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+            nameStart := offset + syscall.SizeofInotifyEvent
+            name := strings.TrimRight(string(buf[nameStart : nameStart + int(event.Len)]), "\x00")
+            offset = nameStart + int(event.Len)
+            w.handleEvent(event.Wd, event.Mask, name)
+        }
+    }
+}
+
+func (w *dirWatcher) handleEvent(wd int32, mask uint32, name string) {
+    if mask & syscall.IN_Q_OVERFLOW != 0 {
+        w.send("")
+        return
+    }
+    dir, ok := w.watches[wd]
+    if !ok {
+        return
+    }
+    if mask & syscall.IN_IGNORED != 0 {
+        delete(w.watches, wd)
+        return
+    }
+    fileName := name
+    if dir != "" {
+        fileName = dir + "/" + name
+    }
+    if name == "" {
+        // An event of the watched directory itself
+        fileName = dir
+    }
+
+    isDir := mask & syscall.IN_ISDIR != 0
+    switch {
+    case isDir && mask & syscall.IN_MOVED_FROM != 0:
+        w.removeTree(fileName)
+    case isDir && mask & (syscall.IN_CREATE | syscall.IN_MOVED_TO) != 0:
+        if err := w.addTree(fileName, true); err != nil && err != errWatcherClosed {
+            w.reportError(err)
+            // Files below it go unnoticed, have them rescanned
+            w.send("")
+        }
+        return
+    }
+    w.send(fileName)
+}
+
+/**
+* Errors are dropped while an earlier one has not been received.
+*/
+func (w *dirWatcher) reportError(err error) {
+    select {
+    case w.Errors <- err:
+    default:
+    }
+}
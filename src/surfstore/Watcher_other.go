@@ -0,0 +1,23 @@
+//go:build !linux
+
+package surfstore
+
+import (
+    "errors"
+)
+
+/**
+* Directory watching needs inotify, elsewhere the client daemon rescans periodically.
+*/
+type dirWatcher struct {
+    Events chan string
+    Errors chan error
+}
+
+func newDirWatcher(root string) (*dirWatcher, error) {
+    return nil, errors.New("Watching directories is only supported on Linux")
+}
+
+func (w *dirWatcher) Close() error {
+    return nil
+}
@@ -1,24 +1,136 @@
 package main
 
 import (
+    "flag"
     "fmt"
     "os"
     "strconv"
+    "strings"
+    "os/signal"
     "surfstore"
+    "syscall"
 )
 
+const usage = "Usage: ./run-client [-chunking fixed|cdc] [-min-chunk bytes] [-avg-chunk bytes] [-max-chunk bytes] [-meta host:port,...] [-blocks host:port,...] [-write-quorum n] [-merge] [-watch [-debounce d] [-poll-interval d]] host:port baseDir blockSize [history file | restore file version | snapshot name | snapshots | materialize name dir]"
+
 func main() {
-    if len(os.Args) < 4 {
-        fmt.Println("Usage: ./run-client host:port baseDir blockSize")
+    chunking := flag.String("chunking", surfstore.FixedChunking, "how files are cut into blocks: fixed or cdc (content-defined)")
+    minChunk := flag.Int("min-chunk", 0, "minimum chunk size for cdc, defaults to avg-chunk/4")
+    avgChunk := flag.Int("avg-chunk", 0, "average chunk size for cdc, defaults to blockSize")
+    maxChunk := flag.Int("max-chunk", 0, "maximum chunk size for cdc, defaults to avg-chunk*4")
+    meta := flag.String("meta", "", "comma-separated host:port of a Raft metadata cluster, defaults to host:port")
+    blocks := flag.String("blocks", "", "comma-separated host:port of block servers to shard blocks over, defaults to host:port")
+    writeQuorum := flag.Int("write-quorum", 0, "replicas or shards that must be stored before a write succeeds, the -blocks servers set how many there are, defaults to a majority of replicas or data shards plus half the parity shards")
+    merge := flag.Bool("merge", false, "merge text files edited here and on the server instead of keeping a conflicted copy")
+    watch := flag.Bool("watch", false, "keep running, sync local changes as they happen and remote ones as the server reports them")
+    debounce := flag.Duration("debounce", surfstore.DefaultDebounce, "with -watch, quiet time after local writes before syncing")
+    pollInterval := flag.Duration("poll-interval", surfstore.DefaultPollInterval, "with -watch, sync at least this often")
+    flag.Usage = func() {
+        fmt.Println(usage)
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    if flag.NArg() < 3 {
+        flag.Usage()
         os.Exit(1)
     }
 
-    hostPort := os.Args[1]
-    baseDir := os.Args[2]
-    blockSize, err := strconv.Atoi(os.Args[3])
+    hostPort := flag.Arg(0)
+    baseDir := flag.Arg(1)
+    blockSize, err := strconv.Atoi(flag.Arg(2))
     if err != nil {
-        fmt.Println("Usage: ./run-client host:port baseDir blockSize")
+        fmt.Println(usage)
+        os.Exit(1)
     }
     rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-    surfstore.ClientSync(rpcClient)
+    rpcClient.Chunking = surfstore.ChunkingConfig{
+        Mode:    *chunking,
+        MinSize: *minChunk,
+        AvgSize: *avgChunk,
+        MaxSize: *maxChunk,
+    }
+    rpcClient.MergeText = *merge
+    if err := rpcClient.Chunking.Validate(blockSize); err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    if *meta != "" {
+        rpcClient.UseMetaCluster(strings.Split(*meta, ","))
+    }
+    if *blocks != "" {
+        if err := rpcClient.UseBlockCluster(strings.Split(*blocks, ","), *writeQuorum); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+    switch flag.Arg(3) {
+    case "history":
+        if flag.NArg() != 5 {
+            flag.Usage()
+            os.Exit(1)
+        }
+        err = surfstore.PrintFileHistory(rpcClient, flag.Arg(4))
+    case "restore":
+        if flag.NArg() != 6 {
+            flag.Usage()
+            os.Exit(1)
+        }
+        version, convErr := strconv.Atoi(flag.Arg(5))
+        if convErr != nil {
+            flag.Usage()
+            os.Exit(1)
+        }
+        err = surfstore.RestoreFile(rpcClient, flag.Arg(4), version)
+    case "snapshot":
+        if flag.NArg() != 5 {
+            flag.Usage()
+            os.Exit(1)
+        }
+        var succ bool
+        err = rpcClient.CreateSnapshot(flag.Arg(4), &succ)
+    case "snapshots":
+        if flag.NArg() != 4 {
+            flag.Usage()
+            os.Exit(1)
+        }
+        err = surfstore.PrintSnapshots(rpcClient)
+    case "materialize":
+        if flag.NArg() != 6 {
+            flag.Usage()
+            os.Exit(1)
+        }
+        err = surfstore.MaterializeSnapshot(rpcClient, flag.Arg(4), flag.Arg(5))
+    case "":
+        runSync(rpcClient, *watch, surfstore.DaemonConfig{Debounce: *debounce, PollInterval: *pollInterval})
+    default:
+        flag.Usage()
+        os.Exit(1)
+    }
+    rpcClient.Close()
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+}
+
+/**
+* Sync once, or keep syncing until SIGINT or SIGTERM with watch.
+*/
+func runSync(rpcClient surfstore.RPCClient, watch bool, config surfstore.DaemonConfig) {
+    if watch {
+        stop := make(chan struct{})
+        signals := make(chan os.Signal, 1)
+        signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+        go func() {
+            <-signals
+            // A second signal kills the client right away
+            signal.Stop(signals)
+            fmt.Println("Shutting down after the current sync")
+            close(stop)
+        }()
+        surfstore.RunDaemon(rpcClient, config, stop)
+    } else {
+        surfstore.ClientSync(rpcClient)
+    }
 }
@@ -1,11 +1,78 @@
 package main
 
 import (
+    "flag"
+    "fmt"
     "log"
+    "os"
+    "strings"
     "surfstore"
+    "time"
 )
 
 func main() {
-    serverInstance := surfstore.NewSurfstoreServer()
-    log.Fatal(surfstore.ServeSurfstoreServer("localhost:8080", serverInstance))
+    addr := flag.String("addr", "localhost:8080", "address to listen on, host:port")
+    backend := flag.String("backend", surfstore.MemoryBackend, "storage backend: memory or disk")
+    dataDir := flag.String("datadir", "surfstore-data", "directory for blocks and metadata of the disk backend")
+    logLevel := flag.String("loglevel", "info", "log level: debug, info or error")
+    maxBlockSize := flag.Int("max-block-size", 0, "reject blocks larger than this many bytes, 0 for no limit")
+    maxBatchBytes := flag.Int("max-batch-bytes", surfstore.DefaultMaxBatchBytes, "maximum block payload of one batch call")
+    gcInterval := flag.Duration("gc-interval", 0, "how often to collect unreferenced blocks, 0 to disable")
+    gcMeta := flag.String("gc-meta", "", "comma-separated host:port of the metadata servers whose files reference the blocks of this server, required for -gc-interval on a block server")
+    tombstoneRetention := flag.Duration("tombstone-retention", 0, "forget deleted files after this long, 0 to keep them forever")
+    tombstoneCheckInterval := flag.Duration("tombstone-check-interval", surfstore.DefaultTombstoneCheckInterval, "how often to look for deleted files past -tombstone-retention")
+    raftPeers := flag.String("raft-peers", "", "comma-separated host:port of every metadata server in the Raft cluster, including -addr")
+    blockPeers := flag.String("block-peers", "", "comma-separated host:port of every block server sharing blocks with -replicas copies, including -addr")
+    replicas := flag.Int("replicas", 1, "copies of each block kept on the -block-peers servers")
+    dataShards := flag.Int("data-shards", 0, "erasure code blocks on the -block-peers servers into this many data shards instead of copying them")
+    parityShards := flag.Int("parity-shards", 0, "parity shards per erasure coded block, as many -block-peers servers may be lost")
+    replicateInterval := flag.Duration("replicate-interval", time.Minute, "how often to restore the replication factor of the local blocks, or rebuild lost shards")
+    flag.Parse()
+
+    if flag.NArg() > 0 {
+        flag.Usage()
+        os.Exit(1)
+    }
+    if err := surfstore.SetLogLevel(*logLevel); err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+
+    config := surfstore.ServerConfig{
+        Backend:       *backend,
+        DataDir:       *dataDir,
+        MaxBlockSize:  *maxBlockSize,
+        MaxBatchBytes: *maxBatchBytes,
+        Replication:   surfstore.ReplicationConfig{
+            Factor:       *replicas,
+            DataShards:   *dataShards,
+            ParityShards: *parityShards,
+        },
+    }
+    if *raftPeers != "" {
+        config.RaftID = *addr
+        config.RaftPeers = strings.Split(*raftPeers, ",")
+    }
+    if *gcMeta != "" {
+        config.GCMetaAddrs = strings.Split(*gcMeta, ",")
+    } else if *gcInterval > 0 && *blockPeers != "" {
+        // Its own metadata references none of the blocks, everything would be collected
+        log.Fatal("A block server needs -gc-meta to collect garbage")
+    }
+    serverInstance, err := surfstore.NewSurfstoreServerFromConfig(config)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if *gcInterval > 0 {
+        serverInstance.StartGarbageCollector(*gcInterval, surfstore.DefaultGCGracePeriod)
+    }
+    if *tombstoneRetention > 0 {
+        serverInstance.StartTombstoneExpiry(*tombstoneCheckInterval, *tombstoneRetention)
+    }
+    if *blockPeers != "" && (*replicas > 1 || *dataShards > 0) {
+        if _, err := serverInstance.StartBlockReplicator(*addr, strings.Split(*blockPeers, ","), *replicateInterval); err != nil {
+            log.Fatal(err)
+        }
+    }
+    log.Fatal(surfstore.ServeSurfstoreServer(*addr, serverInstance))
 }